@@ -5,8 +5,10 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 
+	"github.com/pseudonator/recaptcha-processing-server/pkg/logging"
 	"github.com/pseudonator/recaptcha-processing-server/pkg/server"
 	"github.com/pseudonator/recaptcha-processing-server/pkg/version"
 	"go.uber.org/zap"
@@ -18,7 +20,7 @@ func main() {
 }
 
 func start() int {
-	log, err := createLogger()
+	log, level, err := createLogger()
 	if err != nil {
 		fmt.Println("error setting up the logger:", err)
 		return 1
@@ -32,7 +34,8 @@ func start() int {
 	}()
 
 	s := server.New(server.Options{
-		Log: log,
+		Log:      log,
+		LogLevel: &level,
 	})
 
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
@@ -63,6 +66,36 @@ func start() int {
 	return 0
 }
 
-func createLogger() (*zap.Logger, error) {
-	return zap.NewProduction()
+// The logger is configured before the server, from the LOG_* env vars
+func createLogger() (*zap.Logger, zap.AtomicLevel, error) {
+	sampling, err := getBoolOrDefault("LOG_SAMPLING", true)
+	if err != nil {
+		return nil, zap.AtomicLevel{}, err
+	}
+	development, err := getBoolOrDefault("LOG_DEVELOPMENT", false)
+	if err != nil {
+		return nil, zap.AtomicLevel{}, err
+	}
+	redaction, err := getBoolOrDefault("LOG_REDACTION", true)
+	if err != nil {
+		return nil, zap.AtomicLevel{}, err
+	}
+	opts, err := logging.ParseOptions(os.Getenv("LOG_LEVEL"), os.Getenv("LOG_FORMAT"), sampling, development)
+	if err != nil {
+		return nil, zap.AtomicLevel{}, err
+	}
+	opts.DisableRedaction = !redaction
+	return logging.New(opts)
+}
+
+func getBoolOrDefault(name string, defaultV bool) (bool, error) {
+	v, ok := os.LookupEnv(name)
+	if !ok || v == "" {
+		return defaultV, nil
+	}
+	vAsBool, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s '%s'", name, v)
+	}
+	return vAsBool, nil
 }
@@ -0,0 +1,185 @@
+// Package attest signs verdict attestations as JWTs with an Ed25519 (EdDSA) or P-256 (ES256) key,
+// so that the backends can trust a verdict without trusting every header reaching them.
+// The public keys are published as a JSON Web Key Set.
+package attest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+const (
+	AlgEdDSA = "EdDSA"
+	AlgES256 = "ES256"
+)
+
+// Sources of the verdicts, telling how the request was allowed.
+const (
+	// Verified with reCAPTCHA, the only source with a score and an action
+	SourceVerification = "verification"
+	// Allowed with a captcha pass, issued by an earlier verification or by the challenge
+	SourcePass = "pass"
+	// Refused, then allowed by the shadow mode
+	SourceShadow = "shadow"
+	// Allowed without verification by the fail-open mode, as reCAPTCHA could not be reached
+	SourceFailOpen = "fail_open"
+)
+
+// Claims of a verdict attestation.
+type Claims struct {
+	Issuer  string `json:"iss"`
+	SiteKey string `json:"site_key,omitempty"`
+	// How the request was allowed, SourceVerification when empty
+	Source string  `json:"source"`
+	Action string  `json:"action"`
+	Score  float64 `json:"score"`
+	// Name of the reCAPTCHA Enterprise assessment, empty for the classic verification
+	AssessmentId string `json:"assessment_id,omitempty"`
+	// Code of the refusal overridden by the shadow or the fail-open mode
+	Refusal   string `json:"refusal,omitempty"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
+
+// Signer signs the attestations with its private key.
+type Signer struct {
+	key    crypto.Signer
+	alg    string
+	keyId  string
+	issuer string
+	ttl    time.Duration
+}
+
+// NewSigner creates a signer for an Ed25519 or a P-256 private key. Without a key ID,
+// the RFC 7638 thumbprint of the public key is used.
+func NewSigner(key crypto.Signer, keyId string, issuer string, ttl time.Duration) (*Signer, error) {
+	if ttl <= 0 {
+		return nil, errors.New("attestation ttl must be positive")
+	}
+	signer := &Signer{key: key, keyId: keyId, issuer: issuer, ttl: ttl}
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		signer.alg = AlgEdDSA
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return nil, errors.New("only P-256 ECDSA keys are supported")
+		}
+		signer.alg = AlgES256
+	default:
+		return nil, fmt.Errorf("unsupported attestation key type %T", key)
+	}
+	if signer.keyId == "" {
+		jwk, err := publicJwk(key.Public(), "", "")
+		if err != nil {
+			return nil, err
+		}
+		signer.keyId = jwk.thumbprint()
+	}
+	return signer, nil
+}
+
+// GenerateKey creates an ephemeral Ed25519 key, which is lost on restart and differs between replicas.
+func GenerateKey() (crypto.Signer, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	return key, err
+}
+
+// ParsePrivateKey reads a PKCS #8 or SEC 1 PEM encoded private key.
+func ParsePrivateKey(content []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported attestation key type %T", key)
+		}
+		return signer, nil
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	return nil, fmt.Errorf("unsupported PEM block '%s'", block.Type)
+}
+
+// TTL is the lifetime of the attestations.
+func (s *Signer) TTL() time.Duration {
+	return s.ttl
+}
+
+// Sign the claims as a compact JWT, setting the issuer, the issue time and the expiry.
+func (s *Signer) Sign(claims Claims, now time.Time) (string, error) {
+	claims.Issuer = s.issuer
+	claims.IssuedAt = now.Unix()
+	claims.ExpiresAt = now.Add(s.ttl).Unix()
+
+	encodedHeader, err := encodeSegment(header{Alg: s.alg, Typ: "JWT", Kid: s.keyId})
+	if err != nil {
+		return "", err
+	}
+	encodedClaims, err := encodeSegment(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := encodedHeader + "." + encodedClaims
+
+	var signature []byte
+	switch s.alg {
+	case AlgEdDSA:
+		signature, err = s.key.Sign(rand.Reader, []byte(signingInput), crypto.Hash(0))
+	case AlgES256:
+		digest := sha256.Sum256([]byte(signingInput))
+		var r, sv *big.Int
+		r, sv, err = ecdsa.Sign(rand.Reader, s.key.(*ecdsa.PrivateKey), digest[:])
+		if err == nil {
+			// JWS encodes the ECDSA signatures as the fixed size R || S
+			signature = make([]byte, 64)
+			r.FillBytes(signature[:32])
+			sv.FillBytes(signature[32:])
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// JWKS returns the key set publishing the public key of the signer.
+func (s *Signer) JWKS() (*JSONWebKeySet, error) {
+	jwk, err := publicJwk(s.key.Public(), s.keyId, s.alg)
+	if err != nil {
+		return nil, err
+	}
+	return &JSONWebKeySet{Keys: []JSONWebKey{*jwk}}, nil
+}
+
+func encodeSegment(v any) (string, error) {
+	content, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(content), nil
+}
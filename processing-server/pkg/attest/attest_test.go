@@ -0,0 +1,333 @@
+package attest
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newSigner(t *testing.T, key crypto.Signer, keyId string) *Signer {
+	t.Helper()
+	signer, err := NewSigner(key, keyId, "test", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func newEd25519Key(t *testing.T) crypto.Signer {
+	t.Helper()
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func newP256Key(t *testing.T) crypto.Signer {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func jwks(t *testing.T, signers ...*Signer) *JSONWebKeySet {
+	t.Helper()
+	set := &JSONWebKeySet{}
+	for _, signer := range signers {
+		keys, err := signer.JWKS()
+		if err != nil {
+			t.Fatal(err)
+		}
+		set.Keys = append(set.Keys, keys.Keys...)
+	}
+	return set
+}
+
+func TestVerify(t *testing.T) {
+	now := time.Now()
+	for name, key := range map[string]crypto.Signer{AlgEdDSA: newEd25519Key(t), AlgES256: newP256Key(t)} {
+		t.Run(name, func(t *testing.T) {
+			signer := newSigner(t, key, "")
+			token, err := signer.Sign(Claims{Source: SourceVerification, Action: "submit", Score: 0.9}, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			verifier := NewVerifier(jwks(t, signer), "test")
+
+			tests := []struct {
+				name string
+				now  time.Time
+				err  error
+			}{
+				{name: "valid", now: now},
+				// Clocks of the backends behind the processing server, the issue time is not checked
+				{name: "verifier clock behind", now: now.Add(-time.Minute)},
+				{name: "last second", now: now.Add(time.Minute - time.Second)},
+				{name: "expired", now: now.Add(time.Minute), err: ErrExpired},
+			}
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					claims, err := verifier.Verify(context.Background(), token, tt.now)
+					if !errors.Is(err, tt.err) {
+						t.Fatalf("got error %v, want %v", err, tt.err)
+					}
+					if err == nil && (claims.Issuer != "test" || claims.Action != "submit" || claims.Score != 0.9 || claims.Source != SourceVerification) {
+						t.Errorf("got claims %+v", claims)
+					}
+				})
+			}
+
+			if _, err := NewVerifier(jwks(t, signer), "other").Verify(context.Background(), token, now); !errors.Is(err, ErrIssuer) {
+				t.Errorf("got error %v for another issuer, want %v", err, ErrIssuer)
+			}
+			if _, err := NewVerifier(jwks(t, signer), "").Verify(context.Background(), token, now); err != nil {
+				t.Errorf("got error %v without issuer", err)
+			}
+		})
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	now := time.Now()
+	old := newSigner(t, newEd25519Key(t), "")
+	rotated := newSigner(t, newP256Key(t), "")
+	oldToken, err := old.Sign(Claims{}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newToken, err := rotated.Sign(Claims{}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both keys are published during the rotation
+	verifier := NewVerifier(jwks(t, rotated, old), "test")
+	for _, token := range []string{oldToken, newToken} {
+		if _, err := verifier.Verify(context.Background(), token, now); err != nil {
+			t.Errorf("got error %v during the rotation", err)
+		}
+	}
+	if _, err := NewVerifier(jwks(t, rotated), "test").Verify(context.Background(), oldToken, now); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("got error %v for a removed key, want %v", err, ErrUnknownKey)
+	}
+}
+
+func TestTampered(t *testing.T) {
+	now := time.Now()
+	edSigner := newSigner(t, newEd25519Key(t), "ed")
+	ecSigner := newSigner(t, newP256Key(t), "ec")
+	verifier := NewVerifier(jwks(t, edSigner, ecSigner), "test")
+	token, err := edSigner.Sign(Claims{Score: 0.1}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token, ".")
+
+	// Raising the score, keeping the signature
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		t.Fatal(err)
+	}
+	claims.Score = 0.9
+	raised, _ := encodeSegment(claims)
+
+	// Signed by another key under the same key ID
+	forged, err := newSigner(t, newEd25519Key(t), "ed").Sign(Claims{Score: 0.9}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	withHeader := func(h header, signature string) string {
+		encoded, _ := encodeSegment(h)
+		return encoded + "." + parts[1] + "." + signature
+	}
+	ecToken, err := ecSigner.Sign(Claims{}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecParts := strings.Split(ecToken, ".")
+
+	tests := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{name: "raised score", token: parts[0] + "." + raised + "." + parts[2], err: ErrSignature},
+		{name: "other key", token: forged, err: ErrSignature},
+		{name: "truncated signature", token: parts[0] + "." + parts[1] + "." + parts[2][:10], err: ErrSignature},
+		{name: "no signature", token: parts[0] + "." + parts[1] + ".", err: ErrSignature},
+		{name: "alg none", token: withHeader(header{Alg: "none", Typ: "JWT", Kid: "ed"}, ""), err: ErrSignature},
+		{name: "alg none without key ID", token: withHeader(header{Alg: "none", Typ: "JWT"}, ""), err: ErrUnknownKey},
+		{name: "ES256 header on the Ed25519 key", token: withHeader(header{Alg: AlgES256, Typ: "JWT", Kid: "ed"}, parts[2]), err: ErrSignature},
+		{name: "EdDSA header on the P-256 key", token: strings.Replace(ecToken, ecParts[0], mustEncode(t, header{Alg: AlgEdDSA, Typ: "JWT", Kid: "ec"}), 1), err: ErrSignature},
+		{name: "unknown key", token: withHeader(header{Alg: AlgEdDSA, Typ: "JWT", Kid: "other"}, parts[2]), err: ErrUnknownKey},
+		{name: "two segments", token: parts[0] + "." + parts[1], err: ErrMalformed},
+		{name: "invalid header", token: "!." + parts[1] + "." + parts[2], err: ErrMalformed},
+		{name: "invalid signature encoding", token: parts[0] + "." + parts[1] + ".!", err: ErrMalformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := verifier.Verify(context.Background(), tt.token, now); !errors.Is(err, tt.err) {
+				t.Errorf("got error %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+// The key set published without algorithm still binds the algorithm to the type of the key
+func TestAlgorithmConfusionWithoutJwkAlg(t *testing.T) {
+	now := time.Now()
+	signer := newSigner(t, newEd25519Key(t), "ed")
+	set := jwks(t, signer)
+	set.Keys[0].Alg = ""
+	token, err := signer.Sign(Claims{}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token, ".")
+	confused := mustEncode(t, header{Alg: AlgES256, Typ: "JWT", Kid: "ed"}) + "." + parts[1] + "." + parts[2]
+
+	verifier := NewVerifier(set, "test")
+	if _, err := verifier.Verify(context.Background(), token, now); err != nil {
+		t.Errorf("got error %v", err)
+	}
+	if _, err := verifier.Verify(context.Background(), confused, now); !errors.Is(err, ErrSignature) {
+		t.Errorf("got error %v with the ES256 header, want %v", err, ErrSignature)
+	}
+}
+
+func TestRemoteKeySet(t *testing.T) {
+	now := time.Now()
+	old := newSigner(t, newEd25519Key(t), "old")
+	rotated := newSigner(t, newEd25519Key(t), "new")
+	var published atomic.Pointer[JSONWebKeySet]
+	published.Store(jwks(t, old))
+	var fetches atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		_ = json.NewEncoder(w).Encode(published.Load())
+	}))
+	defer srv.Close()
+
+	keys := NewRemoteKeySet(srv.URL, nil)
+	verifier := NewVerifier(keys, "test")
+	oldToken, _ := old.Sign(Claims{}, now)
+	newToken, _ := rotated.Sign(Claims{}, now)
+	if _, err := verifier.Verify(context.Background(), oldToken, now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifier.Verify(context.Background(), oldToken, now); err != nil || fetches.Load() != 1 {
+		t.Fatalf("got error %v and %d fetches, want the cached key set", err, fetches.Load())
+	}
+
+	// The new key is fetched once the refresh interval is over
+	published.Store(jwks(t, rotated, old))
+	if _, err := verifier.Verify(context.Background(), newToken, now); !errors.Is(err, ErrUnknownKey) || fetches.Load() != 1 {
+		t.Fatalf("got error %v and %d fetches, want the unknown key within the refresh interval", err, fetches.Load())
+	}
+	keys.mu.Lock()
+	keys.fetchedAt = keys.fetchedAt.Add(-minJwksRefreshInterval)
+	keys.mu.Unlock()
+	if _, err := verifier.Verify(context.Background(), newToken, now); err != nil || fetches.Load() != 2 {
+		t.Fatalf("got error %v and %d fetches, want the new key fetched", err, fetches.Load())
+	}
+}
+
+// The known keys are served while the key set is fetched, the concurrent fetches are shared
+func TestRemoteKeySetConcurrentFetch(t *testing.T) {
+	signer := newSigner(t, newEd25519Key(t), "known")
+	var fetches atomic.Int32
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fetches.Add(1) > 1 {
+			<-release
+		}
+		_ = json.NewEncoder(w).Encode(jwks(t, signer))
+	}))
+	defer srv.Close()
+
+	keys := NewRemoteKeySet(srv.URL, nil)
+	if _, err := keys.Key(context.Background(), "known"); err != nil {
+		t.Fatal(err)
+	}
+	keys.mu.Lock()
+	keys.fetchedAt = keys.fetchedAt.Add(-minJwksRefreshInterval)
+	keys.mu.Unlock()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := keys.Key(context.Background(), "unknown")
+			errs <- err
+		}()
+	}
+	// Waiting for the fetch to be in flight
+	for deadline := time.Now().Add(5 * time.Second); fetches.Load() < 2; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the key set was not fetched")
+		}
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := keys.Key(context.Background(), "known")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("got error %v for the known key", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("the known key waited for the fetch")
+	}
+
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if !errors.Is(err, ErrUnknownKey) {
+			t.Errorf("got error %v, want %v", err, ErrUnknownKey)
+		}
+	}
+	if got := fetches.Load(); got != 2 {
+		t.Errorf("got %d fetches, want the concurrent ones shared", got)
+	}
+}
+
+func TestRemoteKeySetFetchError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	if _, err := NewRemoteKeySet(srv.URL, nil).Key(context.Background(), "known"); err == nil || errors.Is(err, ErrUnknownKey) {
+		t.Errorf("got error %v, want the fetch error", err)
+	}
+}
+
+func mustEncode(t *testing.T, v any) string {
+	t.Helper()
+	content, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(content)
+}
@@ -0,0 +1,62 @@
+package attest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+)
+
+// JSONWebKeySet as served on `/.well-known/jwks.json`.
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// JSONWebKey of an Ed25519 (OKP) or a P-256 (EC) public key.
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y,omitempty"`
+	Kid string `json:"kid,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Use string `json:"use,omitempty"`
+}
+
+func publicJwk(public crypto.PublicKey, keyId string, alg string) (*JSONWebKey, error) {
+	jwk := &JSONWebKey{Kid: keyId, Alg: alg}
+	if alg != "" {
+		jwk.Use = "sig"
+	}
+	switch k := public.(type) {
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(k)
+	case *ecdsa.PublicKey:
+		jwk.Kty = "EC"
+		jwk.Crv = "P-256"
+		x, y := make([]byte, 32), make([]byte, 32)
+		k.X.FillBytes(x)
+		k.Y.FillBytes(y)
+		jwk.X = base64.RawURLEncoding.EncodeToString(x)
+		jwk.Y = base64.RawURLEncoding.EncodeToString(y)
+	default:
+		return nil, fmt.Errorf("unsupported attestation key type %T", public)
+	}
+	return jwk, nil
+}
+
+// RFC 7638 thumbprint, hashing the required members in lexicographic order
+func (k JSONWebKey) thumbprint() string {
+	var canonical string
+	if k.Kty == "OKP" {
+		canonical = fmt.Sprintf(`{"crv":"%s","kty":"%s","x":"%s"}`, k.Crv, k.Kty, k.X)
+	} else {
+		canonical = fmt.Sprintf(`{"crv":"%s","kty":"%s","x":"%s","y":"%s"}`, k.Crv, k.Kty, k.X, k.Y)
+	}
+	digest := sha256.Sum256([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(digest[:])
+}
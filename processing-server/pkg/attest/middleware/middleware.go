@@ -0,0 +1,132 @@
+// Package middleware verifies the verdict attestations of the processing server in backend services,
+// enforcing the accepted sources, a minimum score and an expected action per route.
+//
+//	verifier := attest.NewVerifier(attest.NewRemoteKeySet(jwksUrl, nil), "")
+//	mux.With(middleware.Verdict(middleware.Options{
+//		Verifier: verifier,
+//		MinScore: 0.5,
+//		Action:   "submit",
+//	})).Post("/submit", submit)
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pseudonator/recaptcha-processing-server/pkg/attest"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/problem"
+)
+
+// DefaultHeader carries the attestation forwarded by the API gateway.
+const DefaultHeader = "x-recaptcha-verdict"
+
+var (
+	ErrMissing = errors.New("missing verdict attestation")
+	ErrSource  = errors.New("verdict source not accepted")
+	ErrScore   = errors.New("verdict score is too low")
+	ErrAction  = errors.New("verdict action mismatch")
+)
+
+type contextKey struct{}
+
+// Options of the middleware for a route.
+type Options struct {
+	Verifier *attest.Verifier
+	// Header carrying the attestation, DefaultHeader when empty
+	Header string
+	// Minimum score of the verdict, inclusive
+	MinScore float64
+	// Expected action, any action is accepted when empty
+	Action string
+	// Accepted sources of the verdicts, attest.SourceVerification only when empty. The minimum score and the
+	// action only apply to the verifications, the other sources carry neither.
+	Sources []string
+	// Writes the response of the refused requests, WriteProblem when nil
+	OnError func(w http.ResponseWriter, r *http.Request, err error)
+}
+
+// Verdict refuses the requests without a valid attestation, or with a score or an action
+// not matching the options. The verified claims are available with FromContext.
+func Verdict(opts Options) func(http.Handler) http.Handler {
+	if opts.Verifier == nil {
+		panic(errors.New("verdict middleware requires a verifier"))
+	}
+	if opts.Header == "" {
+		opts.Header = DefaultHeader
+	}
+	if opts.OnError == nil {
+		opts.OnError = WriteProblem
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, err := opts.verify(r)
+			if err != nil {
+				opts.OnError(w, r, err)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, claims)))
+		})
+	}
+}
+
+func (opts Options) verify(r *http.Request) (*attest.Claims, error) {
+	token := r.Header.Get(opts.Header)
+	if token == "" {
+		return nil, ErrMissing
+	}
+	claims, err := opts.Verifier.Verify(r.Context(), token, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	source := claims.Source
+	if source == "" {
+		source = attest.SourceVerification
+	}
+	if !opts.accepts(source) {
+		return nil, fmt.Errorf("%w: received '%s'", ErrSource, source)
+	}
+	if source != attest.SourceVerification {
+		return claims, nil
+	}
+	if claims.Score < opts.MinScore {
+		return nil, fmt.Errorf("%w: received '%f', while expecting at least '%f'", ErrScore, claims.Score, opts.MinScore)
+	}
+	if opts.Action != "" && claims.Action != opts.Action {
+		return nil, fmt.Errorf("%w: received '%s', while expecting '%s'", ErrAction, claims.Action, opts.Action)
+	}
+	return claims, nil
+}
+
+func (opts Options) accepts(source string) bool {
+	if len(opts.Sources) == 0 {
+		return source == attest.SourceVerification
+	}
+	for _, accepted := range opts.Sources {
+		if accepted == source {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteProblem refuses the request with 403 and the problem details of the error, coded as
+// score_too_low, action_mismatch or attestation_invalid.
+func WriteProblem(w http.ResponseWriter, r *http.Request, err error) {
+	code := problem.CodeAttestationInvalid
+	switch {
+	case errors.Is(err, ErrScore):
+		code = problem.CodeScoreTooLow
+	case errors.Is(err, ErrAction):
+		code = problem.CodeActionMismatch
+	}
+	problem.Write(w, r, problem.New(http.StatusForbidden, code, err.Error()))
+}
+
+// FromContext returns the verified claims of the request.
+func FromContext(ctx context.Context) (*attest.Claims, bool) {
+	claims, ok := ctx.Value(contextKey{}).(*attest.Claims)
+	return claims, ok
+}
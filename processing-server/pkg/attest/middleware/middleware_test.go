@@ -0,0 +1,86 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pseudonator/recaptcha-processing-server/pkg/attest"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/problem"
+)
+
+func TestVerdict(t *testing.T) {
+	key, err := attest.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := attest.NewSigner(key, "", "test", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks, err := signer.JWKS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier := attest.NewVerifier(jwks, "test")
+
+	tests := []struct {
+		name   string
+		claims *attest.Claims
+		opts   Options
+		status int
+		code   problem.Code
+	}{
+		{name: "verification", claims: &attest.Claims{Source: attest.SourceVerification, Action: "submit", Score: 0.9}, opts: Options{MinScore: 0.5, Action: "submit"}, status: http.StatusOK},
+		{name: "verification without source", claims: &attest.Claims{Action: "submit", Score: 0.9}, opts: Options{MinScore: 0.5}, status: http.StatusOK},
+		{name: "missing", opts: Options{}, status: http.StatusForbidden, code: problem.CodeAttestationInvalid},
+		{name: "score too low", claims: &attest.Claims{Source: attest.SourceVerification, Action: "submit", Score: 0.4}, opts: Options{MinScore: 0.5}, status: http.StatusForbidden, code: problem.CodeScoreTooLow},
+		{name: "action mismatch", claims: &attest.Claims{Source: attest.SourceVerification, Action: "login", Score: 0.9}, opts: Options{Action: "submit"}, status: http.StatusForbidden, code: problem.CodeActionMismatch},
+		{name: "pass refused by default", claims: &attest.Claims{Source: attest.SourcePass}, opts: Options{}, status: http.StatusForbidden, code: problem.CodeAttestationInvalid},
+		{name: "shadow refused by default", claims: &attest.Claims{Source: attest.SourceShadow, Refusal: "score_too_low"}, opts: Options{}, status: http.StatusForbidden, code: problem.CodeAttestationInvalid},
+		{name: "fail-open refused by default", claims: &attest.Claims{Source: attest.SourceFailOpen, Refusal: "provider_unavailable"}, opts: Options{}, status: http.StatusForbidden, code: problem.CodeAttestationInvalid},
+		{
+			name:   "accepted pass without score",
+			claims: &attest.Claims{Source: attest.SourcePass},
+			opts:   Options{MinScore: 0.5, Action: "submit", Sources: []string{attest.SourceVerification, attest.SourcePass}},
+			status: http.StatusOK,
+		},
+		{
+			name:   "verification not accepted",
+			claims: &attest.Claims{Source: attest.SourceVerification, Score: 0.9},
+			opts:   Options{Sources: []string{attest.SourceFailOpen}},
+			status: http.StatusForbidden,
+			code:   problem.CodeAttestationInvalid,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.Verifier = verifier
+			handler := Verdict(tt.opts)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if _, ok := FromContext(r.Context()); !ok {
+					t.Error("no claims in the context")
+				}
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			req := httptest.NewRequest(http.MethodPost, "/submit", nil)
+			if tt.claims != nil {
+				token, err := signer.Sign(*tt.claims, time.Now())
+				if err != nil {
+					t.Fatal(err)
+				}
+				req.Header.Set(DefaultHeader, token)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Fatalf("got status %d, want %d", rec.Code, tt.status)
+			}
+			if got := rec.Header().Get(problem.CodeHeader); got != string(tt.code) {
+				t.Errorf("got code %q, want %q", got, tt.code)
+			}
+		})
+	}
+}
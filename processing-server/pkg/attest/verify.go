@@ -0,0 +1,247 @@
+package attest
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Minimum delay between two fetches of the remote key set, when the key ID is unknown
+const minJwksRefreshInterval = 30 * time.Second
+
+var (
+	ErrMalformed  = errors.New("malformed attestation")
+	ErrUnknownKey = errors.New("attestation signed with an unknown key")
+	ErrSignature  = errors.New("invalid attestation signature")
+	ErrExpired    = errors.New("attestation expired")
+	ErrIssuer     = errors.New("attestation issued by another issuer")
+)
+
+// KeySet resolves the public key of a key ID.
+type KeySet interface {
+	Key(ctx context.Context, keyId string) (*JSONWebKey, error)
+}
+
+// Key finds the key with the ID in the set.
+func (s *JSONWebKeySet) Key(_ context.Context, keyId string) (*JSONWebKey, error) {
+	for i := range s.Keys {
+		if s.Keys[i].Kid == keyId {
+			return &s.Keys[i], nil
+		}
+	}
+	return nil, ErrUnknownKey
+}
+
+// RemoteKeySet fetches the key set from the `/.well-known/jwks.json` of the processing server,
+// caching it and fetching it again for the unknown key IDs, e.g. after a key rotation.
+type RemoteKeySet struct {
+	url    string
+	client *http.Client
+
+	mu        sync.Mutex
+	keys      *JSONWebKeySet
+	fetchedAt time.Time
+	// Fetch in flight, shared by the concurrent calls, closed once over
+	fetching chan struct{}
+	fetchErr error
+}
+
+// NewRemoteKeySet creates a key set fetched from the URL, the default HTTP client is used without a client.
+func NewRemoteKeySet(url string, client *http.Client) *RemoteKeySet {
+	if client == nil {
+		client = &http.Client{Timeout: 5 * time.Second}
+	}
+	return &RemoteKeySet{url: url, client: client}
+}
+
+// Key finds the key with the ID, fetching the key set when it is unknown. The lock is never held while fetching,
+// the calls with a known key ID don't wait for the fetch.
+func (s *RemoteKeySet) Key(ctx context.Context, keyId string) (*JSONWebKey, error) {
+	s.mu.Lock()
+	if s.keys != nil {
+		if key, err := s.keys.Key(ctx, keyId); err == nil {
+			s.mu.Unlock()
+			return key, nil
+		}
+		if time.Since(s.fetchedAt) < minJwksRefreshInterval {
+			s.mu.Unlock()
+			return nil, ErrUnknownKey
+		}
+	}
+	if fetching := s.fetching; fetching != nil {
+		s.mu.Unlock()
+		return s.awaitFetch(ctx, fetching, keyId)
+	}
+	done := make(chan struct{})
+	s.fetching = done
+	s.mu.Unlock()
+
+	keys, err := s.fetch(ctx)
+
+	s.mu.Lock()
+	if err == nil {
+		s.keys, s.fetchedAt = keys, time.Now()
+	}
+	s.fetching, s.fetchErr = nil, err
+	close(done)
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return keys.Key(ctx, keyId)
+}
+
+// Waiting for the fetch of another call, sharing its outcome
+func (s *RemoteKeySet) awaitFetch(ctx context.Context, fetching chan struct{}, keyId string) (*JSONWebKey, error) {
+	select {
+	case <-fetching:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.keys != nil {
+		if key, err := s.keys.Key(ctx, keyId); err == nil {
+			return key, nil
+		}
+	}
+	if s.fetchErr != nil {
+		return nil, s.fetchErr
+	}
+	return nil, ErrUnknownKey
+}
+
+func (s *RemoteKeySet) fetch(ctx context.Context) (*JSONWebKeySet, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch the attestation keys: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to fetch the attestation keys, received status %d", resp.StatusCode)
+	}
+	var keys JSONWebKeySet
+	if err := json.NewDecoder(resp.Body).Decode(&keys); err != nil {
+		return nil, fmt.Errorf("invalid attestation keys: %w", err)
+	}
+	return &keys, nil
+}
+
+// Verifier verifies the attestations against a key set.
+type Verifier struct {
+	keys   KeySet
+	issuer string
+}
+
+// NewVerifier creates a verifier for the key set, an empty issuer accepts any issuer.
+func NewVerifier(keys KeySet, issuer string) *Verifier {
+	return &Verifier{keys: keys, issuer: issuer}
+}
+
+// Verify the signature, the expiry and the issuer of the attestation.
+func (v *Verifier) Verify(ctx context.Context, token string, now time.Time) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+	var h header
+	if err := decodeSegment(parts[0], &h); err != nil {
+		return nil, ErrMalformed
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	jwk, err := v.keys.Key(ctx, h.Kid)
+	if err != nil {
+		return nil, err
+	}
+	// The algorithm is bound to the key, never picked from the header alone
+	if jwk.Alg != "" && jwk.Alg != h.Alg {
+		return nil, ErrSignature
+	}
+	public, err := jwk.publicKey()
+	if err != nil {
+		return nil, err
+	}
+	if !verifySignature(public, h.Alg, []byte(parts[0]+"."+parts[1]), signature) {
+		return nil, ErrSignature
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, ErrMalformed
+	}
+	if now.Unix() >= claims.ExpiresAt {
+		return nil, ErrExpired
+	}
+	if v.issuer != "" && claims.Issuer != v.issuer {
+		return nil, ErrIssuer
+	}
+	return &claims, nil
+}
+
+func verifySignature(public crypto.PublicKey, alg string, signingInput []byte, signature []byte) bool {
+	switch k := public.(type) {
+	case ed25519.PublicKey:
+		return alg == AlgEdDSA && ed25519.Verify(k, signingInput, signature)
+	case *ecdsa.PublicKey:
+		if alg != AlgES256 || len(signature) != 64 {
+			return false
+		}
+		digest := sha256.Sum256(signingInput)
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(k, digest[:], r, s)
+	}
+	return false
+}
+
+func (k JSONWebKey) publicKey() (crypto.PublicKey, error) {
+	x, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil {
+		return nil, fmt.Errorf("invalid attestation key '%s': %w", k.Kid, err)
+	}
+	switch {
+	case k.Kty == "OKP" && k.Crv == "Ed25519":
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid attestation key '%s'", k.Kid)
+		}
+		return ed25519.PublicKey(x), nil
+	case k.Kty == "EC" && k.Crv == "P-256":
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid attestation key '%s': %w", k.Kid, err)
+		}
+		public := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !public.Curve.IsOnCurve(public.X, public.Y) {
+			return nil, fmt.Errorf("invalid attestation key '%s'", k.Kid)
+		}
+		return public, nil
+	}
+	return nil, fmt.Errorf("unsupported attestation key '%s' of type %s", k.Kid, k.Kty)
+}
+
+func decodeSegment(segment string, v any) error {
+	content, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, v)
+}
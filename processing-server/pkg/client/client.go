@@ -0,0 +1,219 @@
+// Package client calls the verification API of the processing server directly, without going through
+// the API gateway, building the auth state and the token header of the passthrough requests.
+//
+//	c, err := client.New(client.Options{BaseUrl: "http://recaptcha-processing-server:8080"})
+//	verdict, err := c.Verify(ctx, client.Request{SiteKey: siteKey, Token: token, ClientIp: ip})
+//	if errors.Is(err, client.ErrChallenge) {
+//		...
+//	}
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	defaultMaxRetries   = 2
+	defaultRetryBackoff = 100 * time.Millisecond
+	maxRetryBackoff     = 2 * time.Second
+)
+
+// Headers of the verification API
+const (
+	TokenHeader        = "x-recaptcha-token"
+	OutcomeHeader      = "x-recaptcha-outcome"
+	ErrorHeader        = "x-recaptcha-error"
+	RiskReasonsHeader  = "x-recaptcha-risk-reasons"
+	ChallengeUrlHeader = "x-recaptcha-challenge-url"
+	PassHeader         = "x-recaptcha-pass"
+	VerdictHeader      = "x-recaptcha-verdict"
+)
+
+// Outcome of a verification, as in the outcome header.
+type Outcome string
+
+const (
+	OutcomeAllow     Outcome = "allow"
+	OutcomeChallenge Outcome = "challenge"
+	OutcomeTarpit    Outcome = "tarpit"
+	OutcomeDeny      Outcome = "deny"
+)
+
+// Options of the client.
+type Options struct {
+	// URL of the processing server, e.g. http://recaptcha-processing-server:8080
+	BaseUrl string
+	// HTTP client calling the server, the default client when nil
+	HttpClient *http.Client
+	// Retries of the requests which failed to reach reCAPTCHA or the server, 2 when zero and none when negative
+	MaxRetries int
+	// Initial backoff between the retries, doubled on each retry
+	RetryBackoff time.Duration
+}
+
+// Request to verify, mirroring the passthrough request of the API gateway.
+type Request struct {
+	SiteKey string
+	Token   string
+	// Creating a token-less express assessment (Enterprise only)
+	Express bool
+	// Account ID for Account Defender (optional)
+	AccountId string
+	// Payment transaction for Fraud Prevention (optional)
+	Transaction *TransactionData
+	// User agent and IP address of the end user, for the express assessments and the pass binding
+	UserAgent string
+	ClientIp  string
+	// Pass issued by a previous verification, accepted instead of a token
+	Pass string
+}
+
+// Verdict of a verification that was not refused.
+type Verdict struct {
+	// Either allow or tarpit, the server already waited for the delay of the tarpit band
+	Outcome Outcome
+	// Pass to send with the next requests instead of a token, when passes are enabled
+	Pass string
+	// Signed verdict attestation for the backend services, when attestations are enabled
+	Attestation string
+}
+
+// Client of the verification API.
+type Client struct {
+	opts     Options
+	endpoint *url.URL
+}
+
+// New creates a client, validating the options.
+func New(opts Options) (*Client, error) {
+	endpoint, err := url.Parse(opts.BaseUrl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base URL: %w", err)
+	}
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" {
+		return nil, fmt.Errorf("invalid base URL scheme '%s'", endpoint.Scheme)
+	}
+	if opts.HttpClient == nil {
+		opts.HttpClient = http.DefaultClient
+	}
+	if opts.MaxRetries == 0 {
+		opts.MaxRetries = defaultMaxRetries
+	}
+	if opts.RetryBackoff == 0 {
+		opts.RetryBackoff = defaultRetryBackoff
+	}
+	return &Client{opts: opts, endpoint: endpoint}, nil
+}
+
+type authState struct {
+	State struct {
+		SiteKey     string           `json:"x-site-key"`
+		AccountId   string           `json:"x-account-id,omitempty"`
+		Transaction *TransactionData `json:"x-transaction,omitempty"`
+	} `json:"state"`
+}
+
+// Verify the request, returning the verdict or an *Error, which can be matched with errors.Is
+// against ErrChallenge, ErrTokenExpired, ErrRiskReasons, ErrDenied, ErrUnauthorized or ErrUnavailable.
+func (c *Client) Verify(ctx context.Context, req Request) (Verdict, error) {
+	var state authState
+	state.State.SiteKey = req.SiteKey
+	state.State.AccountId = req.AccountId
+	state.State.Transaction = req.Transaction
+	body, err := json.Marshal(state)
+	if err != nil {
+		return Verdict{}, fmt.Errorf("unable to encode the auth state: %w", err)
+	}
+	path := "/captcha-verify"
+	if req.Express {
+		path = "/captcha-verify/express"
+	}
+	endpoint := c.endpoint.JoinPath(path).String()
+
+	backoff := c.opts.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		verdict, err := c.verify(ctx, endpoint, body, req)
+		if err == nil || attempt >= c.opts.MaxRetries || !retryable(err) {
+			return verdict, err
+		}
+		// Full jitter, so that the clients failing together don't retry together, unless the server asks for more
+		wait := time.Duration(rand.Int63n(int64(backoff) + 1))
+		if retryAfter := retryAfter(err); retryAfter > wait {
+			wait = retryAfter
+			if wait > maxRetryBackoff {
+				wait = maxRetryBackoff
+			}
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return Verdict{}, ctx.Err()
+		}
+		if backoff *= 2; backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
+
+func (c *Client) verify(ctx context.Context, endpoint string, body []byte, req Request) (Verdict, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return Verdict{}, fmt.Errorf("unable to create the verification request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if req.Token != "" && !req.Express {
+		httpReq.Header.Set(TokenHeader, req.Token)
+	}
+	if req.Pass != "" {
+		httpReq.Header.Set(PassHeader, req.Pass)
+	}
+	if req.UserAgent != "" {
+		httpReq.Header.Set("User-Agent", req.UserAgent)
+	}
+	if req.ClientIp != "" {
+		httpReq.Header.Set("X-Forwarded-For", req.ClientIp)
+	}
+
+	resp, err := c.opts.HttpClient.Do(httpReq)
+	if err != nil {
+		if ctx.Err() != nil {
+			return Verdict{}, ctx.Err()
+		}
+		return Verdict{}, &Error{Message: "unable to reach the processing server", kind: ErrUnavailable, err: err}
+	}
+	defer resp.Body.Close()
+	// The refusals are problem details, or a single line of plain text
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode == http.StatusOK {
+		return Verdict{
+			Outcome:     Outcome(resp.Header.Get(OutcomeHeader)),
+			Pass:        resp.Header.Get(PassHeader),
+			Attestation: resp.Header.Get(VerdictHeader),
+		}, nil
+	}
+	return Verdict{}, newError(resp, message)
+}
+
+func retryAfter(err error) time.Duration {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.RetryAfter
+	}
+	return 0
+}
+
+// Only the failures to get an answer are retried, a refusal is final
+func retryable(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && errors.Is(e, ErrUnavailable)
+}
@@ -0,0 +1,212 @@
+package client_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pseudonator/recaptcha-processing-server/pkg/client"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/client/clienttest"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/problem"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/verify"
+)
+
+func newClient(t *testing.T, baseUrl string, maxRetries int) *client.Client {
+	t.Helper()
+	c, err := client.New(client.Options{BaseUrl: baseUrl, MaxRetries: maxRetries, RetryBackoff: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// Unavailable without retry hint, so that the retries only wait for the backoff
+func unavailable() clienttest.Response {
+	resp := clienttest.Unavailable()
+	resp.RetryAfter = 0
+	return resp
+}
+
+func TestVerify(t *testing.T) {
+	tests := []struct {
+		name      string
+		req       client.Request
+		responses []clienttest.Response
+		// Verdict or kind of the error
+		outcome  client.Outcome
+		err      error
+		requests int
+	}{
+		{name: "allow", req: client.Request{SiteKey: "site-key", Token: "token"}, responses: []clienttest.Response{clienttest.Allow()}, outcome: client.OutcomeAllow, requests: 1},
+		{name: "retried unavailable", req: client.Request{SiteKey: "site-key", Token: "token"}, responses: []clienttest.Response{unavailable(), unavailable(), clienttest.Allow()}, outcome: client.OutcomeAllow, requests: 3},
+		{name: "unavailable after the retries", req: client.Request{SiteKey: "site-key", Token: "token"}, responses: []clienttest.Response{unavailable()}, err: client.ErrUnavailable, requests: 3},
+		{name: "deny not retried", req: client.Request{SiteKey: "site-key", Token: "token"}, responses: []clienttest.Response{clienttest.Deny(), clienttest.Allow()}, err: client.ErrDenied, requests: 1},
+		{name: "challenge not retried", req: client.Request{SiteKey: "site-key", Token: "token"}, responses: []clienttest.Response{clienttest.Challenge("/challenge"), clienttest.Allow()}, err: client.ErrChallenge, requests: 1},
+		{name: "token expired", req: client.Request{SiteKey: "site-key", Token: "token"}, responses: []clienttest.Response{clienttest.TokenExpired()}, err: client.ErrTokenExpired, requests: 1},
+		{name: "risk reasons", req: client.Request{SiteKey: "site-key", Token: "token"}, responses: []clienttest.Response{clienttest.RiskReasons("AUTOMATION")}, err: client.ErrRiskReasons, requests: 1},
+		{name: "missing token", req: client.Request{SiteKey: "site-key"}, err: client.ErrUnauthorized, requests: 1},
+		{name: "missing site key", req: client.Request{Token: "token"}, err: client.ErrUnauthorized, requests: 1},
+		{name: "express", req: client.Request{SiteKey: "site-key", Express: true}, outcome: client.OutcomeAllow, requests: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := clienttest.NewServer()
+			defer srv.Close()
+			if tt.responses != nil {
+				srv.Respond("token", tt.responses...)
+			}
+
+			verdict, err := newClient(t, srv.URL, 0).Verify(context.Background(), tt.req)
+			if tt.err != nil {
+				var clientErr *client.Error
+				if !errors.Is(err, tt.err) || !errors.As(err, &clientErr) {
+					t.Fatalf("got error %v, want %v", err, tt.err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if verdict.Outcome != tt.outcome {
+				t.Errorf("got outcome %q, want %q", verdict.Outcome, tt.outcome)
+			}
+			if got := len(srv.Requests()); got != tt.requests {
+				t.Errorf("got %d requests, want %d", got, tt.requests)
+			}
+		})
+	}
+}
+
+func TestVerifyRequest(t *testing.T) {
+	srv := clienttest.NewServer()
+	defer srv.Close()
+	srv.Respond("token", clienttest.AllowWith("pass", "attestation"))
+
+	verdict, err := newClient(t, srv.URL, 0).Verify(context.Background(), client.Request{
+		SiteKey:   "site-key",
+		Token:     "token",
+		AccountId: "user@example.com",
+		UserAgent: "agent",
+		ClientIp:  "192.0.2.1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verdict.Pass != "pass" || verdict.Attestation != "attestation" {
+		t.Errorf("got pass %q and attestation %q", verdict.Pass, verdict.Attestation)
+	}
+	req := srv.Requests()[0]
+	if req.Path != "/captcha-verify" || req.SiteKey != "site-key" || req.AccountId != "user@example.com" {
+		t.Errorf("got request %+v", req)
+	}
+	if req.Header.Get("User-Agent") != "agent" || req.Header.Get("X-Forwarded-For") != "192.0.2.1" {
+		t.Errorf("got user agent %q and client IP %q", req.Header.Get("User-Agent"), req.Header.Get("X-Forwarded-For"))
+	}
+}
+
+func TestVerifyProblem(t *testing.T) {
+	srv := clienttest.NewServer()
+	defer srv.Close()
+	srv.Respond("challenged", clienttest.Challenge("https://captcha.example.com/challenge"))
+	srv.Respond("risky", clienttest.RiskReasons("AUTOMATION", "TOO_MUCH_TRAFFIC"))
+	srv.Respond("unavailable", clienttest.Unavailable())
+	c := newClient(t, srv.URL, -1)
+
+	var clientErr *client.Error
+	_, err := c.Verify(context.Background(), client.Request{SiteKey: "site-key", Token: "challenged"})
+	if !errors.As(err, &clientErr) || clientErr.ChallengeUrl != "https://captcha.example.com/challenge" || clientErr.Code != problem.CodeChallengeRequired || clientErr.RequestId == "" {
+		t.Errorf("got %+v, want the challenge URL, the code and the request ID", clientErr)
+	}
+	_, err = c.Verify(context.Background(), client.Request{SiteKey: "site-key", Token: "risky"})
+	if !errors.As(err, &clientErr) || !reflect.DeepEqual(clientErr.RiskReasons, []string{"AUTOMATION", "TOO_MUCH_TRAFFIC"}) {
+		t.Errorf("got %+v, want the risk reasons", clientErr)
+	}
+	_, err = c.Verify(context.Background(), client.Request{SiteKey: "site-key", Token: "unavailable"})
+	if !errors.As(err, &clientErr) || clientErr.StatusCode != http.StatusBadGateway || clientErr.RetryAfter != time.Second {
+		t.Errorf("got %+v, want the status and the retry hint", clientErr)
+	}
+}
+
+// Servers answering in plain text, such as Gloo keeping the headers of a denial but not its body
+func TestVerifyPlainError(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		header map[string]string
+		body   string
+		err    error
+	}{
+		{name: "challenge", status: http.StatusPreconditionRequired, header: map[string]string{client.ChallengeUrlHeader: "/challenge"}, err: client.ErrChallenge},
+		{name: "token expired", status: http.StatusUnauthorized, header: map[string]string{client.ErrorHeader: string(problem.CodeTokenExpired)}, err: client.ErrTokenExpired},
+		{name: "risk reasons", status: http.StatusUnauthorized, header: map[string]string{client.RiskReasonsHeader: "AUTOMATION"}, err: client.ErrRiskReasons},
+		{name: "deny", status: http.StatusUnauthorized, header: map[string]string{client.OutcomeHeader: string(client.OutcomeDeny)}, err: client.ErrDenied},
+		{name: "token missing", status: http.StatusUnauthorized, header: map[string]string{client.ErrorHeader: string(problem.CodeTokenMissing)}, err: client.ErrUnauthorized},
+		{name: "site key missing", status: http.StatusUnauthorized, header: map[string]string{client.ErrorHeader: string(problem.CodeSiteKeyMissing)}, err: client.ErrUnauthorized},
+		{name: "unauthorized message", status: http.StatusUnauthorized, body: "unauthorized", err: client.ErrDenied},
+		{name: "other refusal", status: http.StatusForbidden, err: client.ErrDenied},
+		{name: "throttled", status: http.StatusTooManyRequests, err: client.ErrUnavailable},
+		{name: "unavailable", status: http.StatusServiceUnavailable, body: "upstream connect error", err: client.ErrUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				for name, value := range tt.header {
+					w.Header().Set(name, value)
+				}
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+
+			_, err := newClient(t, srv.URL, -1).Verify(context.Background(), client.Request{SiteKey: "site-key", Token: "token"})
+			var clientErr *client.Error
+			if !errors.As(err, &clientErr) || !errors.Is(err, tt.err) {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			if clientErr.StatusCode != tt.status {
+				t.Errorf("got status %d, want %d", clientErr.StatusCode, tt.status)
+			}
+		})
+	}
+}
+
+func TestVerifyUnreachable(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+
+	_, err := newClient(t, srv.URL, 1).Verify(context.Background(), client.Request{SiteKey: "site-key", Token: "token"})
+	var clientErr *client.Error
+	if !errors.Is(err, client.ErrUnavailable) || !errors.As(err, &clientErr) || clientErr.StatusCode != 0 {
+		t.Fatalf("got error %v, want an unavailable error without status", err)
+	}
+
+	// The retries stop with the context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := newClient(t, srv.URL, 1).Verify(ctx, client.Request{SiteKey: "site-key", Token: "token"}); !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v, want the context error", err)
+	}
+}
+
+// The transaction of the client is read by the server as the one of the verifier
+func TestTransactionDataJSON(t *testing.T) {
+	address := &client.TransactionAddress{Recipient: "Jane Citizen", Address: []string{"1 George St"}, Locality: "Sydney", AdministrativeArea: "NSW", RegionCode: "AU", PostalCode: "2000"}
+	transaction := client.TransactionData{
+		TransactionId: "txn-1", Amount: 120.5, ShippingAmount: 10, Currency: "AUD", PaymentMethod: "credit-card",
+		CardBin: "411111", CardLastFour: "1111", BillingAddress: address, ShippingAddress: address,
+	}
+	sent, err := json.Marshal(transaction)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var read verify.TransactionData
+	if err := json.Unmarshal(sent, &read); err != nil {
+		t.Fatal(err)
+	}
+	if reread, _ := json.Marshal(read); string(reread) != string(sent) {
+		t.Errorf("got %s read by the server, want %s", reread, sent)
+	}
+}
@@ -0,0 +1,209 @@
+// Package clienttest provides a fake processing server for the unit tests of the client consumers,
+// answering the verification requests with scripted responses per token.
+//
+//	srv := clienttest.NewServer()
+//	defer srv.Close()
+//	srv.Respond("bot-token", clienttest.Challenge("https://captcha.example.com/challenge"))
+//	c, _ := client.New(client.Options{BaseUrl: srv.URL})
+package clienttest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pseudonator/recaptcha-processing-server/pkg/client"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/problem"
+)
+
+// Response of the fake server to a verification, the refusals are answered with problem details.
+type Response struct {
+	StatusCode int
+	Code       problem.Code
+	Message    string
+	Header     http.Header
+	// Retry hint of the refusal
+	RetryAfter time.Duration
+}
+
+// Allow answers with an allow verdict.
+func Allow() Response {
+	return Response{StatusCode: http.StatusOK, Header: http.Header{
+		http.CanonicalHeaderKey(client.OutcomeHeader): {string(client.OutcomeAllow)},
+	}}
+}
+
+// AllowWith answers with an allow verdict carrying a pass and an attestation, either may be empty.
+func AllowWith(pass string, attestation string) Response {
+	resp := Allow()
+	if pass != "" {
+		resp.Header.Set(client.PassHeader, pass)
+	}
+	if attestation != "" {
+		resp.Header.Set(client.VerdictHeader, attestation)
+	}
+	return resp
+}
+
+// Challenge answers that a challenge is required, the URL of the interstitial may be empty.
+func Challenge(challengeUrl string) Response {
+	resp := Response{StatusCode: http.StatusPreconditionRequired, Code: problem.CodeChallengeRequired, Message: "challenge required", Header: http.Header{}}
+	resp.Header.Set(client.OutcomeHeader, string(client.OutcomeChallenge))
+	if challengeUrl != "" {
+		resp.Header.Set(client.ChallengeUrlHeader, challengeUrl)
+	}
+	return resp
+}
+
+// Deny answers with a site verification failure, as for a score too low.
+func Deny() Response {
+	resp := Response{StatusCode: http.StatusUnauthorized, Code: problem.CodeScoreTooLow, Message: "site verification failure", Header: http.Header{}}
+	resp.Header.Set(client.OutcomeHeader, string(client.OutcomeDeny))
+	return resp
+}
+
+// TokenExpired answers that the token is older than the maximum token age.
+func TokenExpired() Response {
+	return Response{StatusCode: http.StatusUnauthorized, Code: problem.CodeTokenExpired, Message: "token expired"}
+}
+
+// RiskReasons answers that the assessment matched denied risk reasons.
+func RiskReasons(reasons ...string) Response {
+	resp := Response{StatusCode: http.StatusUnauthorized, Code: problem.CodeRiskDenied, Message: "site verification failure, risk reasons: " + strings.Join(reasons, ", "), Header: http.Header{}}
+	resp.Header.Set(client.OutcomeHeader, string(client.OutcomeDeny))
+	resp.Header.Set(client.RiskReasonsHeader, strings.Join(reasons, ","))
+	return resp
+}
+
+// Unavailable answers as if reCAPTCHA could not be reached.
+func Unavailable() Response {
+	return Response{
+		StatusCode: http.StatusBadGateway,
+		Code:       problem.CodeProviderUnavailable,
+		Message:    "unable to process the recaptcha enterprise response",
+		RetryAfter: time.Second,
+	}
+}
+
+// Request received by the fake server.
+type Request struct {
+	Path      string
+	SiteKey   string
+	Token     string
+	Pass      string
+	AccountId string
+	Header    http.Header
+}
+
+// Server is a fake processing server. The requests without a token nor a pass are answered as
+// unauthorized, the other tokens with their scripted responses or with the default one.
+type Server struct {
+	*httptest.Server
+	mu        sync.Mutex
+	responses map[string][]Response
+	fallback  Response
+	requests  []Request
+}
+
+// NewServer starts a fake server allowing every token.
+func NewServer() *Server {
+	s := &Server{
+		responses: map[string][]Response{},
+		fallback:  Allow(),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Respond scripts the responses to a token, or to a pass, answered in order. The last one is repeated.
+func (s *Server) Respond(token string, responses ...Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.responses[token] = responses
+}
+
+// Default sets the response to the tokens without scripted responses.
+func (s *Server) Default(resp Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fallback = resp
+}
+
+// Requests returns the requests received so far.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || (r.URL.Path != "/captcha-verify" && r.URL.Path != "/captcha-verify/express") {
+		http.NotFound(w, r)
+		return
+	}
+	var state struct {
+		State struct {
+			SiteKey   string `json:"x-site-key"`
+			AccountId string `json:"x-account-id"`
+		} `json:"state"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&state); err != nil {
+		problem.Write(w, r, problem.New(http.StatusUnauthorized, problem.CodeInvalidRequest, "unable to read the auth state: "+err.Error()))
+		return
+	}
+	req := Request{
+		Path:      r.URL.Path,
+		SiteKey:   state.State.SiteKey,
+		Token:     r.Header.Get(client.TokenHeader),
+		Pass:      r.Header.Get(client.PassHeader),
+		AccountId: state.State.AccountId,
+		Header:    r.Header.Clone(),
+	}
+
+	resp := s.record(req)
+	for name, values := range resp.Header {
+		w.Header()[name] = values
+	}
+	if resp.StatusCode == http.StatusOK {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	code := resp.Code
+	if code == "" {
+		code = problem.CodeVerificationFailed
+	}
+	p := problem.New(resp.StatusCode, code, resp.Message).WithRetryAfter(resp.RetryAfter)
+	p.ChallengeUrl = w.Header().Get(client.ChallengeUrlHeader)
+	if reasons := w.Header().Get(client.RiskReasonsHeader); reasons != "" {
+		p.RiskReasons = strings.Split(reasons, ",")
+	}
+	problem.Write(w, r, p)
+}
+
+func (s *Server) record(req Request) Response {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, req)
+
+	key := req.Token
+	if req.Pass != "" {
+		key = req.Pass
+	}
+	if req.SiteKey == "" {
+		return Response{StatusCode: http.StatusUnauthorized, Code: problem.CodeSiteKeyMissing, Message: "no site key in the auth state"}
+	}
+	if key == "" && req.Path != "/captcha-verify/express" {
+		return Response{StatusCode: http.StatusUnauthorized, Code: problem.CodeTokenMissing, Message: "no captcha token in the request"}
+	}
+	responses, ok := s.responses[key]
+	if !ok || len(responses) == 0 {
+		return s.fallback
+	}
+	if len(responses) > 1 {
+		s.responses[key] = responses[1:]
+	}
+	return responses[0]
+}
@@ -0,0 +1,135 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pseudonator/recaptcha-processing-server/pkg/problem"
+)
+
+// Kinds of the refusals of the server, matched with errors.Is
+var (
+	// The score requires a challenge, see Error.ChallengeUrl
+	ErrChallenge = errors.New("challenge required")
+	// The token is older than the maximum token age, a new token is needed
+	ErrTokenExpired = errors.New("token expired")
+	// The assessment matched risk reasons denied by the site policy, see Error.RiskReasons
+	ErrRiskReasons = errors.New("denied risk reasons")
+	// The token is invalid, or its score or action is refused
+	ErrDenied = errors.New("site verification failure")
+	// The site key or the token is missing, or the request is malformed
+	ErrUnauthorized = errors.New("unauthorized")
+	// The server or reCAPTCHA could not be reached, the request is neither allowed nor refused
+	ErrUnavailable = errors.New("verification unavailable")
+)
+
+// Error returned by Verify.
+type Error struct {
+	// Status of the response, zero when the server could not be reached
+	StatusCode int
+	Message    string
+	// Stable code of the problem details, empty when the server could not be reached
+	Code      problem.Code
+	RequestId string
+	// Delay suggested by the server before retrying, zero when none
+	RetryAfter time.Duration
+	// Interstitial of the step-up challenge, when configured on the server
+	ChallengeUrl string
+	RiskReasons  []string
+	kind         error
+	err          error
+}
+
+func (e *Error) Error() string {
+	if e.err != nil {
+		return fmt.Sprintf("%s: %v", e.Message, e.err)
+	}
+	if e.StatusCode != 0 {
+		return fmt.Sprintf("%s (%d)", e.Message, e.StatusCode)
+	}
+	return e.Message
+}
+
+// Is matches the kind of the error.
+func (e *Error) Is(target error) bool {
+	return target == e.kind
+}
+
+func (e *Error) Unwrap() error {
+	return e.err
+}
+
+// Telling the refusals apart from the code of the problem details, or from the status and the headers
+// of the servers answering in plain text
+func newError(resp *http.Response, body []byte) *Error {
+	p, ok := problem.Read(resp, body)
+	if !ok {
+		return newPlainError(resp, strings.TrimSpace(string(body)))
+	}
+	e := &Error{
+		StatusCode:   resp.StatusCode,
+		Message:      p.Detail,
+		Code:         p.Code,
+		RequestId:    p.RequestId,
+		RetryAfter:   time.Duration(p.RetryAfter) * time.Second,
+		ChallengeUrl: p.ChallengeUrl,
+		RiskReasons:  p.RiskReasons,
+	}
+	if e.Message == "" {
+		e.Message = p.Title
+	}
+	switch p.Code {
+	case problem.CodeChallengeRequired:
+		e.kind = ErrChallenge
+	case problem.CodeTokenExpired:
+		e.kind = ErrTokenExpired
+	case problem.CodeRiskDenied:
+		e.kind = ErrDenied
+		if len(p.RiskReasons) > 0 {
+			e.kind = ErrRiskReasons
+		}
+	case problem.CodeSiteKeyMissing, problem.CodeTokenMissing, problem.CodeInvalidRequest:
+		e.kind = ErrUnauthorized
+	case problem.CodeProviderUnavailable:
+		e.kind = ErrUnavailable
+	default:
+		e.kind = ErrDenied
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError {
+			e.kind = ErrUnavailable
+		}
+	}
+	return e
+}
+
+func newPlainError(resp *http.Response, message string) *Error {
+	e := &Error{StatusCode: resp.StatusCode, Message: message}
+	if e.Message == "" {
+		e.Message = http.StatusText(resp.StatusCode)
+	}
+	switch {
+	case resp.StatusCode == http.StatusPreconditionRequired:
+		e.kind = ErrChallenge
+		e.ChallengeUrl = resp.Header.Get(ChallengeUrlHeader)
+	// The code header is kept by Gloo on a denial, even when the body is not
+	case resp.StatusCode == http.StatusUnauthorized && resp.Header.Get(ErrorHeader) == string(problem.CodeTokenExpired):
+		e.kind = ErrTokenExpired
+	case resp.StatusCode == http.StatusUnauthorized && resp.Header.Get(RiskReasonsHeader) != "":
+		e.kind = ErrRiskReasons
+		e.RiskReasons = strings.Split(resp.Header.Get(RiskReasonsHeader), ",")
+	case resp.StatusCode == http.StatusUnauthorized && resp.Header.Get(OutcomeHeader) == string(OutcomeDeny):
+		e.kind = ErrDenied
+	case resp.StatusCode == http.StatusUnauthorized && (resp.Header.Get(ErrorHeader) == string(problem.CodeTokenMissing) || resp.Header.Get(ErrorHeader) == string(problem.CodeSiteKeyMissing)):
+		e.kind = ErrUnauthorized
+	case resp.StatusCode == http.StatusUnauthorized:
+		// Any other refusal, the siteverify failures are answered with 401 as well
+		e.kind = ErrDenied
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError:
+		e.kind = ErrUnavailable
+	default:
+		e.kind = ErrDenied
+	}
+	return e
+}
@@ -0,0 +1,25 @@
+package client
+
+// TransactionData describes a payment transaction for reCAPTCHA Enterprise Fraud Prevention, sent as the
+// `x-transaction` of the auth state. The client has its own types, so that its consumers don't depend on the
+// reCAPTCHA Enterprise libraries of the verifier.
+type TransactionData struct {
+	TransactionId   string              `json:"transactionId,omitempty"`
+	Amount          float64             `json:"amount"`
+	ShippingAmount  float64             `json:"shippingAmount,omitempty"`
+	Currency        string              `json:"currency"` // ISO 4217 currency code
+	PaymentMethod   string              `json:"paymentMethod,omitempty"`
+	CardBin         string              `json:"cardBin,omitempty"`
+	CardLastFour    string              `json:"cardLastFour,omitempty"`
+	BillingAddress  *TransactionAddress `json:"billingAddress,omitempty"`
+	ShippingAddress *TransactionAddress `json:"shippingAddress,omitempty"`
+}
+
+type TransactionAddress struct {
+	Recipient          string   `json:"recipient,omitempty"`
+	Address            []string `json:"address,omitempty"`
+	Locality           string   `json:"locality,omitempty"`
+	AdministrativeArea string   `json:"administrativeArea,omitempty"`
+	RegionCode         string   `json:"regionCode,omitempty"` // CLDR region code
+	PostalCode         string   `json:"postalCode,omitempty"`
+}
@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	recaptchaenterprisepb "cloud.google.com/go/recaptchaenterprise/v2/apiv1/recaptchaenterprisepb"
+	chi "github.com/go-chi/chi/v5"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/problem"
+	"go.uber.org/zap"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	defaultMembershipsPageSize = 50
+	maxMembershipsPageSize     = 1000
+)
+
+type accountGroupMembership struct {
+	Name            string `json:"name"`
+	HashedAccountId string `json:"hashedAccountId"`
+}
+
+type accountGroupMembershipsResp struct {
+	HashedAccountId string                   `json:"hashedAccountId"`
+	Memberships     []accountGroupMembership `json:"memberships"`
+}
+
+// HandleAccountGroups lists the related account group memberships of an account for investigations, on the admin
+// listener. The account ID is hashed the same way as when creating assessments.
+func HandleAccountGroups(mux chi.Router, captchaOptions *CaptchaVerifyOptions, log *zap.Logger) {
+	if !captchaOptions.Verifier.AccountDefender() {
+		return
+	}
+	cw := &captchaOptionsWrapper{
+		captchaOptions: captchaOptions,
+		log:            log,
+	}
+	mux.Get("/account-groups/memberships", func(w http.ResponseWriter, r *http.Request) {
+		accountId := r.URL.Query().Get("account_id")
+		if accountId == "" {
+			problem.Write(w, r, problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "account_id is required"))
+			return
+		}
+		pageSize := defaultMembershipsPageSize
+		if v := r.URL.Query().Get("page_size"); v != "" {
+			size, err := strconv.Atoi(v)
+			if err != nil || size <= 0 || size > maxMembershipsPageSize {
+				problem.Write(w, r, problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, fmt.Sprintf("page_size must be between 1 and %d", maxMembershipsPageSize)))
+				return
+			}
+			pageSize = size
+		}
+
+		hashedAccountId := captchaOptions.Verifier.HashAccountId(accountId)
+		memberships, err := cw.searchAccountGroupMemberships(r, hashedAccountId, pageSize)
+		if err != nil {
+			cw.logger(r).Error("unable to search related account group memberships", zap.Error(err))
+			problem.Write(w, r, problem.New(http.StatusBadGateway, problem.CodeProviderUnavailable, "unable to search related account group memberships").WithRetryAfter(providerRetryAfter))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		writeJSON(w, accountGroupMembershipsResp{
+			HashedAccountId: hashedAccountId,
+			Memberships:     memberships,
+		})
+	})
+}
+
+func (cw *captchaOptionsWrapper) searchAccountGroupMemberships(r *http.Request, hashedAccountId string, pageSize int) ([]accountGroupMembership, error) {
+	c, err := cw.captchaOptions.Verifier.EnterpriseClient()
+	if err != nil {
+		return nil, err
+	}
+	it := c.SearchRelatedAccountGroupMemberships(r.Context(), &recaptchaenterprisepb.SearchRelatedAccountGroupMembershipsRequest{
+		Project:   fmt.Sprintf("projects/%s", cw.captchaOptions.GoogleProjectId),
+		AccountId: hashedAccountId,
+		PageSize:  int32(pageSize),
+	})
+	memberships := []accountGroupMembership{}
+	for len(memberships) < pageSize {
+		membership, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		memberships = append(memberships, accountGroupMembership{
+			Name:            membership.GetName(),
+			HashedAccountId: membership.GetAccountId(),
+		})
+	}
+	return memberships, nil
+}
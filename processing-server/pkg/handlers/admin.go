@@ -0,0 +1,155 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	chi "github.com/go-chi/chi/v5"
+	chimiddleware "github.com/go-chi/chi/v5/middleware"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/logging"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/middleware"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/problem"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/verify"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// AdminOptions of the endpoints served on the admin listener.
+type AdminOptions struct {
+	// Bearer token required on every endpoint, none when empty, e.g. when the clients are verified with mTLS
+	Token    string
+	LogLevel *zap.AtomicLevel
+	Modes    *Modes
+	// Reporting the circuit breaker of the provider
+	Verifier *verify.Verifier
+	// Effective configuration, masked before being served
+	Config map[string]string
+}
+
+type logLevelBody struct {
+	Level string `json:"level"`
+}
+
+type modesBody struct {
+	Shadow   *bool `json:"shadow"`
+	FailOpen *bool `json:"failOpen"`
+}
+
+// HandleAdmin serves the operational endpoints on the admin listener, never on the listener called by the proxy:
+// profiling under /debug/pprof, the redacted configuration, the log level, the verification modes and the circuit
+// breakers.
+//
+//	curl -X PUT -H "Authorization: Bearer $ADMIN_TOKEN" -d '{"level":"debug"}' localhost:8091/log-level
+func HandleAdmin(mux chi.Router, adminOptions *AdminOptions, log *zap.Logger) {
+	mux.Group(func(mux chi.Router) {
+		mux.Use(AdminAuth(adminOptions.Token))
+		mux.Mount("/debug", chimiddleware.Profiler())
+
+		mux.Get("/config", func(w http.ResponseWriter, r *http.Request) {
+			config := make(map[string]string, len(adminOptions.Config))
+			for name, value := range adminOptions.Config {
+				config[name] = logging.RedactValue(name, value)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			writeJSON(w, config)
+		})
+
+		if level := adminOptions.LogLevel; level != nil {
+			mux.Get("/log-level", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusOK)
+				writeJSON(w, logLevelBody{Level: level.Level().String()})
+			})
+			mux.Put("/log-level", func(w http.ResponseWriter, r *http.Request) {
+				var body logLevelBody
+				if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+					problem.Write(w, r, problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "unable to read the log level"))
+					return
+				}
+				var newLevel zapcore.Level
+				if err := newLevel.UnmarshalText([]byte(strings.ToLower(body.Level))); err != nil {
+					problem.Write(w, r, problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "invalid log level"))
+					return
+				}
+				previous := level.Level()
+				level.SetLevel(newLevel)
+				middleware.Logger(r.Context(), log).Warn("log level changed",
+					zap.Stringer("from", previous),
+					zap.Stringer("to", newLevel))
+
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusOK)
+				writeJSON(w, logLevelBody{Level: newLevel.String()})
+			})
+		}
+
+		if verifier := adminOptions.Verifier; verifier != nil {
+			// Listed even when disabled, none are reported then
+			mux.Get("/circuit-breakers", func(w http.ResponseWriter, r *http.Request) {
+				breakers := []verify.BreakerStatus{}
+				if status, ok := verifier.Breaker(); ok {
+					breakers = append(breakers, status)
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusOK)
+				writeJSON(w, breakers)
+			})
+		}
+
+		if modes := adminOptions.Modes; modes != nil {
+			mux.Get("/modes", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusOK)
+				writeJSON(w, newModesBody(modes))
+			})
+			// Only the modes of the body are changed
+			mux.Put("/modes", func(w http.ResponseWriter, r *http.Request) {
+				var body modesBody
+				if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+					problem.Write(w, r, problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "unable to read the modes"))
+					return
+				}
+				if body.Shadow != nil {
+					modes.SetShadow(*body.Shadow)
+				}
+				if body.FailOpen != nil {
+					modes.SetFailOpen(*body.FailOpen)
+				}
+				middleware.Logger(r.Context(), log).Warn("verification modes changed",
+					zap.Bool("shadow", modes.Shadow()),
+					zap.Bool("failOpen", modes.FailOpen()))
+
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusOK)
+				writeJSON(w, newModesBody(modes))
+			})
+		}
+	})
+}
+
+func newModesBody(modes *Modes) modesBody {
+	shadow, failOpen := modes.Shadow(), modes.FailOpen()
+	return modesBody{Shadow: &shadow, FailOpen: &failOpen}
+}
+
+// AdminAuth refuses the requests without the admin token as bearer, every request is accepted without a token,
+// e.g. when the clients are verified with mTLS.
+func AdminAuth(adminToken string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if adminToken == "" {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				problem.Write(w, r, problem.New(http.StatusUnauthorized, problem.CodeInvalidRequest, "unauthorized"))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	chi "github.com/go-chi/chi/v5"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/logging"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/verify"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestHandleAdmin(t *testing.T) {
+	level := zap.NewAtomicLevelAt(zapcore.InfoLevel)
+	modes := &Modes{}
+	verifier, err := verify.New(verify.Options{
+		SiteVerify: &verify.SiteVerifyOptions{Api: "http://localhost/siteverify"},
+		Breaker:    verify.BreakerOptions{FailureThreshold: 5, Cooldown: time.Minute},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := chi.NewMux()
+	HandleAdmin(mux, &AdminOptions{
+		Token:    "admin-token",
+		LogLevel: &level,
+		Modes:    modes,
+		Verifier: verifier,
+		Config:   map[string]string{"ACCOUNT_ID_HMAC_SECRET": "secret", "SERVER_PORT": "8090"},
+	}, zap.NewNop())
+
+	tests := []struct {
+		name          string
+		method        string
+		path          string
+		authorization string
+		body          string
+		wantStatus    int
+		wantBody      string
+	}{
+		{name: "no token", method: http.MethodPut, path: "/log-level", body: `{"level":"debug"}`, wantStatus: http.StatusUnauthorized},
+		{name: "wrong token", method: http.MethodGet, path: "/config", authorization: "Bearer other", wantStatus: http.StatusUnauthorized},
+		{name: "pprof without token", method: http.MethodGet, path: "/debug/pprof/", wantStatus: http.StatusUnauthorized},
+		{name: "pprof", method: http.MethodGet, path: "/debug/pprof/cmdline", authorization: "Bearer admin-token", wantStatus: http.StatusOK},
+		{name: "config", method: http.MethodGet, path: "/config", authorization: "Bearer admin-token", wantStatus: http.StatusOK,
+			wantBody: `{"ACCOUNT_ID_HMAC_SECRET":"` + logging.Redacted + `","SERVER_PORT":"8090"}`},
+		{name: "read level", method: http.MethodGet, path: "/log-level", authorization: "Bearer admin-token", wantStatus: http.StatusOK, wantBody: `{"level":"info"}`},
+		{name: "invalid level", method: http.MethodPut, path: "/log-level", authorization: "Bearer admin-token", body: `{"level":"verbose"}`, wantStatus: http.StatusBadRequest},
+		{name: "change level", method: http.MethodPut, path: "/log-level", authorization: "Bearer admin-token", body: `{"level":"DEBUG"}`, wantStatus: http.StatusOK, wantBody: `{"level":"debug"}`},
+		{name: "circuit breakers", method: http.MethodGet, path: "/circuit-breakers", authorization: "Bearer admin-token", wantStatus: http.StatusOK,
+			wantBody: `[{"name":"siteverify","state":"closed","failures":0}]`},
+		{name: "read modes", method: http.MethodGet, path: "/modes", authorization: "Bearer admin-token", wantStatus: http.StatusOK, wantBody: `{"shadow":false,"failOpen":false}`},
+		{name: "change a mode", method: http.MethodPut, path: "/modes", authorization: "Bearer admin-token", body: `{"failOpen":true}`, wantStatus: http.StatusOK, wantBody: `{"shadow":false,"failOpen":true}`},
+		{name: "change the other mode", method: http.MethodPut, path: "/modes", authorization: "Bearer admin-token", body: `{"shadow":true}`, wantStatus: http.StatusOK, wantBody: `{"shadow":true,"failOpen":true}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("got status %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantBody != "" {
+				var got, want any
+				if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+					t.Fatal(err)
+				}
+				_ = json.Unmarshal([]byte(tt.wantBody), &want)
+				gotJSON, _ := json.Marshal(got)
+				wantJSON, _ := json.Marshal(want)
+				if string(gotJSON) != string(wantJSON) {
+					t.Errorf("got %s, want %s", gotJSON, wantJSON)
+				}
+			}
+		})
+	}
+
+	if level.Level() != zapcore.DebugLevel || !modes.Shadow() || !modes.FailOpen() {
+		t.Errorf("got level %s, shadow %t and fail-open %t after the changes", level.Level(), modes.Shadow(), modes.FailOpen())
+	}
+}
@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	chi "github.com/go-chi/chi/v5"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/attest"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/problem"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/verify"
+	"go.uber.org/zap"
+)
+
+const verdictHeader = "x-recaptcha-verdict"
+
+// HandleJwks publishes the public key of the verdict attestations, for the backends to verify them.
+func HandleJwks(mux chi.Router, captchaOptions *CaptchaVerifyOptions, log *zap.Logger) {
+	if captchaOptions.Attester == nil {
+		return
+	}
+	jwks, err := captchaOptions.Attester.JWKS()
+	if err != nil {
+		panic(err)
+	}
+
+	mux.Get("/.well-known/jwks.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		w.WriteHeader(http.StatusOK)
+		writeJSON(w, jwks)
+	})
+}
+
+// Attesting the verdict in a signed JWT, forwarded upstream with the request
+func (cw *captchaOptionsWrapper) attestVerdict(w http.ResponseWriter, verifyReq verify.Request, verdict verify.Verdict) error {
+	return cw.attest(w, verifyReq.SiteKey, attest.Claims{
+		Source:       attest.SourceVerification,
+		Action:       verdict.Action,
+		Score:        verdict.Score,
+		AssessmentId: verdict.AssessmentId,
+	})
+}
+
+// Attesting a request allowed without a verdict, by a pass or by a mode overriding the refusal, so that the
+// backends decide whether to accept it
+func (cw *captchaOptionsWrapper) attestAllow(w http.ResponseWriter, siteKey string, source string, refusal problem.Code) error {
+	return cw.attest(w, siteKey, attest.Claims{Source: source, Refusal: string(refusal)})
+}
+
+func (cw *captchaOptionsWrapper) attest(w http.ResponseWriter, siteKey string, claims attest.Claims) error {
+	if cw.captchaOptions.Attester == nil {
+		return nil
+	}
+	// The classic site key is the secret key, it is never attested
+	if cw.captchaOptions.EnterpriseEnabled {
+		claims.SiteKey = siteKey
+	}
+	signed, err := cw.captchaOptions.Attester.Sign(claims, time.Now())
+	if err != nil {
+		return err
+	}
+	w.Header().Set(verdictHeader, signed)
+	return nil
+}
@@ -3,16 +3,19 @@ package handlers
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"strings"
 	"time"
 
-	recaptchaenterprise "cloud.google.com/go/recaptchaenterprise/v2/apiv1"
-	recaptchaenterprisepb "cloud.google.com/go/recaptchaenterprise/v2/apiv1/recaptchaenterprisepb"
 	chi "github.com/go-chi/chi/v5"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/attest"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/middleware"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/pass"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/problem"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/verify"
 	"go.uber.org/zap"
 )
 
@@ -20,60 +23,57 @@ const (
 	// apiKeyHeader       = "x-api-key"
 	// siteKeyHeader      = "x-site-key"
 	captchaTokenHeader = "x-recaptcha-token"
+	riskReasonsHeader  = "x-recaptcha-risk-reasons"
+	outcomeHeader      = "x-recaptcha-outcome"
 )
 
+// Retry hint of the provider failures
+const providerRetryAfter = time.Second
+
 type statusCodeGiver interface {
 	StatusCode() int
 }
 
-type jsonError struct {
-	Err error
-}
-
-type wrapErrorAsResp struct {
-	Error jsonError
-}
-
-type errorResp struct {
-	code    int
-	message string
-}
-
 type emptyResp struct {
 }
 
 type CaptchaVerifyOptions struct {
-	Threshold         float64
+	// Verifies the tokens with the configured provider
+	Verifier          *verify.Verifier
 	EnterpriseEnabled bool
 	// Enterprise related options
 	GoogleProjectId string
-	// non-Enterprise options
-	GoogleApi string
-}
-
-type captchaPayloadReq struct {
-	secret   string
-	response string
-}
-
-type siteVerifyResp struct {
-	success     bool      `json:"success"`               // whether this request was a valid reCAPTCHA token for your site
-	challengeTS time.Time `json:"challenge_ts"`          // timestamp of the challenge load (ISO format yyyy-MM-dd'T'HH:mm:ssZZ)
-	score       *float64  `json:"score,omitempty"`       // the score for this request (0.0 - 1.0)
-	action      *string   `json:"action,omitempty"`      // the action name for this request (important to verify)
-	hostname    string    `json:"hostname,omitempty"`    // the hostname of the site where the reCAPTCHA was solved
-	errorCodes  []string  `json:"error-codes,omitempty"` // optional
+	// Header of the account ID for Account Defender, when not passed as state
+	AccountIdHeader string
+	// Step-up challenge options, the interstitial is only served when a challenge site key is set
+	ChallengeSiteKey   string
+	ChallengeSecretKey string // non-Enterprise only
+	ChallengeUrl       string
+	// Signs the passes accepted instead of a token
+	PassSigner *pass.Signer
+	// Signs the verdict attestations forwarded upstream
+	Attester *attest.Signer
+	// Cookies holding the reCAPTCHA WAF tokens
+	WafActionTokenCookie  string
+	WafSessionTokenCookie string
+	// Shadow and fail-open modes, every verification is enforced when nil
+	Modes *Modes
 }
 
 type captchaOptionsWrapper struct {
 	captchaOptions *CaptchaVerifyOptions
 	log            *zap.Logger
+	// Whether the route only creates express assessments
+	express bool
 }
 
 type AuthState struct {
 	State struct {
-		SiteKey string `json:"x-site-key"` // site key
+		SiteKey     string                  `json:"x-site-key"`    // site key
+		AccountId   string                  `json:"x-account-id"`  // account ID for Account Defender (optional)
+		Transaction *verify.TransactionData `json:"x-transaction"` // payment transaction for Fraud Prevention (optional)
 	} `json:"state"`
+	Body string `json:"body"` // original request body, when `passThroughBody` is enabled
 }
 
 func HandleCaptcha(mux chi.Router, captchaOptions *CaptchaVerifyOptions, log *zap.Logger) {
@@ -86,6 +86,18 @@ func HandleCaptcha(mux chi.Router, captchaOptions *CaptchaVerifyOptions, log *za
 			// We are leaving response intact
 			return &emptyResp{}, nil
 		}, cw))
+
+	if captchaOptions.EnterpriseEnabled {
+		expressCw := &captchaOptionsWrapper{
+			captchaOptions: captchaOptions,
+			log:            log,
+			express:        true,
+		}
+		mux.Post("/captcha-verify/express", createAuthHandler(
+			func(ctx context.Context, _ any) (*emptyResp, error) {
+				return &emptyResp{}, nil
+			}, expressCw))
+	}
 }
 
 func createAuthHandler[Req, Res any](cb func(context.Context, Req) (Res, error), cw *captchaOptionsWrapper) http.HandlerFunc {
@@ -93,12 +105,8 @@ func createAuthHandler[Req, Res any](cb func(context.Context, Req) (Res, error),
 		var req Req
 		res, err := cb(r.Context(), req)
 		if err != nil {
-			if err, ok := err.(statusCodeGiver); ok {
-				w.WriteHeader(err.StatusCode())
-			} else {
-				w.WriteHeader(http.StatusInternalServerError)
-			}
-			writeJSON(w, wrapErrorAsResp{jsonError{err}})
+			// Coded as the refusals of the verification, so that the clients can rely on the same codes
+			problem.Write(w, r, cw.refusal(w, r, "", err))
 			return
 		}
 
@@ -106,137 +114,209 @@ func createAuthHandler[Req, Res any](cb func(context.Context, Req) (Res, error),
 		// "cannot use type assertion on type parameter value responseBody (variable of type Res constrained by any)"
 		// See https://github.com/golang/go/issues/45380#issuecomment-1014950980
 		if res, ok := any(res).(statusCodeGiver); ok {
+			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(res.StatusCode())
 		} else {
 			var authState AuthState
 			decoder := json.NewDecoder(r.Body)
 			decoderErr := decoder.Decode(&authState)
 			defer r.Body.Close()
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(decoderErr, &maxBytesErr) {
+				problem.Write(w, r, problem.New(http.StatusRequestEntityTooLarge, problem.CodeRequestTooLarge, "auth state too large"))
+				return
+			}
 			if decoderErr != nil {
-				cw.log.Error("error reading auth state body", zap.Error(decoderErr))
-				http.Error(w, decoderErr.Error(), http.StatusUnauthorized)
+				cw.logger(r).Error("error reading auth state body", zap.Error(decoderErr))
+				problem.Write(w, r, problem.New(http.StatusUnauthorized, problem.CodeInvalidRequest, "unable to read the auth state: "+decoderErr.Error()))
 				return
 			}
 
-			token := r.Header.Get(captchaTokenHeader)
-			if authState.State.SiteKey != "" && token != "" {
-				if err != nil {
-					cw.log.Error("unable to decode site key")
-					http.Error(w, "unauthorized", http.StatusUnauthorized)
-					return
-				}
-				errorResp, err := cw.createRecaptchaRequest(r.Context(), string(authState.State.SiteKey), token)
-				if errorResp != nil {
-					cw.log.Error(errorResp.message)
-					http.Error(w, errorResp.message, errorResp.code)
-					return
-				} else if err != nil {
-					cw.log.Error("site verification failure", zap.Error(err))
-					http.Error(w, "site verification failure", http.StatusUnauthorized)
-					return
-				}
-				cw.log.Info("successfully submitted and verified captcha")
-				w.WriteHeader(http.StatusOK)
-			} else {
-				http.Error(w, "unauthorized", http.StatusUnauthorized)
+			if !cw.authorize(w, r, authState) {
 				return
 			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
 		}
 		writeJSON(w, res)
 	}
 }
 
-func (cw *captchaOptionsWrapper) createRecaptchaRequest(ctx context.Context, siteKey string, token string) (*errorResp, error) {
-	if cw.captchaOptions.EnterpriseEnabled {
-		c, err := recaptchaenterprise.NewClient(ctx)
-		if err != nil {
-			log.Fatal("unable to create recaptcha enterprise client", zap.Error(err))
-		}
-		defer c.Close()
-
-		req := &recaptchaenterprisepb.CreateAssessmentRequest{
-			// See https://pkg.go.dev/cloud.google.com/go/recaptchaenterprise/v2/apiv1/recaptchaenterprisepb#CreateAssessmentRequest
-			Parent: fmt.Sprintf("projects/%s", cw.captchaOptions.GoogleProjectId),
-			Assessment: &recaptchaenterprisepb.Assessment{
-				Event: &recaptchaenterprisepb.Event{
-					Token:   token,
-					SiteKey: siteKey,
-				},
-			},
-		}
-		resp, err := c.CreateAssessment(ctx, req)
-		if err != nil {
-			log.Fatal("unable to process the recaptcha enterprise response", zap.Error(err))
-		}
-		return nil, cw.confirmEnterpriseAssessment(resp)
-	} else {
-		var captchaPayloadReq http.Request
-		var siteVerifyResp siteVerifyResp
-		captchaPayloadReq.ParseForm()
-		captchaPayloadReq.Form.Add("secret", siteKey)
-		captchaPayloadReq.Form.Add("response", token)
-
-		verifyCaptchaResp, err := http.Post(cw.captchaOptions.GoogleApi, "application/x-www-form-urlencoded", strings.NewReader(captchaPayloadReq.Form.Encode()))
-		if err != nil {
-			return &errorResp{
-				code:    http.StatusUnauthorized,
-				message: "unable to solve captcha",
-			}, nil
-		}
-
-		decoder := json.NewDecoder(verifyCaptchaResp.Body)
-		decoderErr := decoder.Decode(&siteVerifyResp)
+// Logger of the request, carrying its request ID
+func (cw *captchaOptionsWrapper) logger(r *http.Request) *zap.Logger {
+	return middleware.Logger(r.Context(), cw.log)
+}
 
-		defer verifyCaptchaResp.Body.Close()
+// Verifying the captcha of the request, or its pass. A refused request is answered and false is returned,
+// otherwise the outcome, pass and attestation headers are set for the caller to write the response.
+func (cw *captchaOptionsWrapper) authorize(w http.ResponseWriter, r *http.Request, authState AuthState) bool {
+	verifyReq := cw.newVerifyRequest(r, authState)
+	if cw.acceptsPass(verifyReq) && cw.hasValidPass(r, verifyReq.SiteKey) {
+		cw.logger(r).Info("successfully verified captcha pass")
+		if err := cw.attestAllow(w, authState.State.SiteKey, attest.SourcePass, ""); err != nil {
+			cw.logger(r).Error("unable to sign the verdict attestation", zap.Error(err))
+			problem.Write(w, r, problem.New(http.StatusInternalServerError, problem.CodeInternal, "unable to sign the verdict attestation"))
+			return false
+		}
+		w.Header().Set(outcomeHeader, string(verify.OutcomeAllow))
+		return true
+	}
 
-		if decoderErr != nil {
-			return &errorResp{
-				code:    http.StatusUnauthorized,
-				message: "unable to parse the response from captcha verification",
-			}, nil
+	if verifyReq.SiteKey == "" {
+		return cw.refuse(w, r, "", problem.New(http.StatusUnauthorized, problem.CodeSiteKeyMissing, "no site key in the auth state"))
+	}
+	if verifyReq.Token == "" && verifyReq.TokenType != verify.TokenExpress {
+		return cw.refuse(w, r, verifyReq.SiteKey, problem.New(http.StatusUnauthorized, problem.CodeTokenMissing, "no captcha token in the request"))
+	}
+	verdict, err := cw.captchaOptions.Verifier.Verify(r.Context(), verifyReq)
+	if err != nil {
+		return cw.refuse(w, r, verifyReq.SiteKey, cw.refusal(w, r, verifyReq.SiteKey, err))
+	}
+	// Not slowing down the traffic in shadow mode either
+	if verdict.Outcome == verify.OutcomeTarpit && !cw.captchaOptions.Modes.Shadow() {
+		select {
+		case <-time.After(verdict.Delay):
+		case <-r.Context().Done():
+			// Never answered as allowed, an empty response would be
+			problem.Write(w, r, problem.New(http.StatusServiceUnavailable, problem.CodeTimeout, "request timed out in the tarpit").WithRetryAfter(providerRetryAfter))
+			return false
 		}
-		return nil, cw.confirm(siteVerifyResp)
 	}
+	cw.logger(r).Info("successfully submitted and verified captcha",
+		zap.String("tokenType", string(verdict.TokenType)),
+		zap.Float64("score", verdict.Score),
+		zap.String("action", verdict.Action),
+		zap.String("outcome", string(verdict.Outcome)))
+	if verdict.Outcome == verify.OutcomeAllow && cw.captchaOptions.PassSigner != nil {
+		if err := cw.issuePass(w, r, verifyPassSubject, verifyReq.SiteKey); err != nil {
+			cw.logger(r).Error("unable to issue captcha pass", zap.Error(err))
+		}
+	}
+	if err := cw.attestVerdict(w, verifyReq, verdict); err != nil {
+		cw.logger(r).Error("unable to sign the verdict attestation", zap.Error(err))
+		problem.Write(w, r, problem.New(http.StatusInternalServerError, problem.CodeInternal, "unable to sign the verdict attestation"))
+		return false
+	}
+	w.Header().Set(outcomeHeader, string(verdict.Outcome))
+	return true
 }
 
-// Managing response from reCAPTCHA
-func (cw *captchaOptionsWrapper) confirm(resp siteVerifyResp) error {
-	if resp.errorCodes != nil {
-		return fmt.Errorf("remote error codes: %v", resp.errorCodes)
+// Retry hint of the provider failure, the time left before the circuit breaker probes the provider when known
+func providerRetry(providerErr *verify.ProviderError) time.Duration {
+	if providerErr.RetryAfter > 0 {
+		return providerErr.RetryAfter
 	}
+	return providerRetryAfter
+}
 
-	if !resp.success {
-		return fmt.Errorf("invalid challenge solution")
+// Logging the refusal of the verification and turning it into a problem, the headers read by the
+// clients behind Gloo are set on w as well. The challenge URL is issued for the site key.
+func (cw *captchaOptionsWrapper) refusal(w http.ResponseWriter, r *http.Request, siteKey string, err error) problem.Problem {
+	var providerErr *verify.ProviderError
+	if errors.As(err, &providerErr) {
+		// Cut off by the request timeout rather than refused by reCAPTCHA, never allowed by the fail-open mode
+		if middleware.TimedOut(r.Context()) {
+			cw.logger(r).Error("request timed out verifying the captcha", zap.Error(providerErr.Err))
+			return problem.New(http.StatusServiceUnavailable, problem.CodeTimeout, "request timed out verifying the captcha").WithRetryAfter(providerRetryAfter)
+		}
+		cw.logger(r).Error(providerErr.Message, zap.Error(providerErr.Err))
+		return problem.New(providerErr.StatusCode, problem.CodeProviderUnavailable, providerErr.Message).WithRetryAfter(providerRetry(providerErr))
 	}
-
-	if resp.score == nil {
-		return fmt.Errorf("no risk score available")
+	var challengeErr *verify.ChallengeError
+	if errors.As(err, &challengeErr) {
+		cw.logger(r).Info("challenge required", zap.Error(err))
+		w.Header().Set(outcomeHeader, string(verify.OutcomeChallenge))
+		p := problem.New(http.StatusPreconditionRequired, problem.CodeChallengeRequired, "challenge required")
+		if cw.captchaOptions.ChallengeSiteKey != "" && cw.captchaOptions.PassSigner != nil && siteKey != "" {
+			challengeUrl, err := cw.challengeUrl(r, siteKey)
+			if err != nil {
+				cw.logger(r).Error("unable to issue the challenge ticket", zap.Error(err))
+				return p
+			}
+			w.Header().Set(challengeUrlHeader, challengeUrl)
+			p.ChallengeUrl = challengeUrl
+		}
+		return p
 	}
-
-	threshold := 0.0
-	if cw.captchaOptions.Threshold != 0 {
-		threshold = cw.captchaOptions.Threshold
+	var expiredErr *verify.TokenExpiredError
+	if errors.As(err, &expiredErr) {
+		cw.logger(r).Info("token expired", zap.Error(err))
+		return problem.New(http.StatusUnauthorized, problem.CodeTokenExpired, "token expired")
 	}
-	if threshold >= *resp.score {
-		return fmt.Errorf("received score '%f', while expecting minimum '%f'", *resp.score, threshold)
+	var reasonsErr *verify.ReasonsError
+	if errors.As(err, &reasonsErr) {
+		cw.logger(r).Error("site verification failure", zap.Error(err), zap.Strings("matchedReasons", reasonsErr.Reasons))
+		w.Header().Set(outcomeHeader, string(verify.OutcomeDeny))
+		w.Header().Set(riskReasonsHeader, strings.Join(reasonsErr.Reasons, ","))
+		p := problem.New(http.StatusUnauthorized, problem.CodeRiskDenied, fmt.Sprintf("site verification failure, risk reasons: %s", strings.Join(reasonsErr.Reasons, ", ")))
+		p.RiskReasons = reasonsErr.Reasons
+		return p
 	}
-	return nil
+	cw.logger(r).Error("site verification failure", zap.Error(err))
+	w.Header().Set(outcomeHeader, string(verify.OutcomeDeny))
+	code := problem.CodeVerificationFailed
+	switch {
+	case errors.Is(err, verify.ErrMissingToken):
+		code = problem.CodeTokenMissing
+	case errors.Is(err, verify.ErrInvalidToken):
+		code = problem.CodeTokenInvalid
+	case errors.Is(err, verify.ErrScoreTooLow):
+		code = problem.CodeScoreTooLow
+	case errors.Is(err, verify.ErrActionMismatch):
+		code = problem.CodeActionMismatch
+	case errors.Is(err, verify.ErrRiskDenied):
+		code = problem.CodeRiskDenied
+	}
+	return problem.New(http.StatusUnauthorized, code, "site verification failure")
 }
 
-// Managing assessment from reCAPTCHA Enterprise
-func (cw *captchaOptionsWrapper) confirmEnterpriseAssessment(resp *recaptchaenterprisepb.Assessment) error {
-	if !resp.GetTokenProperties().GetValid() {
-		return fmt.Errorf("token is invalid: '%d'", int(resp.GetTokenProperties().GetInvalidReason()))
+// Collecting everything needed for the verification from the passthrough request
+func (cw *captchaOptionsWrapper) newVerifyRequest(r *http.Request, authState AuthState) verify.Request {
+	verifyReq := verify.Request{
+		SiteKey:   authState.State.SiteKey,
+		Token:     r.Header.Get(captchaTokenHeader),
+		TokenType: verify.TokenScore,
+		AccountId: authState.State.AccountId,
+		UserAgent: r.Header.Get("user-agent"),
+		UserIp:    middleware.ClientIp(r),
+	}
+	policy := cw.captchaOptions.Verifier.SitePolicy(verifyReq.SiteKey)
+	if cw.isExpress(policy) {
+		verifyReq.Token = ""
+		verifyReq.TokenType = verify.TokenExpress
+		verifyReq.Headers = expressHeaders(r)
+	} else if verifyReq.Token == "" {
+		cw.resolveWafToken(r, policy, &verifyReq)
+	}
+	if verifyReq.AccountId == "" && cw.captchaOptions.AccountIdHeader != "" {
+		verifyReq.AccountId = r.Header.Get(cw.captchaOptions.AccountIdHeader)
 	}
+	verifyReq.Transaction = authState.State.Transaction
+	if verifyReq.Transaction == nil {
+		transaction, err := parseTransactionBody(authState.Body)
+		if err != nil {
+			cw.logger(r).Debug("no transaction in the passed through body", zap.Error(err))
+		}
+		verifyReq.Transaction = transaction
+	}
+	return verifyReq
+}
+
+type transactionBody struct {
+	Transaction *verify.TransactionData `json:"transaction"`
+}
 
-	threshold := 0.0
-	if cw.captchaOptions.Threshold != 0 {
-		threshold = cw.captchaOptions.Threshold
+// Reading the transaction from the body of the original request, which is only present when
+// `passThroughBody` is enabled on the auth config
+func parseTransactionBody(body string) (*verify.TransactionData, error) {
+	if body == "" {
+		return nil, nil
 	}
-	if threshold >= float64(resp.GetRiskAnalysis().GetScore()) {
-		return fmt.Errorf("received score '%f', while expecting minimum '%f'", float64(resp.GetRiskAnalysis().GetScore()), threshold)
+	var tb transactionBody
+	if err := json.Unmarshal([]byte(body), &tb); err != nil {
+		return nil, fmt.Errorf("unable to parse transaction from body: %w", err)
 	}
-	return nil
+	return tb.Transaction, nil
 }
 
 func writeJSON(w io.Writer, v any) {
@@ -0,0 +1,464 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	recaptchaenterprisepb "cloud.google.com/go/recaptchaenterprise/v2/apiv1/recaptchaenterprisepb"
+	chi "github.com/go-chi/chi/v5"
+	"github.com/googleapis/gax-go/v2"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/pass"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/problem"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/verify"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// fakeAssessmentClient answers with a canned assessment, recording the events
+type fakeAssessmentClient struct {
+	assessment *recaptchaenterprisepb.Assessment
+	err        error
+	events     []*recaptchaenterprisepb.Event
+}
+
+func (c *fakeAssessmentClient) CreateAssessment(ctx context.Context, req *recaptchaenterprisepb.CreateAssessmentRequest, opts ...gax.CallOption) (*recaptchaenterprisepb.Assessment, error) {
+	c.events = append(c.events, req.GetAssessment().GetEvent())
+	return c.assessment, c.err
+}
+
+// headerCountingRecorder records the explicit WriteHeader calls, a second one is superfluous
+type headerCountingRecorder struct {
+	*httptest.ResponseRecorder
+	writeHeaders int
+}
+
+func (r *headerCountingRecorder) WriteHeader(status int) {
+	r.writeHeaders++
+	r.ResponseRecorder.WriteHeader(status)
+}
+
+func validAssessment(score float32, reasons ...recaptchaenterprisepb.RiskAnalysis_ClassificationReason) *recaptchaenterprisepb.Assessment {
+	return &recaptchaenterprisepb.Assessment{
+		Name: "projects/project/assessments/1",
+		TokenProperties: &recaptchaenterprisepb.TokenProperties{
+			Valid:      true,
+			Action:     "submit",
+			CreateTime: timestamppb.Now(),
+		},
+		RiskAnalysis: &recaptchaenterprisepb.RiskAnalysis{Score: score, Reasons: reasons},
+	}
+}
+
+func newCaptchaMux(t *testing.T, client verify.AssessmentClient, policies map[string]verify.SitePolicy, challenge bool) chi.Router {
+	t.Helper()
+	options := newCaptchaOptions(t, client, policies)
+	if challenge {
+		options.ChallengeSiteKey = "challenge-key"
+		options.ChallengeUrl = "/challenge"
+		options.PassSigner = newPassSigner(t)
+	}
+	mux := chi.NewMux()
+	HandleCaptcha(mux, options, zap.NewNop())
+	return mux
+}
+
+func newPassSigner(t *testing.T) *pass.Signer {
+	t.Helper()
+	signer, err := pass.NewSigner([]pass.Key{{Id: "test", Secret: []byte(strings.Repeat("s", 32))}}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func newCaptchaOptions(t *testing.T, client verify.AssessmentClient, policies map[string]verify.SitePolicy) *CaptchaVerifyOptions {
+	t.Helper()
+	verifier, err := verify.New(verify.Options{
+		Threshold: 0.5,
+		Enterprise: &verify.EnterpriseOptions{
+			ProjectId:                "project",
+			TransactionRiskThreshold: 0.5,
+			Client:                   client,
+		},
+		SitePolicies: policies,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &CaptchaVerifyOptions{
+		Verifier:          verifier,
+		EnterpriseEnabled: true,
+		GoogleProjectId:   "project",
+	}
+}
+
+func TestCreateAuthHandler(t *testing.T) {
+	challengeBands := map[string]verify.SitePolicy{verify.DefaultSitePolicyKey: {Bands: []verify.ScoreBand{
+		{MinScore: 0, Outcome: verify.OutcomeDeny},
+		{MinScore: 0.3, Outcome: verify.OutcomeChallenge},
+		{MinScore: 0.7, Outcome: verify.OutcomeAllow},
+	}}}
+	tests := []struct {
+		name       string
+		path       string
+		body       string
+		token      string
+		assessment *recaptchaenterprisepb.Assessment
+		clientErr  error
+		policies   map[string]verify.SitePolicy
+		challenge  bool
+		status     int
+		headers    map[string]string
+		respBody   string
+		code       problem.Code
+		assessed   int
+	}{
+		{
+			name:     "allowed",
+			body:     `{"state":{"x-site-key":"site-key"}}`,
+			token:    "token",
+			status:   http.StatusOK,
+			headers:  map[string]string{"Content-Type": "application/json", outcomeHeader: "allow"},
+			respBody: "{}\n",
+			assessed: 1,
+		},
+		{
+			name:   "malformed state body",
+			body:   `{"state":`,
+			token:  "token",
+			status: http.StatusUnauthorized,
+			code:   problem.CodeInvalidRequest,
+		},
+		{
+			name:   "empty body",
+			token:  "token",
+			status: http.StatusUnauthorized,
+			code:   problem.CodeInvalidRequest,
+		},
+		{
+			name:   "missing site key",
+			body:   `{"state":{}}`,
+			token:  "token",
+			status: http.StatusUnauthorized,
+			code:   problem.CodeSiteKeyMissing,
+		},
+		{
+			name:   "missing token header",
+			body:   `{"state":{"x-site-key":"site-key"}}`,
+			status: http.StatusUnauthorized,
+			code:   problem.CodeTokenMissing,
+		},
+		{
+			name:       "score equal to threshold",
+			body:       `{"state":{"x-site-key":"site-key"}}`,
+			token:      "token",
+			assessment: validAssessment(0.5),
+			status:     http.StatusUnauthorized,
+			headers:    map[string]string{outcomeHeader: "deny"},
+			code:       problem.CodeScoreTooLow,
+			assessed:   1,
+		},
+		{
+			name:       "invalid token",
+			body:       `{"state":{"x-site-key":"site-key"}}`,
+			token:      "token",
+			assessment: &recaptchaenterprisepb.Assessment{TokenProperties: &recaptchaenterprisepb.TokenProperties{InvalidReason: recaptchaenterprisepb.TokenProperties_MALFORMED}},
+			status:     http.StatusUnauthorized,
+			headers:    map[string]string{outcomeHeader: "deny"},
+			code:       problem.CodeTokenInvalid,
+			assessed:   1,
+		},
+		{
+			name:      "provider error",
+			body:      `{"state":{"x-site-key":"site-key"}}`,
+			token:     "token",
+			clientErr: errors.New("unavailable"),
+			status:    http.StatusBadGateway,
+			headers:   map[string]string{"Retry-After": "1"},
+			code:      problem.CodeProviderUnavailable,
+			assessed:  1,
+		},
+		{
+			name:       "denied risk reasons",
+			body:       `{"state":{"x-site-key":"site-key"}}`,
+			token:      "token",
+			assessment: validAssessment(0.9, recaptchaenterprisepb.RiskAnalysis_AUTOMATION, recaptchaenterprisepb.RiskAnalysis_TOO_MUCH_TRAFFIC),
+			policies:   map[string]verify.SitePolicy{"site-key": {DenyReasons: []string{"AUTOMATION", "TOO_MUCH_TRAFFIC"}}},
+			status:     http.StatusUnauthorized,
+			headers:    map[string]string{riskReasonsHeader: "AUTOMATION,TOO_MUCH_TRAFFIC", outcomeHeader: "deny"},
+			code:       problem.CodeRiskDenied,
+			assessed:   1,
+		},
+		{
+			name:     "action mismatch",
+			body:     `{"state":{"x-site-key":"site-key"}}`,
+			token:    "token",
+			policies: map[string]verify.SitePolicy{"site-key": {Actions: []string{"login"}}},
+			status:   http.StatusUnauthorized,
+			headers:  map[string]string{outcomeHeader: "deny"},
+			code:     problem.CodeActionMismatch,
+			assessed: 1,
+		},
+		{
+			name:       "challenge band",
+			body:       `{"state":{"x-site-key":"site-key"}}`,
+			token:      "token",
+			assessment: validAssessment(0.5),
+			policies:   challengeBands,
+			challenge:  true,
+			status:     http.StatusPreconditionRequired,
+			headers:    map[string]string{outcomeHeader: "challenge"},
+			code:       problem.CodeChallengeRequired,
+			assessed:   1,
+		},
+		{
+			name:       "challenge band without interstitial",
+			body:       `{"state":{"x-site-key":"site-key"}}`,
+			token:      "token",
+			assessment: validAssessment(0.5),
+			policies:   challengeBands,
+			status:     http.StatusPreconditionRequired,
+			headers:    map[string]string{outcomeHeader: "challenge", challengeUrlHeader: ""},
+			code:       problem.CodeChallengeRequired,
+			assessed:   1,
+		},
+		{
+			name:     "express assessment without token",
+			path:     "/captcha-verify/express",
+			body:     `{"state":{"x-site-key":"site-key"}}`,
+			status:   http.StatusOK,
+			headers:  map[string]string{outcomeHeader: "allow"},
+			respBody: "{}\n",
+			assessed: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.assessment == nil && tt.clientErr == nil {
+				tt.assessment = validAssessment(0.9)
+			}
+			if tt.path == "" {
+				tt.path = "/captcha-verify"
+			}
+			client := &fakeAssessmentClient{assessment: tt.assessment, err: tt.clientErr}
+			mux := newCaptchaMux(t, client, tt.policies, tt.challenge)
+
+			req := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body))
+			if tt.token != "" {
+				req.Header.Set(captchaTokenHeader, tt.token)
+			}
+			rec := &headerCountingRecorder{ResponseRecorder: httptest.NewRecorder()}
+			mux.ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Fatalf("got status %d, want %d (%s)", rec.Code, tt.status, rec.Body.String())
+			}
+			if rec.writeHeaders > 1 {
+				t.Errorf("got %d WriteHeader calls, want at most 1", rec.writeHeaders)
+			}
+			for name, want := range tt.headers {
+				if got := rec.Header().Get(name); got != want {
+					t.Errorf("got header %s %q, want %q", name, got, want)
+				}
+			}
+			if tt.respBody != "" && rec.Body.String() != tt.respBody {
+				t.Errorf("got body %q, want %q", rec.Body.String(), tt.respBody)
+			}
+			if tt.code != "" {
+				assertProblem(t, rec.Result(), rec.Body.Bytes(), tt.status, tt.code)
+			}
+			if len(client.events) != tt.assessed {
+				t.Errorf("got %d assessments, want %d", len(client.events), tt.assessed)
+			}
+		})
+	}
+}
+
+func TestRefusalProblem(t *testing.T) {
+	client := &fakeAssessmentClient{assessment: validAssessment(0.9, recaptchaenterprisepb.RiskAnalysis_AUTOMATION)}
+	mux := newCaptchaMux(t, client, map[string]verify.SitePolicy{"site-key": {DenyReasons: []string{"AUTOMATION"}}}, false)
+
+	req := httptest.NewRequest(http.MethodPost, "/captcha-verify", strings.NewReader(`{"state":{"x-site-key":"site-key"}}`))
+	req.Header.Set(captchaTokenHeader, "token")
+	req.Header.Set(problem.RequestIdHeader, "request-1")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+
+	p := assertProblem(t, rec.Result(), rec.Body.Bytes(), http.StatusUnauthorized, problem.CodeRiskDenied)
+	if p.RequestId != "request-1" || rec.Header().Get(problem.RequestIdHeader) != "request-1" {
+		t.Errorf("got request ID %q, want the one of the request", p.RequestId)
+	}
+	if p.Instance != "/captcha-verify" || p.Type != "urn:recaptcha-processing-server:problem:risk_denied" {
+		t.Errorf("got instance %q and type %q", p.Instance, p.Type)
+	}
+	if len(p.RiskReasons) != 1 || p.RiskReasons[0] != "AUTOMATION" {
+		t.Errorf("got risk reasons %v, want [AUTOMATION]", p.RiskReasons)
+	}
+	if p.RetryAfter != 0 {
+		t.Errorf("got retry hint %d, want none for a refusal", p.RetryAfter)
+	}
+}
+
+func TestCallbackErrorProblem(t *testing.T) {
+	cw := &captchaOptionsWrapper{captchaOptions: newCaptchaOptions(t, &fakeAssessmentClient{}, nil), log: zap.NewNop()}
+	handler := createAuthHandler(func(ctx context.Context, _ any) (*emptyResp, error) {
+		return nil, &verify.ProviderError{StatusCode: http.StatusServiceUnavailable, Message: "unavailable"}
+	}, cw)
+
+	req := httptest.NewRequest(http.MethodPost, "/captcha-verify", nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	p := assertProblem(t, rec.Result(), rec.Body.Bytes(), http.StatusServiceUnavailable, problem.CodeProviderUnavailable)
+	if p.RetryAfter == 0 {
+		t.Error("got no retry hint for a provider failure")
+	}
+
+	// The retry hint of the open circuit breaker is the time left before it probes the provider
+	handler = createAuthHandler(func(ctx context.Context, _ any) (*emptyResp, error) {
+		return nil, &verify.ProviderError{StatusCode: http.StatusServiceUnavailable, Message: "open", Err: verify.ErrBreakerOpen, RetryAfter: 25 * time.Second}
+	}, cw)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/captcha-verify", nil))
+	p = assertProblem(t, rec.Result(), rec.Body.Bytes(), http.StatusServiceUnavailable, problem.CodeProviderUnavailable)
+	if p.RetryAfter != 25 || rec.Header().Get("Retry-After") != "25" {
+		t.Errorf("got retry hint %d (%q), want 25", p.RetryAfter, rec.Header().Get("Retry-After"))
+	}
+}
+
+func assertProblem(t *testing.T, resp *http.Response, body []byte, status int, code problem.Code) problem.Problem {
+	t.Helper()
+	p, ok := problem.Read(resp, body)
+	if !ok {
+		t.Fatalf("got %q (%s), want problem details", body, resp.Header.Get("Content-Type"))
+	}
+	if p.Code != code || p.Status != status || resp.Header.Get(problem.CodeHeader) != string(code) {
+		t.Errorf("got problem %s (%d), want %s (%d)", p.Code, p.Status, code, status)
+	}
+	if p.RequestId == "" {
+		t.Error("got no request ID")
+	}
+	return p
+}
+
+func TestNewVerifyRequest(t *testing.T) {
+	client := &fakeAssessmentClient{assessment: validAssessment(0.9)}
+	mux := newCaptchaMux(t, client, nil, false)
+
+	body := `{"state":{"x-site-key":"site-key"},"body":"{\"transaction\":{\"amount\":12.5,\"currency\":\"AUD\"}}"}`
+	req := httptest.NewRequest(http.MethodPost, "/captcha-verify", strings.NewReader(body))
+	req.Header.Set(captchaTokenHeader, "token")
+	req.Header.Set("user-agent", "agent")
+	// Forged by the client, never read without trusted proxies
+	req.Header.Set("x-forwarded-for", "198.51.100.1")
+	req.RemoteAddr = "192.0.2.1:1234"
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusOK)
+	}
+	if len(client.events) != 1 {
+		t.Fatalf("got %d assessments, want 1", len(client.events))
+	}
+	event := client.events[0]
+	if event.Token != "token" || event.SiteKey != "site-key" {
+		t.Errorf("got token %q and site key %q", event.Token, event.SiteKey)
+	}
+	if event.UserAgent != "agent" || event.UserIpAddress != "192.0.2.1" {
+		t.Errorf("got user agent %q and IP %q", event.UserAgent, event.UserIpAddress)
+	}
+	if got := event.GetTransactionData(); got.GetValue() != 12.5 || got.GetCurrencyCode() != "AUD" {
+		t.Errorf("got transaction %v, want the one of the body", got)
+	}
+}
+
+func TestExpressHeaders(t *testing.T) {
+	client := &fakeAssessmentClient{assessment: validAssessment(0.9)}
+	options := newCaptchaOptions(t, client, nil)
+	options.AccountIdHeader = "x-account-id"
+	mux := chi.NewMux()
+	HandleCaptcha(mux, options, zap.NewNop())
+
+	req := httptest.NewRequest(http.MethodPost, "/captcha-verify/express", strings.NewReader(`{"state":{"x-site-key":"site-key"}}`))
+	req.Header.Set("user-agent", "agent")
+	req.Header.Set("accept-language", "en-AU")
+	req.Header.Set("sec-ch-ua-platform", `"Linux"`)
+	req.Header.Set("authorization", "Bearer secret")
+	req.Header.Set("cookie", "session=secret")
+	req.Header.Set("x-api-key", "secret")
+	req.Header.Set("x-account-id", "user@example.com")
+	req.Header.Set(passHeader, "pass")
+	req.Header.Set("x-internal-secret", "secret")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK || len(client.events) != 1 {
+		t.Fatalf("got status %d and %d assessments", rec.Code, len(client.events))
+	}
+	event := client.events[0]
+	want := []string{"Accept-Language: en-AU", `Sec-Ch-Ua-Platform: "Linux"`, "User-Agent: agent"}
+	if strings.Join(event.Headers, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got headers %q, want %q", event.Headers, want)
+	}
+	if event.GetUserInfo().GetAccountId() == "user@example.com" {
+		t.Error("got the raw account ID")
+	}
+}
+
+func TestPassWithRiskData(t *testing.T) {
+	tests := []struct {
+		name     string
+		state    string
+		policy   verify.SitePolicy
+		assessed int
+	}{
+		{name: "pass", state: `{"x-site-key":"site-key"}`},
+		{name: "transaction", state: `{"x-site-key":"site-key","x-transaction":{"amount":12.5,"currency":"AUD"}}`, assessed: 1},
+		{name: "account ID", state: `{"x-site-key":"site-key","x-account-id":"user@example.com"}`, assessed: 1},
+		{name: "opted in", state: `{"x-site-key":"site-key","x-transaction":{"amount":12.5,"currency":"AUD"}}`, policy: verify.SitePolicy{PassSkipsRiskAssessment: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakeAssessmentClient{assessment: validAssessment(0.9)}
+			verifier, err := verify.New(verify.Options{
+				Threshold: 0.5,
+				Enterprise: &verify.EnterpriseOptions{
+					ProjectId:                "project",
+					TransactionRiskThreshold: 0.5,
+					AccountIdSecret:          []byte("secret"),
+					Client:                   client,
+				},
+				SitePolicies: map[string]verify.SitePolicy{"site-key": tt.policy},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			options := &CaptchaVerifyOptions{Verifier: verifier, EnterpriseEnabled: true, GoogleProjectId: "project", PassSigner: newPassSigner(t)}
+			mux := chi.NewMux()
+			HandleCaptcha(mux, options, zap.NewNop())
+
+			req := httptest.NewRequest(http.MethodPost, "/captcha-verify", strings.NewReader(`{"state":`+tt.state+`}`))
+			issued, err := options.PassSigner.Issue(verifyPassSubject, passBinding(req, "site-key"), time.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set(passHeader, issued)
+			req.Header.Set(captchaTokenHeader, "token")
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("got status %d, want %d (%s)", rec.Code, http.StatusOK, rec.Body.String())
+			}
+			if len(client.events) != tt.assessed {
+				t.Errorf("got %d assessments, want %d", len(client.events), tt.assessed)
+			}
+		})
+	}
+}
@@ -0,0 +1,194 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"embed"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	chi "github.com/go-chi/chi/v5"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/middleware"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/problem"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/verify"
+	"go.uber.org/zap"
+)
+
+const (
+	challengeUrlHeader = "x-recaptcha-challenge-url"
+	// Subject of the passes issued by the challenge interstitial
+	challengePassSubject = "challenge"
+	// Subject of the tickets of the challenge URL, telling the interstitial which site key to bind the pass to
+	challengeTicketSubject = "challenge-ticket"
+)
+
+//go:embed views
+var viewsFS embed.FS
+
+type challengeData struct {
+	SiteKey    string
+	Enterprise bool
+	Action     string
+	ReturnTo   string
+	// Reference of the challenged site key and its ticket
+	Site   string
+	Ticket string
+	Error  string
+}
+
+// HandleChallenge serves the step-up interstitial with a v2 checkbox for the challenge site key, on the path of the
+// challenge URL.
+// A successful solve issues a short-lived pass, which is accepted by `/captcha-verify` on the retried request for the
+// site key of the ticket only.
+func HandleChallenge(mux chi.Router, captchaOptions *CaptchaVerifyOptions, log *zap.Logger) {
+	if captchaOptions.ChallengeSiteKey == "" || captchaOptions.PassSigner == nil {
+		return
+	}
+	cw := &captchaOptionsWrapper{
+		captchaOptions: captchaOptions,
+		log:            log,
+	}
+
+	path, err := challengePath(captchaOptions.ChallengeUrl)
+	if err != nil {
+		panic(err)
+	}
+
+	// Challenge template
+	view, err := template.ParseFS(viewsFS, "views/challenge.html")
+	if err != nil {
+		panic(err)
+	}
+	render := func(w http.ResponseWriter, r *http.Request, status int, data challengeData) {
+		data.SiteKey = captchaOptions.ChallengeSiteKey
+		data.Enterprise = captchaOptions.EnterpriseEnabled
+		data.Action = captchaOptions.ChallengeUrl
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(status)
+		if err := view.Execute(w, data); err != nil {
+			cw.logger(r).Error("unable to render the challenge", zap.Error(err))
+		}
+	}
+
+	mux.Get(path, func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		data := challengeData{
+			ReturnTo: safeReturnTo(query.Get("return_to")),
+			Site:     query.Get("site"),
+			Ticket:   query.Get("ticket"),
+		}
+		if err := cw.verifyTicket(r, data.Site, data.Ticket); err != nil {
+			cw.logger(r).Info("invalid challenge ticket", zap.Error(err))
+			data.Error = "This verification expired, please go back and try again"
+			render(w, r, http.StatusBadRequest, data)
+			return
+		}
+		render(w, r, http.StatusOK, data)
+	})
+
+	mux.Post(path, func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			problem.Write(w, r, problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "invalid challenge submission"))
+			return
+		}
+		data := challengeData{
+			ReturnTo: safeReturnTo(r.PostForm.Get("return_to")),
+			Site:     r.PostForm.Get("site"),
+			Ticket:   r.PostForm.Get("ticket"),
+		}
+		// The site of the ticket only is trusted, the pass would be accepted for any site key otherwise
+		if err := cw.verifyTicket(r, data.Site, data.Ticket); err != nil {
+			cw.logger(r).Info("invalid challenge ticket", zap.Error(err))
+			data.Error = "This verification expired, please go back and try again"
+			render(w, r, http.StatusBadRequest, data)
+			return
+		}
+		token := r.PostForm.Get("g-recaptcha-response")
+		if token == "" {
+			data.Error = "Please complete the challenge"
+			render(w, r, http.StatusBadRequest, data)
+			return
+		}
+		if err := cw.verifyChallenge(r, token); err != nil {
+			cw.logger(r).Info("challenge verification failure", zap.Error(err))
+			data.Error = "Verification failed, please try again"
+			render(w, r, http.StatusUnauthorized, data)
+			return
+		}
+
+		if err := cw.issuePass(w, r, challengePassSubject, data.Site); err != nil {
+			cw.logger(r).Error("unable to issue captcha pass", zap.Error(err))
+			problem.Write(w, r, problem.New(http.StatusInternalServerError, problem.CodeInternal, "unable to issue captcha pass"))
+			return
+		}
+		cw.logger(r).Info("successfully verified challenge")
+		http.Redirect(w, r, data.ReturnTo, http.StatusSeeOther)
+	})
+}
+
+// Path of the challenge URL, which is absolute when the interstitial is served on another host
+func challengePath(challengeUrl string) (string, error) {
+	parsed, err := url.Parse(challengeUrl)
+	if err != nil {
+		return "", fmt.Errorf("invalid challenge URL: %w", err)
+	}
+	if !strings.HasPrefix(parsed.Path, "/") {
+		return "", fmt.Errorf("challenge URL '%s' has no absolute path", challengeUrl)
+	}
+	return parsed.Path, nil
+}
+
+// Reference of the site key in the challenge URL and in the binding of the challenge passes. The classic site key
+// being the secret key, only its digest is disclosed.
+func challengeSite(siteKey string) string {
+	digest := sha256.Sum256([]byte(siteKey))
+	return base64.RawURLEncoding.EncodeToString(digest[:])
+}
+
+// URL of the interstitial for the challenged site key, with a ticket bound to the site and the client
+func (cw *captchaOptionsWrapper) challengeUrl(r *http.Request, siteKey string) (string, error) {
+	site := challengeSite(siteKey)
+	ticket, err := cw.captchaOptions.PassSigner.Issue(challengeTicketSubject, passBinding(r, site), time.Now())
+	if err != nil {
+		return "", err
+	}
+	separator := "?"
+	if strings.Contains(cw.captchaOptions.ChallengeUrl, "?") {
+		separator = "&"
+	}
+	return cw.captchaOptions.ChallengeUrl + separator + url.Values{"site": {site}, "ticket": {ticket}}.Encode(), nil
+}
+
+// Verifying that the ticket was issued for the site and the client
+func (cw *captchaOptionsWrapper) verifyTicket(r *http.Request, site string, ticket string) error {
+	_, err := cw.captchaOptions.PassSigner.Verify(ticket, challengeTicketSubject, passBinding(r, site), time.Now())
+	return err
+}
+
+// Verifying the v2 checkbox token, there is no score to check
+func (cw *captchaOptionsWrapper) verifyChallenge(r *http.Request, token string) error {
+	siteKey := cw.captchaOptions.ChallengeSiteKey
+	if !cw.captchaOptions.EnterpriseEnabled {
+		siteKey = cw.captchaOptions.ChallengeSecretKey
+	}
+	_, err := cw.captchaOptions.Verifier.Verify(r.Context(), verify.Request{
+		SiteKey:   siteKey,
+		Token:     token,
+		TokenType: verify.TokenCheckbox,
+		UserAgent: r.Header.Get("user-agent"),
+		UserIp:    middleware.ClientIp(r),
+	})
+	return err
+}
+
+// Only redirecting within the same site after the challenge
+func safeReturnTo(returnTo string) string {
+	if !strings.HasPrefix(returnTo, "/") || strings.HasPrefix(returnTo, "//") || strings.HasPrefix(returnTo, "/\\") {
+		return "/"
+	}
+	return returnTo
+}
@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	chi "github.com/go-chi/chi/v5"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/attest"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/problem"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/verify"
+	"go.uber.org/zap"
+)
+
+func TestChallengePass(t *testing.T) {
+	challengeBands := map[string]verify.SitePolicy{verify.DefaultSitePolicyKey: {Bands: []verify.ScoreBand{
+		{MinScore: 0, Outcome: verify.OutcomeDeny},
+		{MinScore: 0.3, Outcome: verify.OutcomeChallenge},
+		{MinScore: 0.7, Outcome: verify.OutcomeAllow},
+	}}}
+	client := &fakeAssessmentClient{assessment: validAssessment(0.5)}
+	options := newCaptchaOptions(t, client, challengeBands)
+	options.ChallengeSiteKey = "challenge-key"
+	options.ChallengeUrl = "/challenge"
+	options.PassSigner = newPassSigner(t)
+	attester, verifier := newAttester(t)
+	options.Attester = attester
+	mux := chi.NewMux()
+	HandleCaptcha(mux, options, zap.NewNop())
+	HandleChallenge(mux, options, zap.NewNop())
+
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+	verifyRequest := func(siteKey string, cookies ...*http.Cookie) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/captcha-verify", strings.NewReader(`{"state":{"x-site-key":"`+siteKey+`"}}`))
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		return req
+	}
+	submit := func(form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/challenge", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return serve(req)
+	}
+
+	// The challenged request gets the interstitial of its site key
+	req := verifyRequest("site-key")
+	req.Header.Set(captchaTokenHeader, "token")
+	rec := serve(req)
+	if rec.Code != http.StatusPreconditionRequired {
+		t.Fatalf("got status %d, want 428", rec.Code)
+	}
+	challengeUrl, err := url.Parse(rec.Header().Get(challengeUrlHeader))
+	if err != nil || challengeUrl.Path != "/challenge" {
+		t.Fatalf("got challenge URL %q", rec.Header().Get(challengeUrlHeader))
+	}
+	site, ticket := challengeUrl.Query().Get("site"), challengeUrl.Query().Get("ticket")
+	if site != challengeSite("site-key") || ticket == "" {
+		t.Fatalf("got site %q and ticket %q", site, ticket)
+	}
+
+	if rec := serve(httptest.NewRequest(http.MethodGet, challengeUrl.String(), nil)); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), ticket) {
+		t.Fatalf("got status %d for the interstitial, want 200 with the ticket", rec.Code)
+	}
+	if rec := serve(httptest.NewRequest(http.MethodGet, "/challenge", nil)); rec.Code != http.StatusBadRequest {
+		t.Errorf("got status %d for the interstitial without ticket, want 400", rec.Code)
+	}
+
+	// The ticket is bound to its site, another site can't be challenged with it
+	rec = submit(url.Values{"site": {challengeSite("other-site-key")}, "ticket": {ticket}, "g-recaptcha-response": {"token"}})
+	if rec.Code != http.StatusBadRequest || len(rec.Result().Cookies()) != 0 {
+		t.Fatalf("got status %d and cookies %v for another site, want 400 without pass", rec.Code, rec.Result().Cookies())
+	}
+
+	client.assessment = validAssessment(0.9)
+	rec = submit(url.Values{"site": {site}, "ticket": {ticket}, "g-recaptcha-response": {"token"}, "return_to": {"/form"}})
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/form" {
+		t.Fatalf("got status %d and location %q, want a redirect to /form", rec.Code, rec.Header().Get("Location"))
+	}
+	var passCookie *http.Cookie
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == "recaptcha-pass" {
+			passCookie = cookie
+		}
+	}
+	if passCookie == nil {
+		t.Fatal("got no pass cookie")
+	}
+
+	// The pass is accepted for the challenged site key only
+	assessed := len(client.events)
+	rec = serve(verifyRequest("site-key", passCookie))
+	if rec.Code != http.StatusOK {
+		t.Errorf("got status %d with the pass, want 200", rec.Code)
+	}
+	if claims, err := verifier.Verify(context.Background(), rec.Header().Get(verdictHeader), time.Now()); err != nil || claims.Source != attest.SourcePass {
+		t.Errorf("got attestation %+v (%v), want one of the pass", claims, err)
+	}
+	if len(client.events) != assessed {
+		t.Errorf("got %d assessments with the pass, want none", len(client.events)-assessed)
+	}
+	rec = serve(verifyRequest("other-site-key", passCookie))
+	assertProblem(t, rec.Result(), rec.Body.Bytes(), http.StatusUnauthorized, problem.CodeTokenMissing)
+}
+
+func TestChallengePath(t *testing.T) {
+	tests := []struct {
+		challengeUrl string
+		path         string
+		err          bool
+	}{
+		{challengeUrl: "/challenge", path: "/challenge"},
+		{challengeUrl: "/verify/challenge?lang=en", path: "/verify/challenge"},
+		{challengeUrl: "https://captcha.example.com/step-up", path: "/step-up"},
+		{challengeUrl: "https://captcha.example.com", err: true},
+		{challengeUrl: "challenge", err: true},
+		{challengeUrl: "%", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.challengeUrl, func(t *testing.T) {
+			path, err := challengePath(tt.challengeUrl)
+			if (err != nil) != tt.err {
+				t.Fatalf("got error %v, want an error %t", err, tt.err)
+			}
+			if path != tt.path {
+				t.Errorf("got path %q, want %q", path, tt.path)
+			}
+		})
+	}
+
+	options := newCaptchaOptions(t, &fakeAssessmentClient{}, nil)
+	options.ChallengeSiteKey = "challenge-key"
+	options.ChallengeUrl = "https://captcha.example.com/step-up"
+	options.PassSigner = newPassSigner(t)
+	mux := chi.NewMux()
+	HandleChallenge(mux, options, zap.NewNop())
+	for path, want := range map[string]int{"/step-up": http.StatusBadRequest, "/challenge": http.StatusNotFound} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != want {
+			t.Errorf("got status %d on %s, want %d", rec.Code, path, want)
+		}
+	}
+}
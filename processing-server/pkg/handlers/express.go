@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/pseudonator/recaptcha-processing-server/pkg/verify"
+)
+
+// Headers sent to reCAPTCHA Enterprise, describing the client. The others may carry credentials, passes or
+// identifiers, such as the account ID which only leaves the service hashed.
+var expressHeaderNames = map[string]bool{
+	"Accept":                    true,
+	"Accept-Encoding":           true,
+	"Accept-Language":           true,
+	"Cache-Control":             true,
+	"Connection":                true,
+	"Content-Type":              true,
+	"Dnt":                       true,
+	"Origin":                    true,
+	"Pragma":                    true,
+	"Referer":                   true,
+	"Sec-Ch-Ua":                 true,
+	"Sec-Ch-Ua-Mobile":          true,
+	"Sec-Ch-Ua-Platform":        true,
+	"Sec-Fetch-Dest":            true,
+	"Sec-Fetch-Mode":            true,
+	"Sec-Fetch-Site":            true,
+	"Sec-Fetch-User":            true,
+	"Upgrade-Insecure-Requests": true,
+	"User-Agent":                true,
+}
+
+func (cw *captchaOptionsWrapper) isExpress(policy verify.SitePolicy) bool {
+	return cw.captchaOptions.EnterpriseEnabled && (cw.express || policy.Express)
+}
+
+// Formatting the allowed request headers as `name: value`, in a stable order
+func expressHeaders(r *http.Request) []string {
+	var headers []string
+	for name, values := range r.Header {
+		if !expressHeaderNames[name] {
+			continue
+		}
+		for _, value := range values {
+			headers = append(headers, name+": "+value)
+		}
+	}
+	sort.Strings(headers)
+	return headers
+}
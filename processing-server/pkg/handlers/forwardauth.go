@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	chi "github.com/go-chi/chi/v5"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/problem"
+	"go.uber.org/zap"
+)
+
+const (
+	// Headers of the original request, set by NGINX (by convention) and by Traefik
+	originalUriHeader   = "x-original-uri"
+	forwardedUriHeader  = "x-forwarded-uri"
+	forwardedHostHeader = "x-forwarded-host"
+)
+
+// NGINX treats any status other than 2xx, 401 and 403 as an error of the subrequest and answers 500. The refusals
+// the client can act upon are answered with 401, the failures of the service or of reCAPTCHA with 403, the problem
+// code and the retry hint telling them apart.
+var nginxStatuses = map[int]int{
+	http.StatusBadRequest:            http.StatusUnauthorized,
+	http.StatusRequestEntityTooLarge: http.StatusUnauthorized,
+	http.StatusPreconditionRequired:  http.StatusUnauthorized,
+	http.StatusTooManyRequests:       http.StatusUnauthorized,
+	http.StatusInternalServerError:   http.StatusForbidden,
+	http.StatusBadGateway:            http.StatusForbidden,
+	http.StatusServiceUnavailable:    http.StatusForbidden,
+	http.StatusGatewayTimeout:        http.StatusForbidden,
+}
+
+// ForwardAuthOptions resolve the site key of the bodiless subrequests.
+type ForwardAuthOptions struct {
+	// Header set by the proxy with the site key, when no mapping matches
+	SiteKeyHeader string
+	SiteKeys      []SiteKeyMapping
+}
+
+// SiteKeyMapping maps the original requests of a host and a path prefix to a site key.
+type SiteKeyMapping struct {
+	// Any host when empty
+	Host       string `json:"host,omitempty"`
+	PathPrefix string `json:"pathPrefix"`
+	SiteKey    string `json:"siteKey"`
+}
+
+// Validate the mapping.
+func (m SiteKeyMapping) Validate() error {
+	if !strings.HasPrefix(m.PathPrefix, "/") {
+		return fmt.Errorf("pathPrefix must start with '/'")
+	}
+	if m.SiteKey == "" {
+		return fmt.Errorf("siteKey is required")
+	}
+	return nil
+}
+
+// HandleForwardAuth serves the endpoints of the NGINX `auth_request` and Traefik `ForwardAuth` subrequests,
+// which carry the headers of the original request without its body.
+func HandleForwardAuth(mux chi.Router, forwardAuth *ForwardAuthOptions, captchaOptions *CaptchaVerifyOptions, log *zap.Logger) {
+	cw := &captchaOptionsWrapper{
+		captchaOptions: captchaOptions,
+		log:            log,
+	}
+	mux.HandleFunc("/auth/nginx", cw.forwardAuthHandler(forwardAuth, nginxStatuses))
+	// Traefik returns the response of a refusal to the client as it is
+	mux.HandleFunc("/auth/traefik", cw.forwardAuthHandler(forwardAuth, nil))
+}
+
+func (cw *captchaOptionsWrapper) forwardAuthHandler(forwardAuth *ForwardAuthOptions, statuses map[int]int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = &statusMappingWriter{ResponseWriter: w, statuses: statuses}
+		host, path := originalRequest(r)
+		var authState AuthState
+		authState.State.SiteKey = forwardAuth.siteKey(r, host, path)
+		if authState.State.SiteKey == "" {
+			cw.logger(r).Info("no site key for the original request", zap.String("host", host), zap.String("path", path))
+			problem.Write(w, r, problem.New(http.StatusUnauthorized, problem.CodeSiteKeyMissing, "no site key for the original request"))
+			return
+		}
+
+		if !cw.authorize(w, r, authState) {
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// Reading the host and the path of the original request from the proxy headers
+func originalRequest(r *http.Request) (string, string) {
+	host := r.Header.Get(forwardedHostHeader)
+	if host == "" {
+		host = r.Host
+	}
+	uri := r.Header.Get(originalUriHeader)
+	if uri == "" {
+		uri = r.Header.Get(forwardedUriHeader)
+	}
+	if uri == "" {
+		return host, r.URL.Path
+	}
+	parsed, err := url.ParseRequestURI(uri)
+	if err != nil {
+		return host, uri
+	}
+	return host, parsed.Path
+}
+
+// Picking the longest path prefix mapped for the host, falling back to the site key header
+func (o *ForwardAuthOptions) siteKey(r *http.Request, host string, path string) string {
+	var matched *SiteKeyMapping
+	for i, m := range o.SiteKeys {
+		if m.Host != "" && !strings.EqualFold(m.Host, host) {
+			continue
+		}
+		if !strings.HasPrefix(path, m.PathPrefix) {
+			continue
+		}
+		if matched == nil || len(m.PathPrefix) > len(matched.PathPrefix) {
+			matched = &o.SiteKeys[i]
+		}
+	}
+	if matched != nil {
+		return matched.SiteKey
+	}
+	if o.SiteKeyHeader != "" {
+		return r.Header.Get(o.SiteKeyHeader)
+	}
+	return ""
+}
+
+// statusMappingWriter replaces the statuses the proxy doesn't understand
+type statusMappingWriter struct {
+	http.ResponseWriter
+	statuses map[int]int
+}
+
+func (w *statusMappingWriter) WriteHeader(status int) {
+	if mapped, ok := w.statuses[status]; ok {
+		status = mapped
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	chi "github.com/go-chi/chi/v5"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/problem"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/verify"
+	"go.uber.org/zap"
+)
+
+func TestNginxStatuses(t *testing.T) {
+	tests := []struct {
+		status int
+		code   problem.Code
+		want   int
+	}{
+		{status: http.StatusBadRequest, code: problem.CodeInvalidRequest, want: http.StatusUnauthorized},
+		{status: http.StatusUnauthorized, code: problem.CodeTokenInvalid, want: http.StatusUnauthorized},
+		{status: http.StatusForbidden, code: problem.CodeScoreTooLow, want: http.StatusForbidden},
+		{status: http.StatusRequestEntityTooLarge, code: problem.CodeRequestTooLarge, want: http.StatusUnauthorized},
+		{status: http.StatusPreconditionRequired, code: problem.CodeChallengeRequired, want: http.StatusUnauthorized},
+		{status: http.StatusTooManyRequests, code: problem.CodeVerificationFailed, want: http.StatusUnauthorized},
+		{status: http.StatusInternalServerError, code: problem.CodeInternal, want: http.StatusForbidden},
+		{status: http.StatusBadGateway, code: problem.CodeProviderUnavailable, want: http.StatusForbidden},
+		{status: http.StatusServiceUnavailable, code: problem.CodeTimeout, want: http.StatusForbidden},
+		{status: http.StatusGatewayTimeout, code: problem.CodeTimeout, want: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			w := &statusMappingWriter{ResponseWriter: rec, statuses: nginxStatuses}
+			problem.Write(w, httptest.NewRequest(http.MethodGet, "/auth/nginx", nil), problem.New(tt.status, tt.code, "refused"))
+
+			if rec.Code != tt.want {
+				t.Errorf("got status %d, want %d", rec.Code, tt.want)
+			}
+			if got := rec.Header().Get(problem.CodeHeader); got != string(tt.code) {
+				t.Errorf("got code %q, want %q", got, tt.code)
+			}
+		})
+	}
+}
+
+func TestForwardAuth(t *testing.T) {
+	challengeBands := map[string]verify.SitePolicy{verify.DefaultSitePolicyKey: {Bands: []verify.ScoreBand{
+		{MinScore: 0, Outcome: verify.OutcomeDeny},
+		{MinScore: 0.3, Outcome: verify.OutcomeChallenge},
+		{MinScore: 0.7, Outcome: verify.OutcomeAllow},
+	}}}
+	tests := []struct {
+		name    string
+		path    string
+		siteKey string
+		client  *fakeAssessmentClient
+		status  int
+		code    problem.Code
+	}{
+		{name: "nginx allowed", path: "/auth/nginx", siteKey: "site-key", client: &fakeAssessmentClient{assessment: validAssessment(0.9)}, status: http.StatusOK},
+		{name: "nginx without site key", path: "/auth/nginx", client: &fakeAssessmentClient{}, status: http.StatusUnauthorized, code: problem.CodeSiteKeyMissing},
+		{name: "nginx challenge", path: "/auth/nginx", siteKey: "site-key", client: &fakeAssessmentClient{assessment: validAssessment(0.5)}, status: http.StatusUnauthorized, code: problem.CodeChallengeRequired},
+		{name: "nginx provider failure", path: "/auth/nginx", siteKey: "site-key", client: &fakeAssessmentClient{err: errors.New("unavailable")}, status: http.StatusForbidden, code: problem.CodeProviderUnavailable},
+		{name: "traefik challenge", path: "/auth/traefik", siteKey: "site-key", client: &fakeAssessmentClient{assessment: validAssessment(0.5)}, status: http.StatusPreconditionRequired, code: problem.CodeChallengeRequired},
+		{name: "traefik provider failure", path: "/auth/traefik", siteKey: "site-key", client: &fakeAssessmentClient{err: errors.New("unavailable")}, status: http.StatusBadGateway, code: problem.CodeProviderUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux := chi.NewMux()
+			HandleForwardAuth(mux, &ForwardAuthOptions{SiteKeyHeader: "x-site-key"}, newCaptchaOptions(t, tt.client, challengeBands), zap.NewNop())
+
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.Header.Set(captchaTokenHeader, "token")
+			if tt.siteKey != "" {
+				req.Header.Set("x-site-key", tt.siteKey)
+			}
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Fatalf("got status %d, want %d", rec.Code, tt.status)
+			}
+			if got := rec.Header().Get(problem.CodeHeader); got != string(tt.code) {
+				t.Errorf("got code %q, want %q", got, tt.code)
+			}
+		})
+	}
+}
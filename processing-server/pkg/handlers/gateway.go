@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	chi "github.com/go-chi/chi/v5"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/problem"
+	"go.uber.org/zap"
+)
+
+// Maximum size of the request bodies parsed for the Fraud Prevention transactions, the larger ones are streamed
+// to the upstream without transaction, within the body size limit of the gateway
+const maxTransactionBodySize = 1 << 20
+
+// Headers set by this service only, the values sent by the clients are dropped
+var gatewayUpstreamHeaders = []string{verdictHeader, outcomeHeader}
+
+// GatewayRoute protects the requests matching the path prefix, before forwarding them to the upstream.
+type GatewayRoute struct {
+	PathPrefix string `json:"pathPrefix"`
+	Upstream   string `json:"upstream"`
+	SiteKey    string `json:"siteKey"`
+	// Methods requiring a verification, all of them when empty. The other methods are forwarded as they are.
+	Methods []string `json:"methods,omitempty"`
+	// Creating token-less express assessments (Enterprise only)
+	Express bool `json:"express,omitempty"`
+}
+
+// Validate the route.
+func (g GatewayRoute) Validate() error {
+	if !strings.HasPrefix(g.PathPrefix, "/") {
+		return fmt.Errorf("pathPrefix must start with '/'")
+	}
+	upstream, err := url.Parse(g.Upstream)
+	if err != nil || upstream.Scheme == "" || upstream.Host == "" {
+		return fmt.Errorf("upstream must be an absolute URL")
+	}
+	if g.SiteKey == "" {
+		return fmt.Errorf("siteKey is required")
+	}
+	return nil
+}
+
+// HandleGateway verifies the captcha of the routes and forwards the requests to their upstream,
+// for the environments without Gloo Edge. The token is stripped, while the verdict headers are added.
+func HandleGateway(mux chi.Router, routes []GatewayRoute, captchaOptions *CaptchaVerifyOptions, log *zap.Logger) {
+	for _, route := range routes {
+		cw := &captchaOptionsWrapper{
+			captchaOptions: captchaOptions,
+			log:            log.With(zap.String("route", route.PathPrefix)),
+			express:        route.Express,
+		}
+		handler := cw.gatewayHandler(route)
+
+		prefix := strings.TrimSuffix(route.PathPrefix, "/")
+		if prefix != "" {
+			mux.Handle(prefix, handler)
+		}
+		mux.Handle(prefix+"/*", handler)
+	}
+}
+
+func (cw *captchaOptionsWrapper) gatewayHandler(route GatewayRoute) http.Handler {
+	upstream, _ := url.Parse(route.Upstream)
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(upstream)
+			pr.SetXForwarded()
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			cw.logger(r).Error("unable to forward the request", zap.String("upstream", route.Upstream), zap.Error(err))
+			problem.Write(w, r, problem.New(http.StatusBadGateway, problem.CodeUpstreamUnavailable, "unable to forward the request"))
+		},
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, name := range gatewayUpstreamHeaders {
+			r.Header.Del(name)
+		}
+		if route.verifies(r.Method) {
+			var authState AuthState
+			authState.State.SiteKey = route.SiteKey
+			if cw.captchaOptions.EnterpriseEnabled && isJSON(r) {
+				body, err := cw.peekBody(r)
+				if err != nil {
+					var maxBytesErr *http.MaxBytesError
+					if errors.As(err, &maxBytesErr) {
+						problem.Write(w, r, problem.New(http.StatusRequestEntityTooLarge, problem.CodeRequestTooLarge, "request body too large"))
+						return
+					}
+					cw.logger(r).Info("unable to read the request body", zap.Error(err))
+					problem.Write(w, r, problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "unable to read the request body"))
+					return
+				}
+				authState.Body = body
+			}
+			if !cw.authorize(w, r, authState) {
+				return
+			}
+			// The verdict goes upstream, only the pass is returned to the client
+			for _, name := range gatewayUpstreamHeaders {
+				if v := w.Header().Get(name); v != "" {
+					r.Header.Set(name, v)
+				}
+				w.Header().Del(name)
+			}
+			r.Header.Del(captchaTokenHeader)
+		}
+		proxy.ServeHTTP(w, r)
+	})
+}
+
+// Reading the beginning of the body for its transaction, the body is then replayed to the upstream. Empty when
+// the body is larger than the transactions parsed.
+func (cw *captchaOptionsWrapper) peekBody(r *http.Request) (string, error) {
+	prefix, err := io.ReadAll(io.LimitReader(r.Body, maxTransactionBodySize+1))
+	if err != nil {
+		return "", err
+	}
+	r.Body = replayedBody{Reader: io.MultiReader(bytes.NewReader(prefix), r.Body), Closer: r.Body}
+	if len(prefix) > maxTransactionBodySize {
+		cw.logger(r).Debug("request body too large for its transaction to be parsed")
+		return "", nil
+	}
+	return string(prefix), nil
+}
+
+type replayedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// Only the JSON bodies may carry a transaction
+func isJSON(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"))
+}
+
+func (g GatewayRoute) verifies(method string) bool {
+	if len(g.Methods) == 0 {
+		return true
+	}
+	for _, m := range g.Methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
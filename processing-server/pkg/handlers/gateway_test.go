@@ -0,0 +1,174 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	chi "github.com/go-chi/chi/v5"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/middleware"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/problem"
+	"go.uber.org/zap"
+)
+
+// upstreamRecorder records the requests forwarded by the gateway
+type upstreamRecorder struct {
+	header http.Header
+	body   []byte
+	calls  int
+}
+
+func newUpstream(t *testing.T) (*upstreamRecorder, string) {
+	t.Helper()
+	rec := &upstreamRecorder{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec.calls++
+		rec.header = r.Header.Clone()
+		rec.body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(srv.Close)
+	return rec, srv.URL
+}
+
+func newGatewayMux(t *testing.T, client *fakeAssessmentClient, upstream string, bodyLimit int64) chi.Router {
+	t.Helper()
+	mux := chi.NewMux()
+	mux.Use(middleware.BodyLimit(bodyLimit))
+	routes := []GatewayRoute{{PathPrefix: "/submit", Upstream: upstream, SiteKey: "site-key", Methods: []string{"POST"}}}
+	HandleGateway(mux, routes, newCaptchaOptions(t, client, nil), zap.NewNop())
+	return mux
+}
+
+func TestHandleGateway(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		token  string
+		status int
+		// Outcome forwarded upstream, not called when empty
+		outcome  string
+		assessed int
+	}{
+		{name: "verified", method: http.MethodPost, token: "token", status: http.StatusNoContent, outcome: "allow", assessed: 1},
+		{name: "missing token", method: http.MethodPost, status: http.StatusUnauthorized},
+		{name: "method not verified", method: http.MethodGet, status: http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakeAssessmentClient{assessment: validAssessment(0.9)}
+			upstream, url := newUpstream(t)
+			mux := newGatewayMux(t, client, url, 1<<20)
+
+			req := httptest.NewRequest(tt.method, "/submit/form", strings.NewReader("name=value"))
+			if tt.token != "" {
+				req.Header.Set(captchaTokenHeader, tt.token)
+			}
+			// Spoofed by the client
+			req.Header.Set(outcomeHeader, "allow")
+			req.Header.Set(verdictHeader, "forged")
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Fatalf("got status %d, want %d (%s)", rec.Code, tt.status, rec.Body.String())
+			}
+			if len(client.events) != tt.assessed {
+				t.Errorf("got %d assessments, want %d", len(client.events), tt.assessed)
+			}
+			if rec.Header().Get(outcomeHeader) != "" && tt.status != http.StatusUnauthorized {
+				t.Errorf("got outcome %q returned to the client", rec.Header().Get(outcomeHeader))
+			}
+			if tt.status == http.StatusUnauthorized {
+				if upstream.calls != 0 {
+					t.Errorf("got %d calls to the upstream of a refused request", upstream.calls)
+				}
+				return
+			}
+			if got := upstream.header.Get(outcomeHeader); got != tt.outcome {
+				t.Errorf("got outcome %q upstream, want %q", got, tt.outcome)
+			}
+			if got := upstream.header.Get(verdictHeader); got != "" {
+				t.Errorf("got verdict %q upstream, want the spoofed one dropped", got)
+			}
+			if got := upstream.header.Get(captchaTokenHeader); got != "" {
+				t.Errorf("got token %q upstream", got)
+			}
+			if string(upstream.body) != "name=value" {
+				t.Errorf("got body %q upstream", upstream.body)
+			}
+		})
+	}
+}
+
+func TestGatewayBody(t *testing.T) {
+	transaction := `{"transaction":{"amount":12.5,"currency":"AUD"}}`
+	large := `{"transaction":{"amount":12.5,"currency":"AUD"},"padding":"` + strings.Repeat("a", maxTransactionBodySize) + `"}`
+	tests := []struct {
+		name        string
+		body        string
+		contentType string
+		bodyLimit   int64
+		status      int
+		transaction bool
+	}{
+		{name: "transaction", body: transaction, contentType: "application/json", bodyLimit: 1 << 20, status: http.StatusNoContent, transaction: true},
+		{name: "not JSON", body: transaction, contentType: "text/plain", bodyLimit: 1 << 20, status: http.StatusNoContent},
+		{name: "above the transaction size", body: large, contentType: "application/json", bodyLimit: 4 << 20, status: http.StatusNoContent},
+		{name: "above the body size limit", body: large, contentType: "application/json", bodyLimit: 1 << 10, status: http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakeAssessmentClient{assessment: validAssessment(0.9)}
+			upstream, url := newUpstream(t)
+			mux := newGatewayMux(t, client, url, tt.bodyLimit)
+
+			req := httptest.NewRequest(http.MethodPost, "/submit", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+			req.Header.Set(captchaTokenHeader, "token")
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Fatalf("got status %d, want %d", rec.Code, tt.status)
+			}
+			if tt.status != http.StatusNoContent {
+				assertProblem(t, rec.Result(), rec.Body.Bytes(), tt.status, problem.CodeRequestTooLarge)
+				return
+			}
+			if !bytes.Equal(upstream.body, []byte(tt.body)) {
+				t.Errorf("got %d bytes upstream, want the %d of the request", len(upstream.body), len(tt.body))
+			}
+			if got := client.events[0].GetTransactionData() != nil; got != tt.transaction {
+				t.Errorf("got transaction %t, want %t", got, tt.transaction)
+			}
+		})
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestGatewayBodyError(t *testing.T) {
+	client := &fakeAssessmentClient{assessment: validAssessment(0.9)}
+	upstream, url := newUpstream(t)
+	mux := newGatewayMux(t, client, url, 1<<20)
+
+	req := httptest.NewRequest(http.MethodPost, "/submit", failingReader{})
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(captchaTokenHeader, "token")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+
+	assertProblem(t, rec.Result(), rec.Body.Bytes(), http.StatusBadRequest, problem.CodeInvalidRequest)
+	if upstream.calls != 0 || len(client.events) != 0 {
+		t.Errorf("got %d calls to the upstream and %d assessments", upstream.calls, len(client.events))
+	}
+}
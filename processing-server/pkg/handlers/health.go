@@ -4,10 +4,41 @@ import (
 	"net/http"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/health"
 )
 
+// Health is kept for the existing probes, it only tells that the server answers, as /livez does
 func Health(mux chi.Router) {
 	mux.Get("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 	})
 }
+
+// HandleProbes serves the Kubernetes probes. The liveness probe never checks the dependencies, so that
+// an outage of reCAPTCHA does not restart the pods, while the readiness and startup probes do.
+func HandleProbes(mux chi.Router, checker *health.Checker) {
+	mux.Get("/livez", func(w http.ResponseWriter, r *http.Request) {
+		writeReport(w, health.Report{Status: health.StatusOk})
+	})
+	mux.Get("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeReport(w, checker.Ready(r.Context()))
+	})
+	mux.Get("/startupz", func(w http.ResponseWriter, r *http.Request) {
+		if checker.Started() {
+			writeReport(w, health.Report{Status: health.StatusOk})
+			return
+		}
+		writeReport(w, checker.Ready(r.Context()))
+	})
+}
+
+func writeReport(w http.ResponseWriter, report health.Report) {
+	status := http.StatusOK
+	if report.Status != health.StatusOk {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	writeJSON(w, report)
+}
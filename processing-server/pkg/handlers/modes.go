@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"github.com/pseudonator/recaptcha-processing-server/pkg/attest"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/problem"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/verify"
+	"go.uber.org/zap"
+)
+
+// Modes relaxing the verification, toggled at runtime on the admin listener. The zero value enforces
+// every verification.
+type Modes struct {
+	// Shadow mode: every request is allowed, the refusals are only logged
+	shadow atomic.Bool
+	// Fail-open mode: the requests are allowed when reCAPTCHA can't be reached
+	failOpen atomic.Bool
+}
+
+func (m *Modes) Shadow() bool {
+	return m != nil && m.shadow.Load()
+}
+
+func (m *Modes) SetShadow(enabled bool) {
+	m.shadow.Store(enabled)
+}
+
+func (m *Modes) FailOpen() bool {
+	return m != nil && m.failOpen.Load()
+}
+
+func (m *Modes) SetFailOpen(enabled bool) {
+	m.failOpen.Store(enabled)
+}
+
+// Refusing the request, unless in shadow mode, or in fail-open mode for a provider failure. The allowed
+// requests get the allow outcome rather than the headers of the refusal, with an attestation of the mode,
+// and true is returned.
+func (cw *captchaOptionsWrapper) refuse(w http.ResponseWriter, r *http.Request, siteKey string, p problem.Problem) bool {
+	modes := cw.captchaOptions.Modes
+	var source string
+	switch {
+	case modes.Shadow():
+		cw.logger(r).Warn("shadow mode, allowing a refused request", zap.String("code", string(p.Code)), zap.Int("status", p.Status))
+		source = attest.SourceShadow
+	case modes.FailOpen() && p.Code == problem.CodeProviderUnavailable:
+		cw.logger(r).Warn("fail-open mode, allowing a request without verification", zap.Int("status", p.Status))
+		source = attest.SourceFailOpen
+	default:
+		problem.Write(w, r, p)
+		return false
+	}
+	for _, header := range []string{challengeUrlHeader, riskReasonsHeader} {
+		w.Header().Del(header)
+	}
+	if err := cw.attestAllow(w, siteKey, source, p.Code); err != nil {
+		cw.logger(r).Error("unable to sign the verdict attestation", zap.Error(err))
+		problem.Write(w, r, problem.New(http.StatusInternalServerError, problem.CodeInternal, "unable to sign the verdict attestation"))
+		return false
+	}
+	w.Header().Set(outcomeHeader, string(verify.OutcomeAllow))
+	return true
+}
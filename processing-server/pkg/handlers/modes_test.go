@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	recaptchaenterprisepb "cloud.google.com/go/recaptchaenterprise/v2/apiv1/recaptchaenterprisepb"
+	chi "github.com/go-chi/chi/v5"
+	"github.com/googleapis/gax-go/v2"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/attest"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/middleware"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/problem"
+	"go.uber.org/zap"
+)
+
+func TestModes(t *testing.T) {
+	tests := []struct {
+		name       string
+		shadow     bool
+		failOpen   bool
+		token      string
+		assessment *recaptchaenterprisepb.Assessment
+		clientErr  error
+		status     int
+		code       problem.Code
+		// Source and overridden refusal of the attestation
+		source  string
+		refusal problem.Code
+	}{
+		{name: "enforced refusal", token: "token", assessment: validAssessment(0.1), status: http.StatusUnauthorized, code: problem.CodeScoreTooLow},
+		{name: "shadow refusal", shadow: true, token: "token", assessment: validAssessment(0.1), status: http.StatusOK, source: attest.SourceShadow, refusal: problem.CodeScoreTooLow},
+		{name: "shadow missing token", shadow: true, status: http.StatusOK, source: attest.SourceShadow, refusal: problem.CodeTokenMissing},
+		{name: "shadow provider failure", shadow: true, token: "token", clientErr: errors.New("unavailable"), status: http.StatusOK, source: attest.SourceShadow, refusal: problem.CodeProviderUnavailable},
+		{name: "shadow allowed", shadow: true, token: "token", assessment: validAssessment(0.9), status: http.StatusOK, source: attest.SourceVerification},
+		{name: "fail-open provider failure", failOpen: true, token: "token", clientErr: errors.New("unavailable"), status: http.StatusOK, source: attest.SourceFailOpen, refusal: problem.CodeProviderUnavailable},
+		{name: "fail-open refusal", failOpen: true, token: "token", assessment: validAssessment(0.1), status: http.StatusUnauthorized, code: problem.CodeScoreTooLow},
+		{name: "fail-open missing token", failOpen: true, status: http.StatusUnauthorized, code: problem.CodeTokenMissing},
+	}
+	attester, verifier := newAttester(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options := newCaptchaOptions(t, &fakeAssessmentClient{assessment: tt.assessment, err: tt.clientErr}, nil)
+			options.Attester = attester
+			options.Modes = &Modes{}
+			options.Modes.SetShadow(tt.shadow)
+			options.Modes.SetFailOpen(tt.failOpen)
+			mux := chi.NewMux()
+			HandleCaptcha(mux, options, zap.NewNop())
+
+			req := httptest.NewRequest(http.MethodPost, "/captcha-verify", strings.NewReader(`{"state":{"x-site-key":"site-key"}}`))
+			if tt.token != "" {
+				req.Header.Set(captchaTokenHeader, tt.token)
+			}
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+
+			if tt.code != "" {
+				assertProblem(t, rec.Result(), rec.Body.Bytes(), tt.status, tt.code)
+				return
+			}
+			if rec.Code != tt.status {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+			}
+			if got := rec.Header().Get(outcomeHeader); got != "allow" {
+				t.Errorf("got outcome %q, want allow", got)
+			}
+			claims, err := verifier.Verify(context.Background(), rec.Header().Get(verdictHeader), time.Now())
+			if err != nil {
+				t.Fatalf("got no valid attestation: %v", err)
+			}
+			if claims.Source != tt.source || claims.Refusal != string(tt.refusal) || claims.SiteKey != "site-key" {
+				t.Errorf("got source %q, refusal %q and site key %q, want %q, %q and site-key", claims.Source, claims.Refusal, claims.SiteKey, tt.source, tt.refusal)
+			}
+		})
+	}
+}
+
+func newAttester(t *testing.T) (*attest.Signer, *attest.Verifier) {
+	t.Helper()
+	key, err := attest.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := attest.NewSigner(key, "", "test", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks, err := signer.JWKS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer, attest.NewVerifier(jwks, "test")
+}
+
+// blockingAssessmentClient answers once the call is cancelled, as reCAPTCHA answering too late
+type blockingAssessmentClient struct{}
+
+func (blockingAssessmentClient) CreateAssessment(ctx context.Context, req *recaptchaenterprisepb.CreateAssessmentRequest, opts ...gax.CallOption) (*recaptchaenterprisepb.Assessment, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestFailOpenTimedOut(t *testing.T) {
+	options := newCaptchaOptions(t, blockingAssessmentClient{}, nil)
+	options.Modes = &Modes{}
+	options.Modes.SetFailOpen(true)
+	mux := chi.NewMux()
+	mux.Use(middleware.Timeout(20 * time.Millisecond))
+	HandleCaptcha(mux, options, zap.NewNop())
+
+	req := httptest.NewRequest(http.MethodPost, "/captcha-verify", strings.NewReader(`{"state":{"x-site-key":"site-key"}}`))
+	req.Header.Set(captchaTokenHeader, "token")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+
+	assertProblem(t, rec.Result(), rec.Body.Bytes(), http.StatusServiceUnavailable, problem.CodeTimeout)
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("got no retry hint")
+	}
+}
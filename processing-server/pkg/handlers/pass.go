@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/pseudonator/recaptcha-processing-server/pkg/middleware"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/pass"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/verify"
+	"go.uber.org/zap"
+)
+
+const (
+	passHeader = "x-recaptcha-pass"
+	passCookie = "recaptcha-pass"
+	// Subject of the passes issued by `/captcha-verify`, bound to the site key
+	verifyPassSubject = "verify"
+)
+
+// Binding the pass to the client, the challenge passes are bound to the reference of the site key
+func passBinding(r *http.Request, siteKey string) pass.Binding {
+	return pass.Binding{
+		SiteKey:   siteKey,
+		ClientIp:  middleware.ClientIp(r),
+		UserAgent: r.Header.Get("user-agent"),
+	}
+}
+
+// Issuing a pass after a successful verification, so that the next requests skip the provider
+func (cw *captchaOptionsWrapper) issuePass(w http.ResponseWriter, r *http.Request, subject string, siteKey string) error {
+	issued, err := cw.captchaOptions.PassSigner.Issue(subject, passBinding(r, siteKey), time.Now())
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     passCookie,
+		Value:    issued,
+		Path:     "/",
+		MaxAge:   int(cw.captchaOptions.PassSigner.TTL().Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	w.Header().Set(passHeader, issued)
+	return nil
+}
+
+// A pass skips the provider, so it is not accepted for the requests assessed for their transaction by Fraud Prevention
+// or for their account by Account Defender, unless the site policy opts in
+func (cw *captchaOptionsWrapper) acceptsPass(req verify.Request) bool {
+	verifier := cw.captchaOptions.Verifier
+	if verifier.SitePolicy(req.SiteKey).PassSkipsRiskAssessment {
+		return true
+	}
+	if req.Transaction != nil && verifier.Enterprise() {
+		return false
+	}
+	return req.AccountId == "" || !verifier.AccountDefender()
+}
+
+// Accepting a pass from the header or the cookie, instead of verifying a token.
+// The pass must be issued for the site key by `/captcha-verify`, or by the challenge.
+func (cw *captchaOptionsWrapper) hasValidPass(r *http.Request, siteKey string) bool {
+	if cw.captchaOptions.PassSigner == nil || siteKey == "" {
+		return false
+	}
+	issued := r.Header.Get(passHeader)
+	if issued == "" {
+		issued = readCookie(r, passCookie)
+	}
+	if issued == "" {
+		return false
+	}
+	now := time.Now()
+	_, err := cw.captchaOptions.PassSigner.Verify(issued, verifyPassSubject, passBinding(r, siteKey), now)
+	if errors.Is(err, pass.ErrSubject) {
+		_, err = cw.captchaOptions.PassSigner.Verify(issued, challengePassSubject, passBinding(r, challengeSite(siteKey)), now)
+	}
+	if err != nil {
+		cw.logger(r).Debug("ignoring captcha pass", zap.Error(err))
+		return false
+	}
+	return true
+}
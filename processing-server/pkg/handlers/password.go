@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	recaptchaenterprisepb "cloud.google.com/go/recaptchaenterprise/v2/apiv1/recaptchaenterprisepb"
+	chi "github.com/go-chi/chi/v5"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/passwordcheck"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/problem"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/verify"
+	"go.uber.org/zap"
+)
+
+type passwordLeakReq struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type passwordLeakResp struct {
+	Leaked bool `json:"leaked"`
+}
+
+// HandlePasswordLeak exposes the reCAPTCHA Enterprise private password leak verification on the admin listener,
+// as every call is billed. It is meant to be called directly by the login service, not routed through the gateway.
+func HandlePasswordLeak(mux chi.Router, captchaOptions *CaptchaVerifyOptions, log *zap.Logger) {
+	if !captchaOptions.Verifier.Enterprise() {
+		return
+	}
+	cw := &captchaOptionsWrapper{
+		captchaOptions: captchaOptions,
+		log:            log,
+	}
+	mux.Post("/password-leak-verify", func(w http.ResponseWriter, r *http.Request) {
+		var leakReq passwordLeakReq
+		decoder := json.NewDecoder(r.Body)
+		decoderErr := decoder.Decode(&leakReq)
+		defer r.Body.Close()
+		// Never log the decoder error or the request, they may contain the credentials
+		if decoderErr != nil || leakReq.Username == "" || leakReq.Password == "" {
+			problem.Write(w, r, problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "username and password are required"))
+			return
+		}
+
+		verification, err := passwordcheck.New(leakReq.Username, leakReq.Password)
+		if err != nil {
+			cw.logger(r).Error("unable to prepare password leak verification", zap.Error(err))
+			problem.Write(w, r, problem.New(http.StatusInternalServerError, problem.CodeInternal, "password leak verification failure"))
+			return
+		}
+
+		resp, err := captchaOptions.Verifier.Assess(r.Context(), &recaptchaenterprisepb.Assessment{
+			PrivatePasswordLeakVerification: &recaptchaenterprisepb.PrivatePasswordLeakVerification{
+				LookupHashPrefix:             verification.LookupHashPrefix,
+				EncryptedUserCredentialsHash: verification.EncryptedUserCredentialsHash,
+			},
+		})
+		var providerErr *verify.ProviderError
+		if errors.As(err, &providerErr) {
+			cw.logger(r).Error("unable to create password leak assessment", zap.Error(err))
+			problem.Write(w, r, problem.New(providerErr.StatusCode, problem.CodeProviderUnavailable, providerErr.Message).WithRetryAfter(providerRetry(providerErr)))
+			return
+		}
+		if err != nil {
+			cw.logger(r).Error("unable to create password leak assessment", zap.Error(err))
+			problem.Write(w, r, problem.New(http.StatusBadGateway, problem.CodeProviderUnavailable, "password leak verification failure").WithRetryAfter(providerRetryAfter))
+			return
+		}
+
+		leakVerification := resp.GetPrivatePasswordLeakVerification()
+		leaked, err := verification.IsLeaked(
+			leakVerification.GetReencryptedUserCredentialsHash(),
+			leakVerification.GetEncryptedLeakMatchPrefixes())
+		if err != nil {
+			cw.logger(r).Error("unable to complete password leak verification", zap.Error(err))
+			problem.Write(w, r, problem.New(http.StatusBadGateway, problem.CodeProviderUnavailable, "password leak verification failure"))
+			return
+		}
+
+		cw.logger(r).Info("password leak verification completed", zap.String("assessment", resp.GetName()), zap.Bool("leaked", leaked))
+		w.Header().Set("Content-Type", "application/json")
+		writeJSON(w, passwordLeakResp{Leaked: leaked})
+	})
+}
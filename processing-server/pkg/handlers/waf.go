@@ -0,0 +1,39 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/pseudonator/recaptcha-processing-server/pkg/verify"
+)
+
+// Looking up reCAPTCHA WAF tokens in the cookies when the site policy has WAF keys,
+// action tokens are preferred over session tokens as they are bound to a single action
+func (cw *captchaOptionsWrapper) resolveWafToken(r *http.Request, policy verify.SitePolicy, verifyReq *verify.Request) {
+	if !cw.captchaOptions.EnterpriseEnabled {
+		return
+	}
+	if policy.WafActionSiteKey != "" {
+		if token := readCookie(r, cw.captchaOptions.WafActionTokenCookie); token != "" {
+			verifyReq.Token = token
+			verifyReq.TokenType = verify.TokenWafAction
+			return
+		}
+	}
+	if policy.WafSessionSiteKey != "" {
+		if token := readCookie(r, cw.captchaOptions.WafSessionTokenCookie); token != "" {
+			verifyReq.Token = token
+			verifyReq.TokenType = verify.TokenWafSession
+		}
+	}
+}
+
+func readCookie(r *http.Request, name string) string {
+	if name == "" {
+		return ""
+	}
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
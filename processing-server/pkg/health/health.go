@@ -0,0 +1,113 @@
+// Package health runs the dependency checks of the readiness and startup probes. The results are cached,
+// so that frequent probes neither hammer nor bill the providers.
+//
+//	checker := health.NewChecker(2*time.Second,
+//		health.Check{Name: "provider", Ttl: 30 * time.Second, Run: dialProvider})
+//	report := checker.Ready(ctx)
+package health
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Status string
+
+const (
+	StatusOk   Status = "ok"
+	StatusFail Status = "fail"
+)
+
+// Check of a dependency.
+type Check struct {
+	Name string
+	// Lifetime of the result, failures included, the check is run on every probe when zero
+	Ttl time.Duration
+	Run func(ctx context.Context) error
+}
+
+// Result of a check.
+type Result struct {
+	Status    Status    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checkedAt"`
+}
+
+// Report of the probes, failed when any check failed.
+type Report struct {
+	Status Status            `json:"status"`
+	Checks map[string]Result `json:"checks,omitempty"`
+}
+
+// Checker runs the checks concurrently, within the timeout.
+type Checker struct {
+	checks  []*cachedCheck
+	timeout time.Duration
+	// Latched once ready, the startup probe is not checked again afterwards
+	started atomic.Bool
+}
+
+// The lock is held while running, so that the concurrent probes share a single run
+type cachedCheck struct {
+	Check
+	mu     sync.Mutex
+	result Result
+}
+
+func NewChecker(timeout time.Duration, checks ...Check) *Checker {
+	c := &Checker{timeout: timeout}
+	for _, check := range checks {
+		c.checks = append(c.checks, &cachedCheck{Check: check})
+	}
+	return c
+}
+
+// Ready runs the checks whose result is stale, and reports them all.
+func (c *Checker) Ready(ctx context.Context) Report {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	results := make([]Result, len(c.checks))
+	var wg sync.WaitGroup
+	for i, check := range c.checks {
+		wg.Add(1)
+		go func(i int, check *cachedCheck) {
+			defer wg.Done()
+			results[i] = check.run(ctx)
+		}(i, check)
+	}
+	wg.Wait()
+
+	report := Report{Status: StatusOk, Checks: make(map[string]Result, len(c.checks))}
+	for i, check := range c.checks {
+		report.Checks[check.Name] = results[i]
+		if results[i].Status != StatusOk {
+			report.Status = StatusFail
+		}
+	}
+	if report.Status == StatusOk {
+		c.started.Store(true)
+	}
+	return report
+}
+
+// Started tells whether the checks passed at least once.
+func (c *Checker) Started() bool {
+	return c.started.Load()
+}
+
+func (c *cachedCheck) run(ctx context.Context) Result {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if !c.result.CheckedAt.IsZero() && now.Sub(c.result.CheckedAt) < c.Ttl {
+		return c.result
+	}
+	c.result = Result{Status: StatusOk, CheckedAt: now}
+	if err := c.Run(ctx); err != nil {
+		c.result.Status, c.result.Error = StatusFail, err.Error()
+	}
+	return c.result
+}
@@ -0,0 +1,80 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestChecker(t *testing.T) {
+	var providerRuns atomic.Int32
+	providerErr := errors.New("unreachable")
+	var failing atomic.Bool
+	failing.Store(true)
+
+	checker := NewChecker(time.Second,
+		Check{Name: "config", Run: func(ctx context.Context) error { return nil }},
+		Check{Name: "provider", Ttl: time.Hour, Run: func(ctx context.Context) error {
+			providerRuns.Add(1)
+			if failing.Load() {
+				return providerErr
+			}
+			return nil
+		}},
+	)
+
+	report := checker.Ready(context.Background())
+	if report.Status != StatusFail || report.Checks["provider"].Error != providerErr.Error() || report.Checks["config"].Status != StatusOk {
+		t.Fatalf("got %+v, want the provider failure", report)
+	}
+	if checker.Started() {
+		t.Error("got started before the checks passed")
+	}
+
+	// The failure is cached as well
+	failing.Store(false)
+	for i := 0; i < 3; i++ {
+		if report := checker.Ready(context.Background()); report.Status != StatusFail {
+			t.Fatalf("got %+v, want the cached failure", report)
+		}
+	}
+	if runs := providerRuns.Load(); runs != 1 {
+		t.Errorf("got %d runs of the provider check, want 1", runs)
+	}
+}
+
+func TestCheckerExpiry(t *testing.T) {
+	var runs atomic.Int32
+	checker := NewChecker(time.Second, Check{Name: "provider", Ttl: time.Millisecond, Run: func(ctx context.Context) error {
+		runs.Add(1)
+		return nil
+	}})
+
+	checker.Ready(context.Background())
+	time.Sleep(5 * time.Millisecond)
+	if report := checker.Ready(context.Background()); report.Status != StatusOk {
+		t.Fatalf("got %+v", report)
+	}
+	if runs.Load() != 2 {
+		t.Errorf("got %d runs, want the stale result checked again", runs.Load())
+	}
+	if !checker.Started() {
+		t.Error("got not started once ready")
+	}
+}
+
+func TestCheckerTimeout(t *testing.T) {
+	checker := NewChecker(10*time.Millisecond, Check{Name: "provider", Run: func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}})
+	start := time.Now()
+	if report := checker.Ready(context.Background()); report.Status != StatusFail {
+		t.Fatalf("got %+v, want the timeout", report)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("got the report after %s", elapsed)
+	}
+}
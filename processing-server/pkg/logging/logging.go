@@ -0,0 +1,90 @@
+// Package logging builds the logger of the service from its options, and masks the tokens, secrets and
+// account IDs in every log entry.
+//
+//	opts, err := logging.ParseOptions("info", "json", true, false)
+//	log, level, err := logging.New(opts)
+//
+// The level can be changed at runtime through the returned zap.AtomicLevel.
+package logging
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+type Encoding string
+
+const (
+	EncodingJSON    Encoding = "json"
+	EncodingConsole Encoding = "console"
+)
+
+// Options of the logger.
+type Options struct {
+	Level    zapcore.Level
+	Encoding Encoding
+	// Samples the repeated entries, as zap.NewProduction does
+	Sampling bool
+	// Development mode: stack traces from the warnings on, and panics on the DPanic entries
+	Development bool
+	// Leaves the entries untouched, only meant for local runs
+	DisableRedaction bool
+}
+
+// ParseOptions reads the level and the encoding of the logger, an empty value keeps the default:
+// info and JSON, or debug and console in development mode.
+func ParseOptions(level, encoding string, sampling, development bool) (Options, error) {
+	opts := Options{Level: zapcore.InfoLevel, Encoding: EncodingJSON, Sampling: sampling, Development: development}
+	if development {
+		opts.Level, opts.Encoding = zapcore.DebugLevel, EncodingConsole
+	}
+	if level != "" {
+		if err := opts.Level.UnmarshalText([]byte(strings.ToLower(level))); err != nil {
+			return Options{}, fmt.Errorf("invalid log level '%s'", level)
+		}
+	}
+	switch Encoding(strings.ToLower(encoding)) {
+	case "":
+	case EncodingJSON:
+		opts.Encoding = EncodingJSON
+	case EncodingConsole:
+		opts.Encoding = EncodingConsole
+	default:
+		return Options{}, fmt.Errorf("invalid log encoding '%s', expecting json or console", encoding)
+	}
+	return opts, nil
+}
+
+// New builds the logger, writing to stderr. The returned level changes the level of the logger at runtime.
+func New(opts Options) (*zap.Logger, zap.AtomicLevel, error) {
+	config := zap.NewProductionConfig()
+	if opts.Development {
+		config = zap.NewDevelopmentConfig()
+	}
+	config.Level = zap.NewAtomicLevelAt(opts.Level)
+	config.Encoding = string(opts.Encoding)
+	if opts.Encoding == EncodingConsole {
+		config.EncoderConfig = zap.NewDevelopmentEncoderConfig()
+	}
+	// Sampling after the redaction, so that the redacting core does not bypass the sampler
+	config.Sampling = nil
+
+	var buildOpts []zap.Option
+	if !opts.DisableRedaction {
+		buildOpts = append(buildOpts, zap.WrapCore(Redact))
+	}
+	if opts.Sampling {
+		buildOpts = append(buildOpts, zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+			return zapcore.NewSamplerWithOptions(core, time.Second, 100, 100)
+		}))
+	}
+	log, err := config.Build(buildOpts...)
+	if err != nil {
+		return nil, zap.AtomicLevel{}, err
+	}
+	return log, config.Level, nil
+}
@@ -0,0 +1,139 @@
+package logging
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Redacted replaces the masked values.
+const Redacted = "[REDACTED]"
+
+// Fields masked whatever their value, matched on the end of the key regardless of the case and the separators,
+// e.g. `token`, `hashedAccountId` or `x-api-key`
+var redactedKeySuffixes = []string{
+	"token",
+	"secret",
+	"secretkey",
+	"password",
+	"apikey",
+	"authorization",
+	"cookie",
+	"accountid",
+	"credentials",
+	"privatekey",
+	"signingkey",
+	"signingkeys",
+}
+
+// Values masked in the messages and in the strings and errors of any field
+var redactedValues = regexp.MustCompile(strings.Join([]string{
+	// Verdict attestations and captcha passes
+	`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+(\.[A-Za-z0-9_-]*)?`,
+	// Google API keys
+	`AIza[0-9A-Za-z_-]{35}`,
+	// Bearer credentials
+	`(?i)bearer\s+[^\s,;]+`,
+	// Hashed account IDs, HMAC-SHA256 in hex
+	`\b[0-9a-fA-F]{64}\b`,
+	// reCAPTCHA tokens, long base64url strings
+	`[A-Za-z0-9_-]{100,}`,
+}, "|"))
+
+// Redact wraps a core to mask the tokens, secrets, API keys and hashed account IDs of every entry.
+func Redact(core zapcore.Core) zapcore.Core {
+	return &redactingCore{Core: core}
+}
+
+type redactingCore struct {
+	zapcore.Core
+}
+
+func (c *redactingCore) With(fields []zapcore.Field) zapcore.Core {
+	return &redactingCore{Core: c.Core.With(redactFields(fields))}
+}
+
+func (c *redactingCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(entry.Level) {
+		return checked.AddCore(entry, c)
+	}
+	return checked
+}
+
+func (c *redactingCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	entry.Message = RedactString(entry.Message)
+	return c.Core.Write(entry, redactFields(fields))
+}
+
+// RedactString masks the tokens, API keys and hashed account IDs found in the value.
+func RedactString(value string) string {
+	return redactedValues.ReplaceAllString(value, Redacted)
+}
+
+// RedactValue masks the value of a sensitive key, or the sensitive values found in the value otherwise.
+func RedactValue(key, value string) string {
+	if redactedKey(key) {
+		return Redacted
+	}
+	return RedactString(value)
+}
+
+func redactFields(fields []zapcore.Field) []zapcore.Field {
+	redacted := make([]zapcore.Field, len(fields))
+	for i, field := range fields {
+		redacted[i] = redactField(field)
+	}
+	return redacted
+}
+
+func redactField(field zapcore.Field) zapcore.Field {
+	if redactedKey(field.Key) {
+		switch field.Type {
+		case zapcore.SkipType, zapcore.NamespaceType:
+			return field
+		}
+		return zap.String(field.Key, Redacted)
+	}
+	switch field.Type {
+	case zapcore.StringType:
+		field.String = RedactString(field.String)
+	case zapcore.ByteStringType:
+		field = zap.String(field.Key, RedactString(string(field.Interface.([]byte))))
+	case zapcore.ErrorType:
+		if err, ok := field.Interface.(error); ok && err != nil {
+			field = zap.String(field.Key, RedactString(err.Error()))
+		}
+	case zapcore.StringerType:
+		if value, ok := stringerValue(field.Interface); ok {
+			field = zap.String(field.Key, RedactString(value))
+		}
+	}
+	return field
+}
+
+// A nil pointer may panic in String, the field is then left to zap which reports it
+func stringerValue(value interface{}) (s string, ok bool) {
+	defer func() {
+		if recover() != nil {
+			s, ok = "", false
+		}
+	}()
+	stringer, ok := value.(fmt.Stringer)
+	if !ok {
+		return "", false
+	}
+	return stringer.String(), true
+}
+
+func redactedKey(key string) bool {
+	normalized := strings.NewReplacer("-", "", "_", "", ".", "").Replace(strings.ToLower(key))
+	for _, suffix := range redactedKeySuffixes {
+		if strings.HasSuffix(normalized, suffix) {
+			return true
+		}
+	}
+	return false
+}
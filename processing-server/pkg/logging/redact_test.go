@@ -0,0 +1,77 @@
+package logging
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestRedact(t *testing.T) {
+	token := "03AFcWeA" + strings.Repeat("x1_Y-", 40)
+	hashedAccountId := strings.Repeat("ab12", 16)
+	apiKey := "AIza" + strings.Repeat("k", 35)
+	pass := "eyJzdWIiOiJzaXRlIn0.c2lnbmF0dXJl"
+
+	tests := []struct {
+		name  string
+		field zap.Field
+		want  string
+	}{
+		{name: "sensitive key", field: zap.String("x-recaptcha-token", "short"), want: Redacted},
+		{name: "hashed account ID key", field: zap.String("hashedAccountId", "anything"), want: Redacted},
+		{name: "secret key", field: zap.Int("ACCOUNT_ID_HMAC_SECRET", 42), want: Redacted},
+		{name: "token type kept", field: zap.String("tokenType", "waf-action"), want: "waf-action"},
+		{name: "token in a value", field: zap.String("detail", "invalid token "+token), want: "invalid token " + Redacted},
+		{name: "token in an error", field: zap.Error(errors.New("unable to verify " + token + ": denied")), want: "unable to verify " + Redacted + ": denied"},
+		{name: "hashed account ID in a value", field: zap.String("name", "accounts/"+hashedAccountId), want: "accounts/" + Redacted},
+		{name: "API key", field: zap.String("url", "https://example.com/v1?key="+apiKey), want: "https://example.com/v1?key=" + Redacted},
+		{name: "bearer", field: zap.ByteString("header", []byte("Bearer s3cr3t")), want: Redacted},
+		{name: "pass", field: zap.String("cookie-value", pass+" kept"), want: Redacted + " kept"},
+		{name: "site key kept", field: zap.String("siteKey", "6LcPublicSiteKey"), want: "6LcPublicSiteKey"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			core, logs := observer.New(zapcore.DebugLevel)
+			zap.New(Redact(core)).Info("entry", tt.field)
+
+			fields := logs.All()[0].ContextMap()
+			if got := fields[tt.field.Key]; got != tt.want {
+				t.Errorf("got %v, want %q", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("message and logger fields", func(t *testing.T) {
+		core, logs := observer.New(zapcore.DebugLevel)
+		zap.New(Redact(core)).With(zap.String("token", token)).Info("verifying " + token)
+
+		entry := logs.All()[0]
+		if entry.Message != "verifying "+Redacted {
+			t.Errorf("got message %q", entry.Message)
+		}
+		if got := entry.ContextMap()["token"]; got != Redacted {
+			t.Errorf("got field %v", got)
+		}
+	})
+}
+
+func TestParseOptions(t *testing.T) {
+	opts, err := ParseOptions("", "", true, true)
+	if err != nil || opts.Level != zapcore.DebugLevel || opts.Encoding != EncodingConsole {
+		t.Errorf("got %+v, %v, want the development defaults", opts, err)
+	}
+	opts, err = ParseOptions("WARN", "json", false, true)
+	if err != nil || opts.Level != zapcore.WarnLevel || opts.Encoding != EncodingJSON {
+		t.Errorf("got %+v, %v, want warn and json", opts, err)
+	}
+	if _, err := ParseOptions("verbose", "", false, false); err == nil {
+		t.Error("got no error for an invalid level")
+	}
+	if _, err := ParseOptions("", "logfmt", false, false); err == nil {
+		t.Error("got no error for an invalid encoding")
+	}
+}
@@ -0,0 +1,222 @@
+// Package middleware holds the middleware stack of the HTTP servers: request ID, client IP resolution,
+// request logging, panic recovery, body size limit and per-request timeout.
+//
+//	mux := chi.NewMux()
+//	mux.Use(middleware.RequestId, middleware.Logging(log), middleware.Recoverer(log), middleware.BodyLimit(1<<20))
+//
+// The handlers log with Logger, which carries the request ID of the request.
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/pseudonator/recaptcha-processing-server/pkg/problem"
+	"go.uber.org/zap"
+)
+
+// Longest request ID accepted from the proxy, a longer one is replaced
+const maxRequestIdLength = 128
+
+type (
+	requestIdKey struct{}
+	loggerKey    struct{}
+	clientIpKey  struct{}
+)
+
+// RequestId reads the request ID set by Envoy, or generates one when missing or invalid. The ID is set back
+// on the request header, for the handlers and the problem details, and on the response.
+func RequestId(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(problem.RequestIdHeader)
+		if !validRequestId(id) {
+			r.Header.Del(problem.RequestIdHeader)
+			id = problem.RequestId(r)
+			r.Header.Set(problem.RequestIdHeader, id)
+		}
+		w.Header().Set(problem.RequestIdHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIdKey{}, id)))
+	})
+}
+
+// Printable ASCII only, so that the ID can't forge log lines nor headers
+func validRequestId(id string) bool {
+	if id == "" || len(id) > maxRequestIdLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// RequestIdFrom returns the request ID set by the RequestId middleware, empty without it.
+func RequestIdFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIdKey{}).(string)
+	return id
+}
+
+// Logger returns the logger of the request, which carries its request ID, or the fallback outside of the
+// Logging middleware.
+func Logger(ctx context.Context, fallback *zap.Logger) *zap.Logger {
+	if log, ok := ctx.Value(loggerKey{}).(*zap.Logger); ok {
+		return log
+	}
+	return fallback
+}
+
+// Logging sets the logger of the request and logs every request once answered. The requests to the quiet
+// paths, such as the probes, are logged at the debug level.
+func Logging(log *zap.Logger, quietPaths ...string) func(http.Handler) http.Handler {
+	quiet := map[string]bool{}
+	for _, path := range quietPaths {
+		quiet[path] = true
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			requestLog := log
+			if id := RequestIdFrom(r.Context()); id != "" {
+				requestLog = log.With(zap.String("requestId", id))
+			}
+			sw := &statusWriter{ResponseWriter: w}
+			next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), loggerKey{}, requestLog)))
+
+			level := zap.InfoLevel
+			if quiet[r.URL.Path] {
+				level = zap.DebugLevel
+			}
+			if ce := requestLog.Check(level, "request"); ce != nil {
+				ce.Write(
+					zap.String("method", r.Method),
+					zap.String("path", r.URL.Path),
+					zap.Int("status", sw.Status()),
+					zap.Int64("bytes", sw.bytes),
+					zap.Duration("duration", time.Since(start)),
+					zap.String("clientIp", ClientIp(r)))
+			}
+		})
+	}
+}
+
+// Recoverer answers the panics of the handlers with a 500 problem, rather than dropping the connection.
+// The aborted handlers keep aborting the response.
+func Recoverer(log *zap.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer func() {
+				rec := recover()
+				if rec == nil {
+					return
+				}
+				if rec == http.ErrAbortHandler {
+					panic(rec)
+				}
+				Logger(r.Context(), log).Error("recovered from a panic",
+					zap.Any("panic", rec),
+					zap.ByteString("stack", debug.Stack()))
+				if sw, ok := w.(*statusWriter); ok && sw.status != 0 {
+					// Too late for a problem, the status is already sent
+					return
+				}
+				problem.Write(w, r, problem.New(http.StatusInternalServerError, problem.CodeInternal, "internal error"))
+			}()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// BodyLimit refuses to read more than limit bytes of the request bodies, the reads fail with
+// a *http.MaxBytesError beyond it.
+func BodyLimit(limit int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > limit {
+				problem.Write(w, r, problem.New(http.StatusRequestEntityTooLarge, problem.CodeRequestTooLarge, "request body too large"))
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Timeout cancels the context of the requests after the timeout, aborting the calls to reCAPTCHA and
+// to the upstreams. The handlers answer the cancellation themselves.
+func Timeout(timeout time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// ConnDeadline extends the read and write deadlines of the connection for the request beyond the timeouts of the
+// server, e.g. for the uploads and the downloads of the gateway. The response can still be written a second after
+// the timeout.
+func ConnDeadline(timeout time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rc := http.NewResponseController(w)
+			// The server timeouts apply when the writer doesn't support the deadlines
+			_ = rc.SetReadDeadline(time.Now().Add(timeout))
+			_ = rc.SetWriteDeadline(time.Now().Add(timeout + time.Second))
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// TimedOut tells whether the request context ended because of the Timeout middleware, rather than the
+// client going away.
+func TimedOut(ctx context.Context) bool {
+	return errors.Is(ctx.Err(), context.DeadlineExceeded)
+}
+
+// statusWriter records the status and the size of the response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush keeps the streaming of the reverse proxy working
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Status of the response, 200 when nothing was written
+func (w *statusWriter) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
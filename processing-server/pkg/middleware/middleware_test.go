@@ -0,0 +1,162 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pseudonator/recaptcha-processing-server/pkg/problem"
+	"go.uber.org/zap"
+)
+
+func TestRealIp(t *testing.T) {
+	trusted, err := ParseTrustedProxies([]string{"10.0.0.0/8", "192.0.2.10"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		remote    string
+		forwarded []string
+		want      string
+	}{
+		{name: "untrusted remote", remote: "203.0.113.5:1234", forwarded: []string{"198.51.100.1"}, want: "203.0.113.5"},
+		{name: "trusted remote", remote: "10.1.2.3:1234", forwarded: []string{"198.51.100.1"}, want: "198.51.100.1"},
+		{name: "forged left-most address", remote: "10.1.2.3:1234", forwarded: []string{"1.1.1.1, 198.51.100.1, 192.0.2.10"}, want: "198.51.100.1"},
+		{name: "several headers", remote: "10.1.2.3:1234", forwarded: []string{"198.51.100.1", "10.0.0.1"}, want: "198.51.100.1"},
+		{name: "only trusted proxies", remote: "10.1.2.3:1234", forwarded: []string{"10.0.0.2, 10.0.0.1"}, want: "10.0.0.2"},
+		{name: "invalid addresses", remote: "10.1.2.3:1234", forwarded: []string{"unknown, 198.51.100.1"}, want: "198.51.100.1"},
+		{name: "no header", remote: "10.1.2.3:1234", want: "10.1.2.3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			handler := RealIp(trusted)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = ClientIp(r)
+			}))
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remote
+			for _, value := range tt.forwarded {
+				req.Header.Add("x-forwarded-for", value)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := ParseTrustedProxies([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("got no error for an invalid range")
+	}
+}
+
+func TestRequestId(t *testing.T) {
+	tests := []struct {
+		name  string
+		id    string
+		valid bool
+	}{
+		{name: "envoy id", id: "6b1f5f8e-9d5c-4c1a-8b8e-3f1c2d4e5f60", valid: true},
+		{name: "missing"},
+		{name: "control characters", id: "id\nforged"},
+		{name: "too long", id: strings.Repeat("a", maxRequestIdLength+1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fromContext, fromHeader string
+			handler := RequestId(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fromContext = RequestIdFrom(r.Context())
+				fromHeader = r.Header.Get(problem.RequestIdHeader)
+			}))
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set(problem.RequestIdHeader, tt.id)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if tt.valid && fromContext != tt.id {
+				t.Errorf("got %q, want the id of the request", fromContext)
+			}
+			if !tt.valid && (fromContext == tt.id || !validRequestId(fromContext)) {
+				t.Errorf("got %q, want a generated id", fromContext)
+			}
+			if fromHeader != fromContext || rec.Header().Get(problem.RequestIdHeader) != fromContext {
+				t.Errorf("got %q on the request and %q on the response, want %q", fromHeader, rec.Header().Get(problem.RequestIdHeader), fromContext)
+			}
+		})
+	}
+}
+
+func TestRecoverer(t *testing.T) {
+	handler := RequestId(Logging(zap.NewNop())(Recoverer(zap.NewNop())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	p, ok := problem.Read(rec.Result(), rec.Body.Bytes())
+	if !ok || p.Status != http.StatusInternalServerError || p.Code != problem.CodeInternal {
+		t.Fatalf("got %d %q, want an internal error problem", rec.Code, rec.Body.String())
+	}
+	if p.RequestId == "" || p.RequestId != rec.Header().Get(problem.RequestIdHeader) {
+		t.Errorf("got request ID %q, want the one of the response", p.RequestId)
+	}
+}
+
+func TestBodyLimit(t *testing.T) {
+	var readErr error
+	handler := BodyLimit(4)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, readErr = r.Body.Read(make([]byte, 16))
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("too large")))
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("got status %d with a known length, want %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+
+	// Chunked bodies have no length, the read fails instead
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("too large"))
+	req.ContentLength = -1
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if readErr == nil {
+		t.Error("got no error reading a chunked body above the limit")
+	}
+}
+
+func TestConnDeadline(t *testing.T) {
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		_, _ = w.Write([]byte("done"))
+	})
+	tests := []struct {
+		name    string
+		handler http.Handler
+		ok      bool
+	}{
+		{name: "server write timeout", handler: slow},
+		{name: "extended deadline", handler: ConnDeadline(time.Second)(slow), ok: true},
+		{name: "behind the logging", handler: Logging(zap.NewNop())(ConnDeadline(time.Second)(slow)), ok: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewUnstartedServer(tt.handler)
+			srv.Config.WriteTimeout = 100 * time.Millisecond
+			srv.Start()
+			defer srv.Close()
+
+			resp, err := http.Get(srv.URL)
+			var body []byte
+			if err == nil {
+				body, err = io.ReadAll(resp.Body)
+				resp.Body.Close()
+			}
+			if ok := err == nil && string(body) == "done"; ok != tt.ok {
+				t.Errorf("got body %q (%v), want the response written %t", body, err, tt.ok)
+			}
+		})
+	}
+}
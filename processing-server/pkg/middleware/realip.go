@@ -0,0 +1,94 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ParseTrustedProxies reads the addresses and CIDR ranges of the trusted proxies, a single address
+// is a /32 or a /128 range.
+func ParseTrustedProxies(values []string) ([]*net.IPNet, error) {
+	var proxies []*net.IPNet
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy '%s'", value)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy '%s': %w", value, err)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+// RealIp resolves the IP of the client from the x-forwarded-for header, only when the request comes from
+// a trusted proxy. The addresses are read from right to left, the first one not trusted is the client, as
+// the ones on its left could be forged by the client. The remote address of the request is replaced.
+func RealIp(trusted []*net.IPNet) func(http.Handler) http.Handler {
+	isTrusted := func(ip net.IP) bool {
+		for _, network := range trusted {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip := remoteIp(r)
+			if parsed := net.ParseIP(ip); parsed != nil && isTrusted(parsed) {
+				forwarded := forwardedIps(r)
+				for i := len(forwarded) - 1; i >= 0; i-- {
+					ip = forwarded[i].String()
+					if !isTrusted(forwarded[i]) {
+						break
+					}
+				}
+			}
+			r.RemoteAddr = ip
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientIpKey{}, ip)))
+		})
+	}
+}
+
+// ClientIp returns the IP resolved by RealIp, or the remote address of the request without it.
+func ClientIp(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIpKey{}).(string); ok {
+		return ip
+	}
+	return remoteIp(r)
+}
+
+// The addresses of all the x-forwarded-for headers in order, skipping the invalid ones
+func forwardedIps(r *http.Request) []net.IP {
+	var ips []net.IP
+	for _, header := range r.Header.Values("x-forwarded-for") {
+		for _, value := range strings.Split(header, ",") {
+			if ip := net.ParseIP(strings.TrimSpace(value)); ip != nil {
+				ips = append(ips, ip)
+			}
+		}
+	}
+	return ips
+}
+
+func remoteIp(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,195 @@
+// Package pass issues and verifies short-lived HMAC signed passes, which prove that
+// a client recently solved a captcha without calling the provider again.
+//
+// A pass is bound to the site key, the subnet of the client IP and the user agent,
+// so it can't be replayed from another network or browser. Several signing keys can
+// be configured to rotate them, the first one signs and all of them verify.
+package pass
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// Subnets the client IPs are bound to
+	ipv4PrefixLength = 24
+	ipv6PrefixLength = 64
+)
+
+var (
+	ErrMalformed  = errors.New("malformed pass")
+	ErrUnknownKey = errors.New("pass signed with an unknown key")
+	ErrSignature  = errors.New("invalid pass signature")
+	ErrExpired    = errors.New("pass expired")
+	ErrSubject    = errors.New("pass issued for another subject")
+	ErrBinding    = errors.New("pass issued for another client")
+)
+
+// Claims carried by a pass.
+type Claims struct {
+	KeyId     string `json:"kid"`
+	Subject   string `json:"sub"`
+	Binding   string `json:"bnd"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// Binding ties a pass to the client it was issued to, an empty site key binds to any site key.
+type Binding struct {
+	SiteKey   string
+	ClientIp  string
+	UserAgent string
+}
+
+// Key used to sign the passes, identified by its ID.
+type Key struct {
+	Id     string
+	Secret []byte
+}
+
+// Signer issues and verifies the passes.
+type Signer struct {
+	keys map[string][]byte
+	// ID of the key signing the new passes
+	activeKeyId string
+	ttl         time.Duration
+}
+
+// NewSigner creates a signer with the keys, the first key signs the new passes.
+func NewSigner(keys []Key, ttl time.Duration) (*Signer, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("at least one pass signing key is required")
+	}
+	if ttl <= 0 {
+		return nil, errors.New("pass ttl must be positive")
+	}
+	signer := &Signer{
+		keys:        make(map[string][]byte, len(keys)),
+		activeKeyId: keys[0].Id,
+		ttl:         ttl,
+	}
+	for _, key := range keys {
+		if key.Id == "" {
+			return nil, errors.New("pass signing key ID is required")
+		}
+		if len(key.Secret) < sha256.Size {
+			return nil, fmt.Errorf("pass signing key '%s' must be at least %d bytes", key.Id, sha256.Size)
+		}
+		if _, ok := signer.keys[key.Id]; ok {
+			return nil, fmt.Errorf("duplicate pass signing key '%s'", key.Id)
+		}
+		signer.keys[key.Id] = key.Secret
+	}
+	return signer, nil
+}
+
+// ParseKeys reads keys formatted as `id:secret,id:secret`.
+func ParseKeys(v string) ([]Key, error) {
+	var keys []Key
+	for _, entry := range strings.Split(v, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		id, secret, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("pass signing key must be formatted as id:secret")
+		}
+		keys = append(keys, Key{Id: strings.TrimSpace(id), Secret: []byte(strings.TrimSpace(secret))})
+	}
+	return keys, nil
+}
+
+// TTL is the lifetime of the issued passes.
+func (s *Signer) TTL() time.Duration {
+	return s.ttl
+}
+
+// Issue a pass for the subject and the client, valid from now until the TTL elapses.
+func (s *Signer) Issue(subject string, binding Binding, now time.Time) (string, error) {
+	payload, err := json.Marshal(Claims{
+		KeyId:     s.activeKeyId,
+		Subject:   subject,
+		Binding:   binding.digest(),
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(s.ttl).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(sign(s.keys[s.activeKeyId], encoded)), nil
+}
+
+// Verify the signature and the expiry of the pass, and that it was issued for the subject and the client.
+func (s *Signer) Verify(token string, subject string, binding Binding, now time.Time) (*Claims, error) {
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, ErrMalformed
+	}
+	decodedSignature, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	var claims Claims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, ErrMalformed
+	}
+	// The claims are only trusted once the signature is verified
+	key, ok := s.keys[claims.KeyId]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	if !hmac.Equal(decodedSignature, sign(key, encoded)) {
+		return nil, ErrSignature
+	}
+	if now.Unix() >= claims.ExpiresAt {
+		return nil, ErrExpired
+	}
+	if claims.Subject != subject {
+		return nil, ErrSubject
+	}
+	if !hmac.Equal([]byte(claims.Binding), []byte(binding.digest())) {
+		return nil, ErrBinding
+	}
+	return &claims, nil
+}
+
+func sign(key []byte, encoded string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(encoded))
+	return mac.Sum(nil)
+}
+
+// Hashing the binding, so that the pass doesn't disclose the site key or the client details
+func (b Binding) digest() string {
+	hash := sha256.New()
+	for _, v := range []string{b.SiteKey, subnet(b.ClientIp), b.UserAgent} {
+		hash.Write([]byte(v))
+		hash.Write([]byte{0})
+	}
+	return base64.RawURLEncoding.EncodeToString(hash.Sum(nil))
+}
+
+// Masking the client IP to its subnet, as clients may move between addresses of the same network
+func subnet(clientIp string) string {
+	ip := net.ParseIP(clientIp)
+	if ip == nil {
+		return clientIp
+	}
+	if ipv4 := ip.To4(); ipv4 != nil {
+		return ipv4.Mask(net.CIDRMask(ipv4PrefixLength, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(ipv6PrefixLength, 128)).String()
+}
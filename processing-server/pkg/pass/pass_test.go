@@ -0,0 +1,185 @@
+package pass
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newSigner(t *testing.T, keys ...Key) *Signer {
+	t.Helper()
+	signer, err := NewSigner(keys, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func key(id string) Key {
+	return Key{Id: id, Secret: []byte(strings.Repeat(id, 32))}
+}
+
+func TestVerify(t *testing.T) {
+	now := time.Now()
+	binding := Binding{SiteKey: "site-key", ClientIp: "192.0.2.10", UserAgent: "agent"}
+	signer := newSigner(t, key("a"))
+	token, err := signer.Issue("captcha", binding, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		subject string
+		binding Binding
+		now     time.Time
+		err     error
+	}{
+		{name: "valid", subject: "captcha", binding: binding, now: now},
+		{name: "same subnet", subject: "captcha", binding: Binding{SiteKey: "site-key", ClientIp: "192.0.2.200", UserAgent: "agent"}, now: now},
+		{name: "verifier clock behind", subject: "captcha", binding: binding, now: now.Add(-time.Minute)},
+		{name: "last second", subject: "captcha", binding: binding, now: now.Add(5*time.Minute - time.Second)},
+		{name: "expired", subject: "captcha", binding: binding, now: now.Add(5 * time.Minute), err: ErrExpired},
+		{name: "other subject", subject: "challenge", binding: binding, now: now, err: ErrSubject},
+		{name: "other site key", subject: "captcha", binding: Binding{SiteKey: "other-site-key", ClientIp: "192.0.2.10", UserAgent: "agent"}, now: now, err: ErrBinding},
+		{name: "other subnet", subject: "captcha", binding: Binding{SiteKey: "site-key", ClientIp: "192.0.3.10", UserAgent: "agent"}, now: now, err: ErrBinding},
+		{name: "other user agent", subject: "captcha", binding: Binding{SiteKey: "site-key", ClientIp: "192.0.2.10", UserAgent: "other"}, now: now, err: ErrBinding},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := signer.Verify(token, tt.subject, tt.binding, tt.now)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			if err == nil && (claims.KeyId != "a" || claims.Subject != "captcha") {
+				t.Errorf("got claims %+v", claims)
+			}
+		})
+	}
+}
+
+func TestVerifyIpv6Subnet(t *testing.T) {
+	now := time.Now()
+	signer := newSigner(t, key("a"))
+	token, err := signer.Issue("captcha", Binding{ClientIp: "2001:db8:1:2::10"}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := signer.Verify(token, "captcha", Binding{ClientIp: "2001:db8:1:2:ffff::1"}, now); err != nil {
+		t.Errorf("got error %v within the /64", err)
+	}
+	if _, err := signer.Verify(token, "captcha", Binding{ClientIp: "2001:db8:1:3::10"}, now); !errors.Is(err, ErrBinding) {
+		t.Errorf("got error %v in another /64, want %v", err, ErrBinding)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	now := time.Now()
+	old, err := newSigner(t, key("a")).Issue("captcha", Binding{}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The new key signs, the old one still verifies the passes in flight
+	rotated := newSigner(t, key("b"), key("a"))
+	if _, err := rotated.Verify(old, "captcha", Binding{}, now); err != nil {
+		t.Errorf("got error %v for a pass of the previous key", err)
+	}
+	token, err := rotated.Issue("captcha", Binding{}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims, err := rotated.Verify(token, "captcha", Binding{}, now); err != nil || claims.KeyId != "b" {
+		t.Errorf("got claims %+v (%v), want a pass of the new key", claims, err)
+	}
+
+	// Once the old key is removed
+	if _, err := newSigner(t, key("b")).Verify(old, "captcha", Binding{}, now); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("got error %v for a pass of a removed key, want %v", err, ErrUnknownKey)
+	}
+}
+
+func TestTampered(t *testing.T) {
+	now := time.Now()
+	signer := newSigner(t, key("a"))
+	token, err := signer.Issue("captcha", Binding{}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, signature, _ := strings.Cut(token, ".")
+
+	// Extending the expiry, keeping the signature
+	var claims Claims
+	decoded, _ := base64.RawURLEncoding.DecodeString(payload)
+	if err := json.Unmarshal(decoded, &claims); err != nil {
+		t.Fatal(err)
+	}
+	claims.ExpiresAt += 3600
+	extended, _ := json.Marshal(claims)
+
+	// Signed with another secret under the same key ID
+	forged, err := newSigner(t, Key{Id: "a", Secret: []byte(strings.Repeat("x", 32))}).Issue("captcha", Binding{}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{name: "extended expiry", token: base64.RawURLEncoding.EncodeToString(extended) + "." + signature, err: ErrSignature},
+		{name: "other secret", token: forged, err: ErrSignature},
+		{name: "no signature", token: payload + ".", err: ErrSignature},
+		{name: "no separator", token: payload, err: ErrMalformed},
+		{name: "invalid signature encoding", token: payload + ".!", err: ErrMalformed},
+		{name: "invalid payload", token: "e30!." + signature, err: ErrMalformed},
+		{name: "empty", token: "", err: ErrMalformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := signer.Verify(tt.token, "captcha", Binding{}, now); !errors.Is(err, tt.err) {
+				t.Errorf("got error %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestNewSigner(t *testing.T) {
+	tests := []struct {
+		name string
+		keys []Key
+		ttl  time.Duration
+		err  bool
+	}{
+		{name: "valid", keys: []Key{key("a"), key("b")}, ttl: time.Minute},
+		{name: "no keys", ttl: time.Minute, err: true},
+		{name: "no ttl", keys: []Key{key("a")}, err: true},
+		{name: "short secret", keys: []Key{{Id: "a", Secret: []byte("short")}}, ttl: time.Minute, err: true},
+		{name: "no ID", keys: []Key{{Secret: []byte(strings.Repeat("a", 32))}}, ttl: time.Minute, err: true},
+		{name: "duplicate", keys: []Key{key("a"), key("a")}, ttl: time.Minute, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewSigner(tt.keys, tt.ttl); (err != nil) != tt.err {
+				t.Errorf("got error %v, want an error %t", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	keys, err := ParseKeys(" new:secret-1 , old:secret-2,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0].Id != "new" || string(keys[0].Secret) != "secret-1" || keys[1].Id != "old" {
+		t.Errorf("got keys %+v", keys)
+	}
+	if _, err := ParseKeys("secret"); err == nil {
+		t.Error("got no error without key ID")
+	}
+}
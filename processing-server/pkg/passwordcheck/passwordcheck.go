@@ -0,0 +1,204 @@
+// Package passwordcheck implements the client side of the reCAPTCHA Enterprise
+// private password leak verification handshake.
+//
+// The plaintext credentials never leave this package. Only a 26-bit prefix of the
+// hashed username and an encrypted Scrypt hash of the credentials are sent to
+// reCAPTCHA Enterprise, which re-encrypts the hash with its own key and returns
+// the encrypted prefixes of any matching leaks.
+// See https://cloud.google.com/recaptcha-enterprise/docs/check-passwords
+package passwordcheck
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	lookupHashPrefixBits = 26
+
+	scryptCost        = 1 << 12
+	scryptBlockSize   = 8
+	scryptParallelism = 1
+	scryptKeyLength   = 32
+)
+
+var (
+	// Salts shared with the reCAPTCHA Enterprise password check helpers
+	usernameSalt = []byte{
+		0xC4, 0x94, 0xA3, 0x95, 0xF8, 0xC0, 0xE2, 0x3E, 0xA9, 0x23, 0x04, 0x78, 0x70, 0x2C, 0x72, 0x18,
+		0x56, 0x54, 0x99, 0xB3, 0xE7, 0x21, 0x18, 0x6C, 0x86, 0x1A, 0x6F, 0x2A, 0x2A, 0x2A, 0x2A, 0x2A,
+	}
+	passwordSalt = []byte{
+		0x30, 0x76, 0x2A, 0xD2, 0x3F, 0x7B, 0xA1, 0x9B, 0xF8, 0xE3, 0x42, 0xFC, 0xA1, 0xA7, 0x8D, 0x06,
+		0xE6, 0x6B, 0xE4, 0xDB, 0xB8, 0x4F, 0x81, 0x53, 0xC5, 0x03, 0xC8, 0xDB, 0xBD, 0xDE, 0xA5, 0x20,
+	}
+)
+
+// Verification holds the state of a single leak check. The encryption key is
+// kept in memory only for the lifetime of the handshake.
+type Verification struct {
+	LookupHashPrefix             []byte
+	EncryptedUserCredentialsHash []byte
+
+	cipher *commutativeCipher
+}
+
+// New prepares the parameters for the `PrivatePasswordLeakVerification` sent to reCAPTCHA Enterprise.
+func New(username string, password string) (*Verification, error) {
+	if username == "" || password == "" {
+		return nil, errors.New("username and password are required")
+	}
+	canonicalizedUsername := canonicalizeUsername(username)
+
+	credentialsHash, err := hashCredentials(canonicalizedUsername, password)
+	if err != nil {
+		return nil, err
+	}
+
+	cipher, err := newCommutativeCipher()
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := cipher.encrypt(credentialsHash)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Verification{
+		LookupHashPrefix:             lookupHashPrefix(canonicalizedUsername),
+		EncryptedUserCredentialsHash: encrypted,
+		cipher:                       cipher,
+	}, nil
+}
+
+// IsLeaked completes the handshake with the values returned in the assessment.
+func (v *Verification) IsLeaked(reencryptedUserCredentialsHash []byte, encryptedLeakMatchPrefixes [][]byte) (bool, error) {
+	if len(reencryptedUserCredentialsHash) == 0 {
+		return false, errors.New("re-encrypted credentials hash is missing from the assessment")
+	}
+	serverEncrypted, err := v.cipher.decrypt(reencryptedUserCredentialsHash)
+	if err != nil {
+		return false, err
+	}
+	hashed := sha256.Sum256(serverEncrypted)
+	for _, prefix := range encryptedLeakMatchPrefixes {
+		if len(prefix) > 0 && bytes.HasPrefix(hashed[:], prefix) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func canonicalizeUsername(username string) string {
+	canonicalized := strings.ToLower(strings.TrimSpace(username))
+	if i := strings.LastIndex(canonicalized, "@"); i >= 0 {
+		canonicalized = canonicalized[:i]
+	}
+	return strings.ReplaceAll(canonicalized, ".", "")
+}
+
+func hashCredentials(canonicalizedUsername string, password string) ([]byte, error) {
+	hash, err := scrypt.Key(
+		[]byte(canonicalizedUsername+password),
+		append([]byte(canonicalizedUsername), passwordSalt...),
+		scryptCost, scryptBlockSize, scryptParallelism, scryptKeyLength)
+	if err != nil {
+		return nil, fmt.Errorf("unable to hash the credentials: %w", err)
+	}
+	return hash, nil
+}
+
+func lookupHashPrefix(canonicalizedUsername string) []byte {
+	hash := sha256.Sum256(append([]byte(canonicalizedUsername), usernameSalt...))
+	prefix := make([]byte, (lookupHashPrefixBits+7)/8)
+	copy(prefix, hash[:])
+	prefix[len(prefix)-1] &= byte(0xFF << (len(prefix)*8 - lookupHashPrefixBits))
+	return prefix
+}
+
+// commutativeCipher is an EC commutative cipher over P-256, so that
+// decrypt(reencrypt(encrypt(m))) equals the server side encryption of m.
+// It multiplies arbitrary points by the key, which crypto/ecdh doesn't expose,
+// hence the elliptic APIs. The known answers of the tests pin its output.
+type commutativeCipher struct {
+	curve elliptic.Curve
+	key   *big.Int
+}
+
+func newCommutativeCipher() (*commutativeCipher, error) {
+	curve := elliptic.P256()
+	order := curve.Params().N
+	for {
+		key, err := rand.Int(rand.Reader, order)
+		if err != nil {
+			return nil, fmt.Errorf("unable to generate the encryption key: %w", err)
+		}
+		if key.Sign() > 0 {
+			return &commutativeCipher{curve: curve, key: key}, nil
+		}
+	}
+}
+
+func (c *commutativeCipher) encrypt(plaintext []byte) ([]byte, error) {
+	x, y := c.hashToCurve(plaintext)
+	x, y = c.curve.ScalarMult(x, y, c.key.Bytes())
+	return elliptic.MarshalCompressed(c.curve, x, y), nil
+}
+
+func (c *commutativeCipher) decrypt(ciphertext []byte) ([]byte, error) {
+	x, y := elliptic.UnmarshalCompressed(c.curve, ciphertext)
+	if x == nil {
+		return nil, errors.New("encrypted value is not a valid P-256 point")
+	}
+	inverse := new(big.Int).ModInverse(c.key, c.curve.Params().N)
+	x, y = c.curve.ScalarMult(x, y, inverse.Bytes())
+	return elliptic.MarshalCompressed(c.curve, x, y), nil
+}
+
+// hashToCurve maps a message onto the curve with the try-and-increment method,
+// always picking the even y coordinate.
+func (c *commutativeCipher) hashToCurve(message []byte) (*big.Int, *big.Int) {
+	params := c.curve.Params()
+	x := randomOracle(message, params.P)
+	for {
+		y := new(big.Int).ModSqrt(ySquare(params, x), params.P)
+		if y != nil {
+			if y.Bit(0) == 1 {
+				y.Sub(params.P, y)
+			}
+			return x, y
+		}
+		x = randomOracle(x.Bytes(), params.P)
+	}
+}
+
+// ySquare returns x^3 - 3x + b mod p.
+func ySquare(params *elliptic.CurveParams, x *big.Int) *big.Int {
+	x3 := new(big.Int).Exp(x, big.NewInt(3), params.P)
+	threeX := new(big.Int).Mul(x, big.NewInt(3))
+	x3.Sub(x3, threeX)
+	x3.Add(x3, params.B)
+	return x3.Mod(x3, params.P)
+}
+
+// randomOracle expands SHA-256 with a counter so that the output is uniformly
+// distributed below max.
+func randomOracle(message []byte, max *big.Int) *big.Int {
+	hashBits := sha256.Size * 8
+	iterations := (max.BitLen() + hashBits + hashBits - 1) / hashBits
+	output := new(big.Int)
+	for i := 1; i <= iterations; i++ {
+		hash := sha256.Sum256(append(big.NewInt(int64(i)).Bytes(), message...))
+		output.Lsh(output, uint(hashBits))
+		output.Add(output, new(big.Int).SetBytes(hash[:]))
+	}
+	return output.Mod(output, max)
+}
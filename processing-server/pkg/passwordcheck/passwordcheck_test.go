@@ -0,0 +1,191 @@
+package passwordcheck
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/hex"
+	"math/big"
+	"testing"
+)
+
+// Keys of the known answers, the client key is random in New
+var (
+	clientKey, _ = new(big.Int).SetString("2a9f1d3e5b7c6a8d4f2e1b0c9d8e7f6a5b4c3d2e1f0a9b8c7d6e5f4a3b2c1d0e", 16)
+	serverKey, _ = new(big.Int).SetString("1c2b3a4958677685a4b3c2d1e0f0e1d2c3b4a5968778695a4b3c2d1e0f1e2d3c", 16)
+)
+
+// Known answers of the reCAPTCHA password check helpers algorithm, computed with an implementation independent of
+// this package: canonicalized username, Scrypt hash, lookup hash prefix, then the encryption of the hash by the
+// client, its re-encryption by the server and the encryption of the hash by the server only.
+var knownAnswers = []struct {
+	username              string
+	password              string
+	canonicalizedUsername string
+	lookupHashPrefix      string
+	credentialsHash       string
+	encrypted             string
+	reencrypted           string
+	serverEncrypted       string
+}{
+	{
+		username:              "Foo.Bar@Example.com",
+		password:              "hunter2",
+		canonicalizedUsername: "foobar",
+		lookupHashPrefix:      "f09d6cc0",
+		credentialsHash:       "ea83cdecb26f1c376392e418f6152d689249783e54a445e26d2ed741cd0abf68",
+		encrypted:             "023860784b0748901284d9bec496bdd7bcbb6d157403a926360f50817fb2036595",
+		reencrypted:           "02744832abb432df202c596805dc68ccad8c7aa63bf3bb4f01d372c327bc2928e4",
+		serverEncrypted:       "02d2dce758ae55cf657df94ea5fafc0a4fa6dbe3993e1399b886019a041cea2f60",
+	},
+	{
+		username:              "  leaked.user ",
+		password:              "password123",
+		canonicalizedUsername: "leakeduser",
+		lookupHashPrefix:      "6118c940",
+		credentialsHash:       "f6b98f79dd1c2ef0bce5db719a9b07374c81ed71bdf229b549c06c8bd1c6f001",
+		encrypted:             "029c3ac2953b3d13eea8aa68ecb5e342d418bcbcdb3bb337f12e86254183173c54",
+		reencrypted:           "02f136b7b8d91cab2fffe4d5ec9f2a5de30b2ba16100ac95d192d04cd4ffd95679",
+		serverEncrypted:       "020bde38e172d2019aa5fe2d2789fc08c47c58bc4b4d7bc91029c0a32a6c3be836",
+	},
+}
+
+func TestKnownAnswers(t *testing.T) {
+	for _, tt := range knownAnswers {
+		t.Run(tt.canonicalizedUsername, func(t *testing.T) {
+			canonicalizedUsername := canonicalizeUsername(tt.username)
+			if canonicalizedUsername != tt.canonicalizedUsername {
+				t.Fatalf("got canonicalized username %q, want %q", canonicalizedUsername, tt.canonicalizedUsername)
+			}
+			if got := hex.EncodeToString(lookupHashPrefix(canonicalizedUsername)); got != tt.lookupHashPrefix {
+				t.Errorf("got lookup hash prefix %s, want %s", got, tt.lookupHashPrefix)
+			}
+			credentialsHash, err := hashCredentials(canonicalizedUsername, tt.password)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := hex.EncodeToString(credentialsHash); got != tt.credentialsHash {
+				t.Fatalf("got credentials hash %s, want %s", got, tt.credentialsHash)
+			}
+
+			cipher := &commutativeCipher{curve: elliptic.P256(), key: clientKey}
+			encrypted, err := cipher.encrypt(credentialsHash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := hex.EncodeToString(encrypted); got != tt.encrypted {
+				t.Errorf("got encrypted hash %s, want %s", got, tt.encrypted)
+			}
+			if got := hex.EncodeToString(reencrypt(t, serverKey, encrypted)); got != tt.reencrypted {
+				t.Errorf("got re-encrypted hash %s, want %s", got, tt.reencrypted)
+			}
+			serverEncrypted, err := cipher.decrypt(mustDecode(t, tt.reencrypted))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := hex.EncodeToString(serverEncrypted); got != tt.serverEncrypted {
+				t.Errorf("got decrypted hash %s, want %s", got, tt.serverEncrypted)
+			}
+		})
+	}
+}
+
+func TestIsLeaked(t *testing.T) {
+	tt := knownAnswers[0]
+	serverEncrypted := sha256.Sum256(mustDecode(t, tt.serverEncrypted))
+	tests := []struct {
+		name     string
+		prefixes [][]byte
+		leaked   bool
+	}{
+		{name: "matching prefix", prefixes: [][]byte{{0x00}, serverEncrypted[:4]}, leaked: true},
+		{name: "full hash", prefixes: [][]byte{serverEncrypted[:]}, leaked: true},
+		{name: "other prefix", prefixes: [][]byte{{serverEncrypted[0] ^ 0xFF}}},
+		{name: "empty prefix", prefixes: [][]byte{{}}},
+		{name: "no leaks"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			v := &Verification{cipher: &commutativeCipher{curve: elliptic.P256(), key: clientKey}}
+			leaked, err := v.IsLeaked(mustDecode(t, tt.reencrypted), test.prefixes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if leaked != test.leaked {
+				t.Errorf("got leaked %t, want %t", leaked, test.leaked)
+			}
+		})
+	}
+
+	v := &Verification{cipher: &commutativeCipher{curve: elliptic.P256(), key: clientKey}}
+	if _, err := v.IsLeaked(nil, nil); err == nil {
+		t.Error("got no error without the re-encrypted hash")
+	}
+	if _, err := v.IsLeaked([]byte{0x02, 0x01}, nil); err == nil {
+		t.Error("got no error with an invalid point")
+	}
+}
+
+// Handshake with random client keys, the server finding the leak with its own encryption of the credentials
+func TestRoundTrip(t *testing.T) {
+	credentialsHash, err := hashCredentials("leakeduser", "password123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &commutativeCipher{curve: elliptic.P256(), key: serverKey}
+	leak, err := server.encrypt(credentialsHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leakHash := sha256.Sum256(leak)
+	prefixes := [][]byte{leakHash[:20]}
+
+	for _, username := range []string{"Leaked.User@example.com", "leakeduser", "other.user"} {
+		first, err := New(username, "password123")
+		if err != nil {
+			t.Fatal(err)
+		}
+		second, err := New(username, "password123")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(first.EncryptedUserCredentialsHash, second.EncryptedUserCredentialsHash) {
+			t.Errorf("%s: got the same encrypted hash with two handshakes", username)
+		}
+		if !bytes.Equal(first.LookupHashPrefix, second.LookupHashPrefix) {
+			t.Errorf("%s: got different lookup hash prefixes", username)
+		}
+		leaked, err := first.IsLeaked(reencrypt(t, serverKey, first.EncryptedUserCredentialsHash), prefixes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := username != "other.user"; leaked != want {
+			t.Errorf("%s: got leaked %t, want %t", username, leaked, want)
+		}
+	}
+
+	if _, err := New("", "password"); err == nil {
+		t.Error("got no error without username")
+	}
+}
+
+// Re-encryption by the server of the value encrypted by the client
+func reencrypt(t *testing.T, key *big.Int, ciphertext []byte) []byte {
+	t.Helper()
+	curve := elliptic.P256()
+	x, y := elliptic.UnmarshalCompressed(curve, ciphertext)
+	if x == nil {
+		t.Fatal("invalid encrypted value")
+	}
+	x, y = curve.ScalarMult(x, y, key.Bytes())
+	return elliptic.MarshalCompressed(curve, x, y)
+}
+
+func mustDecode(t *testing.T, value string) []byte {
+	t.Helper()
+	decoded, err := hex.DecodeString(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decoded
+}
@@ -0,0 +1,145 @@
+// Package problem writes the error responses as RFC 7807 problem details, carrying a stable code the clients
+// can rely on rather than the message, the request ID and a retry hint when the request may be retried.
+//
+//	problem.Write(w, r, problem.New(http.StatusUnauthorized, problem.CodeTokenMissing, "the request has no token"))
+package problem
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ContentType of the problem details.
+const ContentType = "application/problem+json"
+
+const (
+	// Request ID, read from the request when set by the proxy and returned with the response
+	RequestIdHeader = "x-request-id"
+	// Code of the problem, for the clients reading the headers only
+	CodeHeader = "x-recaptcha-error"
+)
+
+// Prefix of the type URIs, followed by the code
+const typePrefix = "urn:recaptcha-processing-server:problem:"
+
+// Code is the stable, machine-readable identifier of a problem.
+type Code string
+
+const (
+	// The request body or parameters can't be read
+	CodeInvalidRequest  Code = "invalid_request"
+	CodeRequestTooLarge Code = "request_too_large"
+	// No site key could be resolved for the request
+	CodeSiteKeyMissing Code = "site_key_missing"
+	CodeTokenMissing   Code = "token_missing"
+	// The token is malformed, already used, or was refused by reCAPTCHA
+	CodeTokenInvalid Code = "token_invalid"
+	// The token is older than the maximum token age, a new token is needed
+	CodeTokenExpired Code = "token_expired"
+	// The score is in a deny band, or not above the threshold
+	CodeScoreTooLow Code = "score_too_low"
+	// The action of the token is not expected by the site policy, or the one of the verdict attestation by the backend
+	CodeActionMismatch    Code = "action_mismatch"
+	CodeChallengeRequired Code = "challenge_required"
+	// Denied risk reasons, transaction risk or account defender labels
+	CodeRiskDenied Code = "risk_denied"
+	// The verdict attestation is missing or can't be verified
+	CodeAttestationInvalid Code = "attestation_invalid"
+	// Any other refusal of the verification
+	CodeVerificationFailed Code = "verification_failed"
+	// reCAPTCHA could not be reached or answered unexpectedly, the request may be retried
+	CodeProviderUnavailable Code = "provider_unavailable"
+	// The upstream of a gateway route could not be reached
+	CodeUpstreamUnavailable Code = "upstream_unavailable"
+	// The request took longer than the request timeout
+	CodeTimeout  Code = "timeout"
+	CodeInternal Code = "internal_error"
+)
+
+// Problem details of an error response, with the extension members of this service.
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	// Path of the request
+	Instance  string `json:"instance,omitempty"`
+	Code      Code   `json:"code"`
+	RequestId string `json:"requestId,omitempty"`
+	// Seconds to wait before retrying, also set as the Retry-After header. Zero when the request must not be retried.
+	RetryAfter int `json:"retryAfter,omitempty"`
+	// Interstitial of the step-up challenge, when configured
+	ChallengeUrl string `json:"challengeUrl,omitempty"`
+	// Matched risk reasons of the site policy
+	RiskReasons []string `json:"riskReasons,omitempty"`
+}
+
+// New creates the problem of the code, titled with the status text.
+func New(status int, code Code, detail string) Problem {
+	return Problem{
+		Type:   typePrefix + string(code),
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+		Code:   code,
+	}
+}
+
+// WithRetryAfter sets the retry hint, rounded up to the second.
+func (p Problem) WithRetryAfter(d time.Duration) Problem {
+	p.RetryAfter = int((d + time.Second - 1) / time.Second)
+	return p
+}
+
+// Write the problem as the response, filling in the instance and the request ID. The headers set on w
+// beforehand are kept.
+func Write(w http.ResponseWriter, r *http.Request, p Problem) {
+	if p.Instance == "" {
+		p.Instance = r.URL.Path
+	}
+	if p.RequestId == "" {
+		p.RequestId = RequestId(r)
+	}
+	w.Header().Set("Content-Type", ContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set(RequestIdHeader, p.RequestId)
+	w.Header().Set(CodeHeader, string(p.Code))
+	if p.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(p.RetryAfter))
+	}
+	w.WriteHeader(p.Status)
+	b, err := json.Marshal(p)
+	if err != nil {
+		panic(err)
+	}
+	w.Write(append(b, '\n'))
+}
+
+// RequestId returns the ID set by the proxy on the request, or a new random one.
+func RequestId(r *http.Request) string {
+	if id := r.Header.Get(RequestIdHeader); id != "" {
+		return id
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Read the problem of a response, false when the response is not a problem.
+func Read(resp *http.Response, body []byte) (Problem, bool) {
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != ContentType {
+		return Problem{}, false
+	}
+	var p Problem
+	if err := json.Unmarshal(body, &p); err != nil || p.Code == "" {
+		return Problem{}, false
+	}
+	return p, true
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	chi "github.com/go-chi/chi/v5"
+	captcha "github.com/pseudonator/recaptcha-processing-server/pkg/handlers"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/middleware"
+	"go.uber.org/zap"
+)
+
+// Setting up the admin listener, only when its clients are authenticated, with a bearer token or mTLS. The endpoints
+// called by the other services have their own token, which never grants the operational endpoints.
+func (lw *loggerWrapper) setupAdmin(s *Server, logLevel *zap.AtomicLevel) {
+	token := lw.getStringOrDefault("ADMIN_TOKEN", "")
+	apiToken := lw.getStringOrDefault("ADMIN_API_TOKEN", "")
+	certFile := lw.getStringOrDefault("ADMIN_TLS_CERT_FILE", "")
+	keyFile := lw.getStringOrDefault("ADMIN_TLS_KEY_FILE", "")
+	clientCaFile := lw.getStringOrDefault("ADMIN_TLS_CLIENT_CA_FILE", "")
+	if token == "" && clientCaFile == "" {
+		lw.log.Info("admin listener disabled, neither ADMIN_TOKEN nor ADMIN_TLS_CLIENT_CA_FILE is set, the password leak and account group endpoints are not served")
+		return
+	}
+	// The services holding a client certificate would otherwise reach the operational endpoints
+	if apiToken != "" && token == "" {
+		panic(errors.New("ADMIN_API_TOKEN requires ADMIN_TOKEN"))
+	}
+	if apiToken != "" && apiToken == token {
+		panic(errors.New("ADMIN_API_TOKEN must differ from ADMIN_TOKEN"))
+	}
+	if (certFile == "") != (keyFile == "") {
+		panic(errors.New("ADMIN_TLS_CERT_FILE and ADMIN_TLS_KEY_FILE are required together"))
+	}
+	if clientCaFile != "" && certFile == "" {
+		panic(errors.New("ADMIN_TLS_CLIENT_CA_FILE requires ADMIN_TLS_CERT_FILE and ADMIN_TLS_KEY_FILE"))
+	}
+
+	host := lw.getStringOrDefault("ADMIN_HOST", defaultAdminHost)
+	port := lw.getIntOrDefault("ADMIN_PORT", defaultAdminPort)
+	mux := chi.NewMux()
+	mux.Use(
+		middleware.RequestId,
+		middleware.Logging(lw.log),
+		middleware.Recoverer(lw.log),
+	)
+	s.adminMux = mux
+	// The endpoints called by the other services, authenticated and limited as on the main listener
+	if apiToken != "" {
+		s.adminApi = mux.With(
+			captcha.AdminAuth(apiToken),
+			middleware.BodyLimit(int64(lw.getIntOrDefault("MAX_REQUEST_BODY_SIZE", defaultMaxRequestBodySize))),
+			middleware.Timeout(lw.getDurationOrDefault("REQUEST_TIMEOUT", defaultRequestTimeout)),
+		)
+	} else {
+		lw.log.Info("ADMIN_API_TOKEN is not set, the password leak and account group endpoints are not served")
+	}
+	s.adminCertFile, s.adminKeyFile = certFile, keyFile
+	s.admin = &http.Server{
+		Addr:              net.JoinHostPort(host, strconv.Itoa(port)),
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+		// Long enough for the CPU profiles and the traces
+		WriteTimeout: 2 * time.Minute,
+		IdleTimeout:  time.Minute,
+	}
+	if clientCaFile != "" {
+		s.admin.TLSConfig = &tls.Config{
+			ClientCAs:  lw.getCertPool(clientCaFile),
+			ClientAuth: tls.RequireAndVerifyClientCert,
+			MinVersion: tls.VersionTLS12,
+		}
+	}
+	s.adminOptions = &captcha.AdminOptions{
+		Token:    token,
+		LogLevel: logLevel,
+		Modes:    s.captcha.Modes,
+		Verifier: s.captcha.Verifier,
+		Config:   lw.config,
+	}
+}
+
+func (lw *loggerWrapper) getCertPool(path string) *x509.CertPool {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		panic(fmt.Errorf("unable to read the client CA from %s: %w", path, err))
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(content) {
+		panic(fmt.Errorf("no certificate in the client CA %s", path))
+	}
+	return pool
+}
+
+func (s *Server) startAdmin() error {
+	s.log.Info("starting admin listener", zap.String("address", s.admin.Addr), zap.Bool("tls", s.adminCertFile != ""))
+	var err error
+	if s.adminCertFile != "" {
+		err = s.admin.ListenAndServeTLS(s.adminCertFile, s.adminKeyFile)
+	} else {
+		err = s.admin.ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("error starting admin server: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	captcha "github.com/pseudonator/recaptcha-processing-server/pkg/handlers"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/verify"
+	"go.uber.org/zap"
+)
+
+func setupTestAdmin(t *testing.T, env map[string]string) *Server {
+	t.Helper()
+	for name, value := range env {
+		t.Setenv(name, value)
+	}
+	s := &Server{captcha: &captcha.CaptchaVerifyOptions{Modes: &captcha.Modes{}, Verifier: &verify.Verifier{}}}
+	lw := &loggerWrapper{log: zap.NewNop(), config: map[string]string{}}
+	lw.setupAdmin(s, nil)
+	return s
+}
+
+func TestSetupAdminTokens(t *testing.T) {
+	s := setupTestAdmin(t, map[string]string{"ADMIN_TOKEN": "admin-token", "ADMIN_API_TOKEN": "api-token"})
+	captcha.HandleAdmin(s.adminMux, s.adminOptions, zap.NewNop())
+	s.adminApi.Get("/service", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		name   string
+		path   string
+		token  string
+		status int
+	}{
+		{name: "operator", path: "/modes", token: "admin-token", status: http.StatusOK},
+		{name: "service token on the operational endpoints", path: "/modes", token: "api-token", status: http.StatusUnauthorized},
+		{name: "service", path: "/service", token: "api-token", status: http.StatusOK},
+		{name: "operator token on the service endpoints", path: "/service", token: "admin-token", status: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			rec := httptest.NewRecorder()
+			s.adminMux.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Errorf("got status %d, want %d", rec.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestSetupAdminConfig(t *testing.T) {
+	tests := []struct {
+		name  string
+		env   map[string]string
+		api   bool
+		panic bool
+	}{
+		{name: "without service token", env: map[string]string{"ADMIN_TOKEN": "admin-token"}},
+		{name: "with service token", env: map[string]string{"ADMIN_TOKEN": "admin-token", "ADMIN_API_TOKEN": "api-token"}, api: true},
+		{name: "same tokens", env: map[string]string{"ADMIN_TOKEN": "token", "ADMIN_API_TOKEN": "token"}, panic: true},
+		{name: "service token without operator token", env: map[string]string{"ADMIN_TOKEN": "", "ADMIN_API_TOKEN": "api-token", "ADMIN_TLS_CLIENT_CA_FILE": "ca.pem", "ADMIN_TLS_CERT_FILE": "cert.pem", "ADMIN_TLS_KEY_FILE": "key.pem"}, panic: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if r := recover(); (r != nil) != tt.panic {
+					t.Errorf("got panic %v, want a panic %t", r, tt.panic)
+				}
+			}()
+			s := setupTestAdmin(t, tt.env)
+			if (s.adminApi != nil) != tt.api {
+				t.Errorf("got the service endpoints %t, want %t", s.adminApi != nil, tt.api)
+			}
+		})
+	}
+}
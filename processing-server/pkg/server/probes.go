@@ -0,0 +1,134 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	captcha "github.com/pseudonator/recaptcha-processing-server/pkg/handlers"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/health"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/verify"
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	defaultEnterpriseEndpoint = "recaptchaenterprise.googleapis.com:443"
+	defaultProbeCacheTtl      = 30 * time.Second
+	defaultProbeTimeout       = 2 * time.Second
+)
+
+// Checks of the readiness probe. The provider is only dialed, an assessment would be billed.
+func (lw *loggerWrapper) getChecker(captchaOptions *captcha.CaptchaVerifyOptions) *health.Checker {
+	ttl := lw.getDurationOrDefault("PROBE_CACHE_TTL", defaultProbeCacheTtl)
+	checks := []health.Check{{Name: "config", Ttl: ttl, Run: lw.checkConfigFiles}}
+	if captchaOptions.EnterpriseEnabled {
+		endpoint := lw.getStringOrDefault("RECAPTCHA_ENTERPRISE_ENDPOINT", "")
+		if endpoint == "" {
+			endpoint = defaultEnterpriseEndpoint
+		}
+		// The insecure endpoints are dialed without credentials
+		if !lw.getBoolOrDefault("RECAPTCHA_ENTERPRISE_INSECURE", false) {
+			checks = append(checks, health.Check{Name: "credentials", Ttl: ttl, Run: checkCredentials})
+		}
+		checks = append(checks, health.Check{Name: "provider", Ttl: ttl, Run: dialCheck(endpoint)})
+	} else {
+		address, err := urlAddress(lw.getStringOrDefault("VERIFY_CAPTCHA_GOOGLE_API", ""))
+		if err != nil {
+			panic(fmt.Errorf("unable to read VERIFY_CAPTCHA_GOOGLE_API: %w", err))
+		}
+		checks = append(checks, health.Check{Name: "provider", Ttl: ttl, Run: dialCheck(address)})
+	}
+	// The state is in memory, checked on every probe
+	if _, ok := captchaOptions.Verifier.Breaker(); ok {
+		checks = append(checks, health.Check{Name: "circuit-breaker", Run: breakerCheck(captchaOptions.Verifier)})
+	}
+	return health.NewChecker(lw.getDurationOrDefault("PROBE_TIMEOUT", defaultProbeTimeout), checks...)
+}
+
+// The configuration is validated at startup, but the mounted files may go away afterwards
+func (lw *loggerWrapper) checkConfigFiles(ctx context.Context) error {
+	var missing []string
+	for name, path := range lw.config {
+		if !strings.HasSuffix(name, "_FILE") || path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("unable to read the files of %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// Loading the application default credentials and getting an access token, which is free
+func checkCredentials(ctx context.Context) error {
+	credentials, err := google.FindDefaultCredentials(ctx, "https://www.googleapis.com/auth/cloud-platform")
+	if err != nil {
+		return fmt.Errorf("unable to load the credentials: %w", err)
+	}
+	// The token source ignores the deadline of the context
+	done := make(chan error, 1)
+	go func() {
+		_, err := credentials.TokenSource.Token()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("unable to get an access token: %w", err)
+		}
+		return nil
+	case <-ctx.Done():
+		return errors.New("timed out getting an access token")
+	}
+}
+
+// Not ready while the circuit breaker is open, the half-open breaker is probing the provider
+func breakerCheck(verifier *verify.Verifier) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		status, _ := verifier.Breaker()
+		if status.State == verify.BreakerOpen {
+			return fmt.Errorf("circuit breaker of %s open since %s", status.Name, status.OpenedAt.Format(time.RFC3339))
+		}
+		return nil
+	}
+}
+
+func dialCheck(address string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", address)
+		if err != nil {
+			return fmt.Errorf("unable to reach %s: %w", address, err)
+		}
+		return conn.Close()
+	}
+}
+
+// Address to dial of a URL, with the default port of its scheme
+func urlAddress(rawUrl string) (string, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return "", err
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("no host in '%s'", rawUrl)
+	}
+	if u.Port() != "" {
+		return u.Host, nil
+	}
+	port := "443"
+	if u.Scheme == "http" {
+		port = "80"
+	}
+	return net.JoinHostPort(u.Hostname(), port), nil
+}
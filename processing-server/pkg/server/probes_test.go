@@ -0,0 +1,85 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	captcha "github.com/pseudonator/recaptcha-processing-server/pkg/handlers"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/health"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/verify"
+	"go.uber.org/zap"
+)
+
+// Verifier whose breaker opens on the first failure of siteverify, always unavailable
+func newTrippedVerifier(t *testing.T, cooldown time.Duration) *verify.Verifier {
+	t.Helper()
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(api.Close)
+	verifier, err := verify.New(verify.Options{
+		SiteVerify: &verify.SiteVerifyOptions{Api: api.URL},
+		Breaker:    verify.BreakerOptions{FailureThreshold: 1, Cooldown: cooldown},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifier.Verify(context.Background(), verify.Request{SiteKey: "secret", Token: "token"}); err == nil {
+		t.Fatal("got no error from the unavailable siteverify")
+	}
+	return verifier
+}
+
+func TestBreakerCheck(t *testing.T) {
+	verifier := newTrippedVerifier(t, 50*time.Millisecond)
+	check := breakerCheck(verifier)
+	if err := check(context.Background()); err == nil {
+		t.Fatal("got ready with the circuit breaker open")
+	}
+
+	// Ready again once the cooldown is over, without any call to probe the provider
+	time.Sleep(60 * time.Millisecond)
+	if err := check(context.Background()); err != nil {
+		t.Errorf("got %v after the cooldown", err)
+	}
+}
+
+func TestGetChecker(t *testing.T) {
+	provider := httptest.NewServer(http.NotFoundHandler())
+	defer provider.Close()
+	t.Setenv("VERIFY_CAPTCHA_GOOGLE_API", provider.URL)
+
+	tests := []struct {
+		name     string
+		verifier *verify.Verifier
+		checks   map[string]health.Status
+	}{
+		{
+			name:     "without breaker",
+			verifier: &verify.Verifier{},
+			checks:   map[string]health.Status{"config": health.StatusOk, "provider": health.StatusOk},
+		},
+		{
+			name:     "breaker open",
+			verifier: newTrippedVerifier(t, time.Minute),
+			checks:   map[string]health.Status{"config": health.StatusOk, "provider": health.StatusOk, "circuit-breaker": health.StatusFail},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lw := &loggerWrapper{log: zap.NewNop(), config: map[string]string{}}
+			report := lw.getChecker(&captcha.CaptchaVerifyOptions{Verifier: tt.verifier}).Ready(context.Background())
+			if len(report.Checks) != len(tt.checks) {
+				t.Fatalf("got checks %+v, want %v", report.Checks, tt.checks)
+			}
+			for name, status := range tt.checks {
+				if got := report.Checks[name].Status; got != status {
+					t.Errorf("got %s %s, want %s", name, got, status)
+				}
+			}
+		})
+	}
+}
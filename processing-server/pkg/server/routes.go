@@ -3,6 +3,19 @@ package server
 import "github.com/pseudonator/recaptcha-processing-server/pkg/handlers"
 
 func (s *Server) setupRoutes() {
-	handlers.Health(s.mux)
-	handlers.HandleCaptcha(s.mux, s.captcha, s.log)
+	handlers.Health(s.api)
+	handlers.HandleProbes(s.api, s.checker)
+	handlers.HandleCaptcha(s.api, s.captcha, s.log)
+	handlers.HandleChallenge(s.api, s.captcha, s.log)
+	handlers.HandleJwks(s.api, s.captcha, s.log)
+	handlers.HandleForwardAuth(s.api, s.forwardAuth, s.captcha, s.log)
+	handlers.HandleGateway(s.gateway, s.gatewayRoutes, s.captcha, s.log)
+	if s.admin != nil {
+		handlers.HandleAdmin(s.adminMux, s.adminOptions, s.log)
+	}
+	if s.adminApi != nil {
+		// Billed by reCAPTCHA and disclosing the accounts, only served to the authenticated services
+		handlers.HandlePasswordLeak(s.adminApi, s.captcha, s.log)
+		handlers.HandleAccountGroups(s.adminApi, s.captcha, s.log)
+	}
 }
@@ -2,6 +2,8 @@ package server
 
 import (
 	"context"
+	"crypto"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
@@ -12,31 +14,82 @@ import (
 	"time"
 
 	chi "github.com/go-chi/chi/v5"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/attest"
 	captcha "github.com/pseudonator/recaptcha-processing-server/pkg/handlers"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/health"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/middleware"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/pass"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/verify"
 	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
 )
 
 const (
 	defaultServerHost                 = "localhost"
 	defaultServerPort                 = 8090
 	defaultThreshold                  = 0.5
+	defaultTransactionRiskThreshold   = verify.DefaultTransactionRiskThreshold
 	defaultRecaptchaEnterpriseEnabled = true
+	defaultAccountIdHeader            = "x-account-id"
+	defaultTokenClockSkew             = 30 * time.Second
+	defaultBreakerFailureThreshold    = 5
+	defaultBreakerCooldown            = 30 * time.Second
+	defaultChallengeUrl               = "/challenge"
+	defaultPassTtl                    = 5 * time.Minute
+	defaultPassKeyId                  = "default"
+	defaultAttestationIssuer          = "recaptcha-processing-server"
+	defaultAttestationTtl             = time.Minute
+	defaultForwardAuthSiteKeyHeader   = "x-recaptcha-site-key"
+	defaultWafActionTokenCookie       = "recaptcha-action-token"
+	defaultWafSessionTokenCookie      = "recaptcha-ca-t"
+	defaultMaxRequestBodySize         = 2 << 20
+	// Below the write timeout, so that the refusals of the timed out requests can still be written
+	defaultRequestTimeout            = 4500 * time.Millisecond
+	defaultGatewayMaxRequestBodySize = 32 << 20
+	defaultGatewayTimeout            = time.Minute
+	defaultAdminHost                 = "localhost"
+	defaultAdminPort                 = 8091
 )
 
 type Options struct {
 	Log *zap.Logger
+	// Level of the logger, changed at runtime on the admin listener
+	LogLevel *zap.AtomicLevel
 }
 
 type Server struct {
 	address string
 	log     *zap.Logger
 	mux     chi.Router
+	// Routes of the verification API and of the gateway, each with their body size limit and timeout
+	api     chi.Router
+	gateway chi.Router
 	server  *http.Server
 	captcha *captcha.CaptchaVerifyOptions
+	// Routes of the reverse-proxy gateway mode
+	gatewayRoutes []captcha.GatewayRoute
+	// Site key resolution of the NGINX and Traefik endpoints
+	forwardAuth *captcha.ForwardAuthOptions
+	// Operational endpoints, on their own listener
+	admin        *http.Server
+	adminMux     chi.Router
+	adminOptions *captcha.AdminOptions
+	// Endpoints called by the other services on the admin listener, with their own token, nil without it
+	adminApi chi.Router
+	// Admin listener TLS files, served in plaintext when empty
+	adminCertFile string
+	adminKeyFile  string
+	// Dependency checks of the readiness and startup probes
+	checker *health.Checker
 }
 
 type loggerWrapper struct {
 	log *zap.Logger
+	// Effective value of every env var read, defaults included, for the admin config dump
+	config map[string]string
 }
 
 func New(opts Options) *Server {
@@ -45,14 +98,20 @@ func New(opts Options) *Server {
 	}
 	log := opts.Log
 
-	lw := &loggerWrapper{log: log}
+	lw := &loggerWrapper{log: log, config: map[string]string{}}
 
 	address := lw.getBindingAddress()
 	mux := chi.NewMux()
-	return &Server{
+	lw.useMiddlewares(mux)
+	s := &Server{
 		address: address,
 		log:     log,
 		mux:     mux,
+		api: mux.With(
+			middleware.BodyLimit(int64(lw.getIntOrDefault("MAX_REQUEST_BODY_SIZE", defaultMaxRequestBodySize))),
+			middleware.Timeout(lw.getDurationOrDefault("REQUEST_TIMEOUT", defaultRequestTimeout)),
+		),
+		gateway: lw.getGatewayMux(mux),
 		server: &http.Server{
 			Addr:              address,
 			Handler:           mux,
@@ -61,8 +120,52 @@ func New(opts Options) *Server {
 			WriteTimeout:      5 * time.Second,
 			IdleTimeout:       5 * time.Second,
 		},
-		captcha: lw.getCaptchaVerify(),
+		captcha:       lw.getCaptchaVerify(),
+		gatewayRoutes: lw.getGatewayRoutes("GATEWAY_ROUTES_FILE"),
+		forwardAuth: &captcha.ForwardAuthOptions{
+			SiteKeyHeader: lw.getStringOrDefault("FORWARD_AUTH_SITE_KEY_HEADER", defaultForwardAuthSiteKeyHeader),
+			SiteKeys:      lw.getSiteKeyMappings("FORWARD_AUTH_SITE_KEYS_FILE"),
+		},
+	}
+	s.checker = lw.getChecker(s.captcha)
+	// Last, so that the dumped configuration is complete
+	lw.setupAdmin(s, opts.LogLevel)
+	return s
+}
+
+// The request ID comes first so that every log line carries it, the client IP is resolved before the logging
+func (lw *loggerWrapper) useMiddlewares(mux chi.Router) {
+	mux.Use(middleware.RequestId)
+	if trusted := lw.getTrustedProxies("TRUSTED_PROXIES"); len(trusted) > 0 {
+		mux.Use(middleware.RealIp(trusted))
+	} else {
+		// The proxy headers are never trusted without it, the passes and the assessments get the address of the proxy
+		lw.log.Warn("no TRUSTED_PROXIES, the client IP is the remote address of the connection")
+	}
+	mux.Use(
+		middleware.Logging(lw.log, "/health", "/livez", "/readyz", "/startupz"),
+		middleware.Recoverer(lw.log),
+	)
+}
+
+// The gateway streams the bodies of the upstreams, far beyond the limits of the verification API and the timeouts of
+// the server
+func (lw *loggerWrapper) getGatewayMux(mux chi.Router) chi.Router {
+	timeout := lw.getDurationOrDefault("GATEWAY_TIMEOUT", defaultGatewayTimeout)
+	return mux.With(
+		middleware.BodyLimit(int64(lw.getIntOrDefault("GATEWAY_MAX_REQUEST_BODY_SIZE", defaultGatewayMaxRequestBodySize))),
+		middleware.Timeout(timeout),
+		middleware.ConnDeadline(timeout),
+	)
+}
+
+// Reading the addresses and CIDR ranges of the proxies allowed to set x-forwarded-for
+func (lw *loggerWrapper) getTrustedProxies(name string) []*net.IPNet {
+	trusted, err := middleware.ParseTrustedProxies(lw.getStringSliceOrDefault(name, nil))
+	if err != nil {
+		panic(fmt.Errorf("unable to read %s: %w", name, err))
 	}
+	return trusted
 }
 
 func (lw *loggerWrapper) getBindingAddress() string {
@@ -74,6 +177,7 @@ func (lw *loggerWrapper) getBindingAddress() string {
 
 func (lw *loggerWrapper) getCaptchaVerify() *captcha.CaptchaVerifyOptions {
 	captchaOptions := &captcha.CaptchaVerifyOptions{}
+	verifyOptions := verify.Options{}
 	isEnterprise := lw.getBoolOrDefault("ENABLE_ENTERPRISE", defaultRecaptchaEnterpriseEnabled)
 	captchaOptions.EnterpriseEnabled = isEnterprise
 	if isEnterprise {
@@ -83,12 +187,57 @@ func (lw *loggerWrapper) getCaptchaVerify() *captcha.CaptchaVerifyOptions {
 		captchaOptions.GoogleProjectId = lw.getEnvVarOrError("GOOGLE_ADC_PROJECT_ID")
 		// https://cloud.google.com/recaptcha-enterprise/docs/create-assessment#create_API_client_libraries
 		//captchaOptions.SiteKey = lw.getEnvVarOrError("CAPTCHA_SITE_KEY")
+		// https://cloud.google.com/recaptcha-enterprise/docs/account-defender
+		captchaOptions.AccountIdHeader = lw.getStringOrDefault("ACCOUNT_ID_HEADER", defaultAccountIdHeader)
+		verifyOptions.Enterprise = &verify.EnterpriseOptions{
+			ProjectId:                   captchaOptions.GoogleProjectId,
+			AccountIdSecret:             []byte(lw.getStringOrDefault("ACCOUNT_ID_HMAC_SECRET", "")),
+			DeniedAccountDefenderLabels: lw.getStringSliceOrDefault("DENIED_ACCOUNT_DEFENDER_LABELS", nil),
+			// https://cloud.google.com/recaptcha-enterprise/docs/fraud-prevention
+			TransactionRiskThreshold: lw.getFloatOrDefault("ACCEPTABLE_TRANSACTION_RISK_THRESHOLD", defaultTransactionRiskThreshold),
+			ClientOptions:            lw.getEnterpriseClientOptions(),
+		}
+		// https://cloud.google.com/recaptcha-enterprise/docs/usecase-waf
+		captchaOptions.WafActionTokenCookie = lw.getStringOrDefault("WAF_ACTION_TOKEN_COOKIE", defaultWafActionTokenCookie)
+		captchaOptions.WafSessionTokenCookie = lw.getStringOrDefault("WAF_SESSION_TOKEN_COOKIE", defaultWafSessionTokenCookie)
 	} else {
-		captchaOptions.GoogleApi = lw.getEnvVarOrError("VERIFY_CAPTCHA_GOOGLE_API")
+		verifyOptions.SiteVerify = &verify.SiteVerifyOptions{
+			Api: lw.getEnvVarOrError("VERIFY_CAPTCHA_GOOGLE_API"),
+		}
 		// https://developers.google.com/recaptcha/docs/verify#api_request
 		//captchaOptions.SharedKey = lw.getEnvVarOrError("CAPTCHA_SHARED_KEY")
 	}
-	captchaOptions.Threshold = lw.getFloatOrDefault("ACCEPTABLE_SCORE_THRESHOLD", defaultThreshold)
+	verifyOptions.Threshold = lw.getFloatOrDefault("ACCEPTABLE_SCORE_THRESHOLD", defaultThreshold)
+	verifyOptions.ExpressThreshold = lw.getFloatOrDefault("ACCEPTABLE_EXPRESS_SCORE_THRESHOLD", verifyOptions.Threshold)
+	verifyOptions.MaxTokenAge = lw.getDurationOrDefault("MAX_TOKEN_AGE", 0)
+	verifyOptions.TokenClockSkew = lw.getDurationOrDefault("TOKEN_CLOCK_SKEW", defaultTokenClockSkew)
+	verifyOptions.SitePolicies = lw.getSitePolicies("SITE_POLICIES_FILE")
+	verifyOptions.Breaker = verify.BreakerOptions{
+		FailureThreshold: lw.getIntOrDefault("BREAKER_FAILURE_THRESHOLD", defaultBreakerFailureThreshold),
+		Cooldown:         lw.getDurationOrDefault("BREAKER_COOLDOWN", defaultBreakerCooldown),
+	}
+	verifier, err := verify.New(verifyOptions)
+	if err != nil {
+		panic(fmt.Errorf("unable to create the verifier: %w", err))
+	}
+	captchaOptions.Verifier = verifier
+	captchaOptions.PassSigner = lw.getPassSigner()
+	captchaOptions.Attester = lw.getAttester()
+	// v2 checkbox key of the step-up challenge
+	captchaOptions.ChallengeSiteKey = lw.getStringOrDefault("CHALLENGE_SITE_KEY", "")
+	if captchaOptions.ChallengeSiteKey != "" {
+		if captchaOptions.PassSigner == nil {
+			panic(errors.New("PASS_SIGNING_KEYS is required by the challenge"))
+		}
+		if !isEnterprise {
+			captchaOptions.ChallengeSecretKey = lw.getEnvVarOrError("CHALLENGE_SECRET_KEY")
+		}
+		captchaOptions.ChallengeUrl = lw.getStringOrDefault("CHALLENGE_URL", defaultChallengeUrl)
+	}
+	// Initial verification modes, toggled at runtime on the admin listener
+	captchaOptions.Modes = &captcha.Modes{}
+	captchaOptions.Modes.SetShadow(lw.getBoolOrDefault("SHADOW_MODE", false))
+	captchaOptions.Modes.SetFailOpen(lw.getBoolOrDefault("FAIL_OPEN", false))
 	return captchaOptions
 }
 
@@ -96,11 +245,28 @@ func (lw *loggerWrapper) getCaptchaVerify() *captcha.CaptchaVerifyOptions {
 func (s *Server) Start() error {
 	s.setupRoutes()
 
-	s.log.Info("starting", zap.String("address", s.address))
-	if err := s.server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-		return fmt.Errorf("error starting server: %w", err)
+	// A listener failing closes the other one, for the caller to stop
+	var eg errgroup.Group
+	if s.admin != nil {
+		eg.Go(func() error {
+			if err := s.startAdmin(); err != nil {
+				_ = s.server.Close()
+				return err
+			}
+			return nil
+		})
 	}
-	return nil
+	eg.Go(func() error {
+		s.log.Info("starting", zap.String("address", s.address))
+		if err := s.server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			if s.admin != nil {
+				_ = s.admin.Close()
+			}
+			return fmt.Errorf("error starting server: %w", err)
+		}
+		return nil
+	})
+	return eg.Wait()
 }
 
 // Stop the server gracefully within the timeout.
@@ -113,11 +279,162 @@ func (s *Server) Stop() error {
 	if err := s.server.Shutdown(ctx); err != nil {
 		return fmt.Errorf("error stopping server: %w", err)
 	}
+	if s.admin != nil {
+		if err := s.admin.Shutdown(ctx); err != nil {
+			return fmt.Errorf("error stopping admin server: %w", err)
+		}
+	}
+	if err := s.captcha.Verifier.Close(); err != nil {
+		return fmt.Errorf("error closing the reCAPTCHA client: %w", err)
+	}
 
 	return nil
 }
 
-func (lw *loggerWrapper) getBoolOrDefault(name string, defaultV bool) bool {
+// Overriding the endpoint of the Enterprise API, e.g. for a local fake. An insecure endpoint is dialed in
+// plaintext without credentials.
+func (lw *loggerWrapper) getEnterpriseClientOptions() []option.ClientOption {
+	endpoint := lw.getStringOrDefault("RECAPTCHA_ENTERPRISE_ENDPOINT", "")
+	insecureEndpoint := lw.getBoolOrDefault("RECAPTCHA_ENTERPRISE_INSECURE", false)
+	if endpoint == "" {
+		if insecureEndpoint {
+			panic(errors.New("RECAPTCHA_ENTERPRISE_INSECURE requires RECAPTCHA_ENTERPRISE_ENDPOINT"))
+		}
+		return nil
+	}
+	opts := []option.ClientOption{option.WithEndpoint(endpoint)}
+	if insecureEndpoint {
+		lw.log.Warn("dialing the Enterprise API without credentials nor TLS", zap.String("endpoint", endpoint))
+		opts = append(opts,
+			option.WithoutAuthentication(),
+			option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())))
+	}
+	return opts
+}
+
+// Reading the pass signing keys as `id:secret,id:secret` to rotate them, the first key signs the new passes.
+// A single PASS_SIGNING_KEY is accepted as well.
+func (lw *loggerWrapper) getPassSigner() *pass.Signer {
+	keys, err := pass.ParseKeys(lw.getStringOrDefault("PASS_SIGNING_KEYS", ""))
+	if err != nil {
+		panic(fmt.Errorf("unable to read PASS_SIGNING_KEYS: %w", err))
+	}
+	if key := lw.getStringOrDefault("PASS_SIGNING_KEY", ""); key != "" {
+		keys = append(keys, pass.Key{Id: defaultPassKeyId, Secret: []byte(key)})
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	signer, err := pass.NewSigner(keys, lw.getDurationOrDefault("PASS_TTL", defaultPassTtl))
+	if err != nil {
+		panic(fmt.Errorf("unable to create the pass signer: %w", err))
+	}
+	return signer
+}
+
+// Reading the attestation key from a PEM file, otherwise generating an ephemeral Ed25519 key
+func (lw *loggerWrapper) getAttester() *attest.Signer {
+	if !lw.getBoolOrDefault("ATTESTATION_ENABLED", false) {
+		return nil
+	}
+	var key crypto.Signer
+	if path := lw.getStringOrDefault("ATTESTATION_SIGNING_KEY_FILE", ""); path != "" {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			panic(fmt.Errorf("unable to read the attestation key from %s: %w", path, err))
+		}
+		if key, err = attest.ParsePrivateKey(content); err != nil {
+			panic(fmt.Errorf("invalid attestation key in %s: %w", path, err))
+		}
+	} else {
+		var err error
+		if key, err = attest.GenerateKey(); err != nil {
+			panic(fmt.Errorf("unable to generate the attestation key: %w", err))
+		}
+		lw.log.Warn("using an ephemeral attestation key, which differs between replicas")
+	}
+	signer, err := attest.NewSigner(key,
+		lw.getStringOrDefault("ATTESTATION_KEY_ID", ""),
+		lw.getStringOrDefault("ATTESTATION_ISSUER", defaultAttestationIssuer),
+		lw.getDurationOrDefault("ATTESTATION_TTL", defaultAttestationTtl))
+	if err != nil {
+		panic(fmt.Errorf("unable to create the attestation signer: %w", err))
+	}
+	return signer
+}
+
+// Reading the routes of the gateway mode from a JSON file
+func (lw *loggerWrapper) getGatewayRoutes(name string) []captcha.GatewayRoute {
+	path := lw.getStringOrDefault(name, "")
+	if path == "" {
+		return nil
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		panic(fmt.Errorf("unable to read gateway routes from %s: %w", path, err))
+	}
+	var routes []captcha.GatewayRoute
+	if err := json.Unmarshal(content, &routes); err != nil {
+		panic(fmt.Errorf("unable to parse gateway routes from %s: %w", path, err))
+	}
+	for _, route := range routes {
+		if err := route.Validate(); err != nil {
+			panic(fmt.Errorf("invalid gateway route for %s: %w", route.PathPrefix, err))
+		}
+	}
+	lw.log.Info("loaded gateway routes", zap.String("path", path), zap.Int("count", len(routes)))
+	return routes
+}
+
+// Reading the site keys of the original requests from a JSON file
+func (lw *loggerWrapper) getSiteKeyMappings(name string) []captcha.SiteKeyMapping {
+	path := lw.getStringOrDefault(name, "")
+	if path == "" {
+		return nil
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		panic(fmt.Errorf("unable to read site key mappings from %s: %w", path, err))
+	}
+	var mappings []captcha.SiteKeyMapping
+	if err := json.Unmarshal(content, &mappings); err != nil {
+		panic(fmt.Errorf("unable to parse site key mappings from %s: %w", path, err))
+	}
+	for _, mapping := range mappings {
+		if err := mapping.Validate(); err != nil {
+			panic(fmt.Errorf("invalid site key mapping for %s%s: %w", mapping.Host, mapping.PathPrefix, err))
+		}
+	}
+	lw.log.Info("loaded site key mappings", zap.String("path", path), zap.Int("count", len(mappings)))
+	return mappings
+}
+
+// Reading the policies per site key from a JSON file, keyed by site key
+func (lw *loggerWrapper) getSitePolicies(name string) map[string]verify.SitePolicy {
+	path := lw.getStringOrDefault(name, "")
+	if path == "" {
+		return nil
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		panic(fmt.Errorf("unable to read site policies from %s: %w", path, err))
+	}
+	var policies map[string]verify.SitePolicy
+	if err := json.Unmarshal(content, &policies); err != nil {
+		panic(fmt.Errorf("unable to parse site policies from %s: %w", path, err))
+	}
+	for siteKey, policy := range policies {
+		if err := policy.Validate(); err != nil {
+			panic(fmt.Errorf("invalid site policy for %s: %w", siteKey, err))
+		}
+	}
+	lw.log.Info("loaded site policies", zap.String("path", path), zap.Int("count", len(policies)))
+	return policies
+}
+
+func (lw *loggerWrapper) getBoolOrDefault(name string, defaultV bool) (value bool) {
+	defer func() { lw.record(name, value) }()
+
 	v, ok := os.LookupEnv(name)
 	if !ok {
 		return defaultV
@@ -129,7 +446,9 @@ func (lw *loggerWrapper) getBoolOrDefault(name string, defaultV bool) bool {
 	return vAsBool
 }
 
-func (lw *loggerWrapper) getStringOrDefault(name string, defaultV string) string {
+func (lw *loggerWrapper) getStringOrDefault(name string, defaultV string) (value string) {
+	defer func() { lw.record(name, value) }()
+
 	v, ok := os.LookupEnv(name)
 	if !ok {
 		return defaultV
@@ -137,7 +456,25 @@ func (lw *loggerWrapper) getStringOrDefault(name string, defaultV string) string
 	return strings.TrimSpace(v)
 }
 
-func (lw *loggerWrapper) getFloatOrDefault(name string, defaultV float64) float64 {
+func (lw *loggerWrapper) getStringSliceOrDefault(name string, defaultV []string) (value []string) {
+	defer func() { lw.record(name, strings.Join(value, ",")) }()
+
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return defaultV
+	}
+	var values []string
+	for _, value := range strings.Split(v, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+func (lw *loggerWrapper) getFloatOrDefault(name string, defaultV float64) (value float64) {
+	defer func() { lw.record(name, value) }()
+
 	v, ok := os.LookupEnv(name)
 	if !ok {
 		return defaultV
@@ -149,7 +486,23 @@ func (lw *loggerWrapper) getFloatOrDefault(name string, defaultV float64) float6
 	return vAsFloat
 }
 
-func (lw *loggerWrapper) getIntOrDefault(name string, defaultV int) int {
+func (lw *loggerWrapper) getDurationOrDefault(name string, defaultV time.Duration) (value time.Duration) {
+	defer func() { lw.record(name, value) }()
+
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return defaultV
+	}
+	vAsDuration, err := time.ParseDuration(v)
+	if err != nil {
+		return defaultV
+	}
+	return vAsDuration
+}
+
+func (lw *loggerWrapper) getIntOrDefault(name string, defaultV int) (value int) {
+	defer func() { lw.record(name, value) }()
+
 	v, ok := os.LookupEnv(name)
 	if !ok {
 		return defaultV
@@ -161,10 +514,16 @@ func (lw *loggerWrapper) getIntOrDefault(name string, defaultV int) int {
 	return vAsInt
 }
 
-func (lw *loggerWrapper) getEnvVarOrError(name string) string {
+func (lw *loggerWrapper) getEnvVarOrError(name string) (value string) {
+	defer func() { lw.record(name, value) }()
+
 	v, ok := os.LookupEnv(name)
 	if !ok {
 		panic(errors.New(fmt.Sprintf("given env var is not present, %s not found !", name)))
 	}
 	return v
 }
+
+func (lw *loggerWrapper) record(name string, value any) {
+	lw.config[name] = fmt.Sprint(value)
+}
@@ -0,0 +1,157 @@
+package verify
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// BreakerOptions of the circuit breaker around the calls to reCAPTCHA. Once open, the verifications fail fast with
+// a ProviderError until the cooldown is over, then a single call probes the provider.
+type BreakerOptions struct {
+	// Consecutive failures of the provider opening the breaker, the breaker is disabled when zero
+	FailureThreshold int
+	// Time the breaker stays open before probing the provider
+	Cooldown time.Duration
+}
+
+// BreakerState is the state of the circuit breaker.
+type BreakerState string
+
+const (
+	// The calls go through, the failures are counted
+	BreakerClosed BreakerState = "closed"
+	// The calls fail fast until the cooldown is over
+	BreakerOpen BreakerState = "open"
+	// A single call probes the provider, closing or opening the breaker again
+	BreakerHalfOpen BreakerState = "half_open"
+)
+
+// ErrBreakerOpen is wrapped by the ProviderError of the calls refused by the open circuit breaker.
+var ErrBreakerOpen = errors.New("circuit breaker open")
+
+// BreakerStatus reports the state of the circuit breaker of the provider.
+type BreakerStatus struct {
+	// Provider called through the breaker, either siteverify or enterprise
+	Name     string       `json:"name"`
+	State    BreakerState `json:"state"`
+	Failures int          `json:"failures"`
+	// Time the breaker last opened, unless closed
+	OpenedAt *time.Time `json:"openedAt,omitempty"`
+}
+
+type breaker struct {
+	name string
+	opts BreakerOptions
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+}
+
+func newBreaker(name string, opts BreakerOptions) *breaker {
+	if opts.FailureThreshold <= 0 {
+		return nil
+	}
+	return &breaker{name: name, opts: opts, state: BreakerClosed}
+}
+
+// Letting the call through, otherwise returning the time left before the provider is probed
+func (b *breaker) allow(now time.Time) (time.Duration, bool) {
+	if b == nil {
+		return 0, true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if left := b.openedAt.Add(b.opts.Cooldown).Sub(now); left > 0 {
+			return left, false
+		}
+		b.state = BreakerHalfOpen
+		return 0, true
+	case BreakerHalfOpen:
+		// The probe is in flight, its outcome is known within the request timeout
+		return time.Second, false
+	}
+	return 0, true
+}
+
+// Recording the outcome of a call let through. The calls cancelled by the caller tell nothing about the provider.
+func (b *breaker) record(ctx context.Context, failed bool, now time.Time) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case failed && errors.Is(ctx.Err(), context.Canceled):
+		if b.state == BreakerHalfOpen {
+			// Probing again on the next call
+			b.state = BreakerOpen
+		}
+	case failed:
+		b.failures++
+		if b.state == BreakerHalfOpen || b.failures >= b.opts.FailureThreshold {
+			b.state, b.openedAt = BreakerOpen, now
+		}
+	default:
+		b.state, b.failures = BreakerClosed, 0
+	}
+}
+
+// Reporting the open breaker as half-open once the cooldown is over, the next call probes the provider. The
+// transition itself only happens on that call, which may never come when the probes take the instance out of rotation.
+func (b *breaker) status(now time.Time) BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := BreakerStatus{Name: b.name, State: b.state, Failures: b.failures}
+	if b.state == BreakerOpen && !now.Before(b.openedAt.Add(b.opts.Cooldown)) {
+		s.State = BreakerHalfOpen
+	}
+	if b.state != BreakerClosed {
+		openedAt := b.openedAt
+		s.OpenedAt = &openedAt
+	}
+	return s
+}
+
+func breakerOpenError(retryAfter time.Duration) *ProviderError {
+	return &ProviderError{
+		StatusCode: http.StatusServiceUnavailable,
+		Message:    "reCAPTCHA is unavailable, the circuit breaker is open",
+		Err:        ErrBreakerOpen,
+		RetryAfter: retryAfter,
+	}
+}
+
+// Breaker reports the state of the circuit breaker, false when it is disabled. The breaker is reported half-open
+// once its cooldown is over, even before the next call probes the provider.
+func (v *Verifier) Breaker() (BreakerStatus, bool) {
+	if v.breaker == nil {
+		return BreakerStatus{}, false
+	}
+	return v.breaker.status(time.Now()), true
+}
+
+// Failures of siteverify: unreachable, throttled, unavailable or answering garbage
+func siteVerifyFailure(err error) bool {
+	var providerErr *ProviderError
+	return errors.As(err, &providerErr) &&
+		(providerErr.StatusCode == http.StatusBadGateway || providerErr.StatusCode == http.StatusServiceUnavailable)
+}
+
+// Failures of reCAPTCHA Enterprise, the refused requests and the configuration errors are not counted
+func enterpriseFailure(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Internal, codes.Unknown:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,134 @@
+package verify
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestBreaker(t *testing.T) {
+	now := time.Now()
+	b := newBreaker("siteverify", BreakerOptions{FailureThreshold: 2, Cooldown: 10 * time.Second})
+	ctx := context.Background()
+	assertState := func(state BreakerState, now time.Time) {
+		t.Helper()
+		if got := b.status(now).State; got != state {
+			t.Fatalf("got state %s, want %s", got, state)
+		}
+	}
+
+	// A success resets the consecutive failures
+	b.record(ctx, true, now)
+	b.record(ctx, false, now)
+	b.record(ctx, true, now)
+	assertState(BreakerClosed, now)
+
+	b.record(ctx, true, now)
+	assertState(BreakerOpen, now)
+	if left, ok := b.allow(now.Add(4 * time.Second)); ok || left != 6*time.Second {
+		t.Fatalf("got allowed %t with %s left, want refused with 6s left", ok, left)
+	}
+	// Reported half-open once the cooldown is over, before any call probes the provider
+	assertState(BreakerHalfOpen, now.Add(10*time.Second))
+
+	// A single probe once the cooldown is over, reopening on failure
+	if _, ok := b.allow(now.Add(10 * time.Second)); !ok {
+		t.Fatal("got the probe refused after the cooldown")
+	}
+	assertState(BreakerHalfOpen, now.Add(10*time.Second))
+	if _, ok := b.allow(now.Add(10 * time.Second)); ok {
+		t.Fatal("got a second call allowed while probing")
+	}
+	b.record(ctx, true, now.Add(11*time.Second))
+	assertState(BreakerOpen, now.Add(11*time.Second))
+	if _, ok := b.allow(now.Add(15 * time.Second)); ok {
+		t.Fatal("got a call allowed after the failed probe")
+	}
+
+	// A probe cancelled by the caller is retried by the next call
+	if _, ok := b.allow(now.Add(21 * time.Second)); !ok {
+		t.Fatal("got the probe refused after the cooldown")
+	}
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	b.record(cancelled, true, now.Add(21*time.Second))
+	// Open since the failed probe, with its cooldown over
+	assertState(BreakerHalfOpen, now.Add(21*time.Second))
+	if _, ok := b.allow(now.Add(21 * time.Second)); !ok {
+		t.Fatal("got the probe refused after the cancelled one")
+	}
+	b.record(ctx, false, now.Add(22*time.Second))
+	assertState(BreakerClosed, now.Add(22*time.Second))
+	if status := b.status(now.Add(22 * time.Second)); status.Failures != 0 || status.OpenedAt != nil {
+		t.Errorf("got %+v after the successful probe", status)
+	}
+
+	if newBreaker("siteverify", BreakerOptions{}) != nil {
+		t.Error("got a breaker without failure threshold")
+	}
+}
+
+func TestSiteVerifyBreaker(t *testing.T) {
+	calls := 0
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer api.Close()
+	v := newSiteVerifyVerifier(t, api.URL, Options{Breaker: BreakerOptions{FailureThreshold: 2, Cooldown: time.Minute}})
+
+	for i := 0; i < 3; i++ {
+		_, err := v.Verify(context.Background(), Request{SiteKey: "secret", Token: "token"})
+		var providerErr *ProviderError
+		if !errors.As(err, &providerErr) || providerErr.StatusCode != http.StatusServiceUnavailable {
+			t.Fatalf("got %v, want a provider error with status 503", err)
+		}
+		if open := errors.Is(err, ErrBreakerOpen); open != (i == 2) || (open && providerErr.RetryAfter <= 0) {
+			t.Fatalf("call %d: got %v with retry after %s", i, err, providerErr.RetryAfter)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("got %d calls to siteverify, want 2", calls)
+	}
+	if status, ok := v.Breaker(); !ok || status.Name != "siteverify" || status.State != BreakerOpen {
+		t.Errorf("got breaker %+v", status)
+	}
+}
+
+func TestEnterpriseBreaker(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		open bool
+	}{
+		{name: "unavailable", err: status.Error(codes.Unavailable, "unavailable"), open: true},
+		{name: "deadline exceeded", err: context.DeadlineExceeded, open: true},
+		{name: "invalid argument", err: status.Error(codes.InvalidArgument, "invalid site key")},
+		{name: "permission denied", err: status.Error(codes.PermissionDenied, "permission denied")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakeAssessmentClient{err: tt.err}
+			v := newEnterpriseVerifier(t, client, Options{Breaker: BreakerOptions{FailureThreshold: 1, Cooldown: time.Minute}})
+			for i := 0; i < 2; i++ {
+				_, err := v.Verify(context.Background(), Request{SiteKey: "site-key", Token: "token"})
+				var providerErr *ProviderError
+				if !errors.As(err, &providerErr) {
+					t.Fatalf("got %v, want a provider error", err)
+				}
+			}
+			if want := map[bool]int{true: 1, false: 2}[tt.open]; len(client.requests) != want {
+				t.Errorf("got %d assessments, want %d", len(client.requests), want)
+			}
+			if status, _ := v.Breaker(); (status.State == BreakerOpen) != tt.open {
+				t.Errorf("got state %s, want open %t", status.State, tt.open)
+			}
+		})
+	}
+}
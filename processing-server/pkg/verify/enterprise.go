@@ -0,0 +1,288 @@
+package verify
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	recaptchaenterprise "cloud.google.com/go/recaptchaenterprise/v2/apiv1"
+	recaptchaenterprisepb "cloud.google.com/go/recaptchaenterprise/v2/apiv1/recaptchaenterprisepb"
+	"github.com/googleapis/gax-go/v2"
+	"google.golang.org/api/option"
+)
+
+const defaultWafSessionMaxAge = 30 * time.Minute
+
+// DefaultTransactionRiskThreshold is the transaction risk denying the request when no threshold is set.
+const DefaultTransactionRiskThreshold = 0.5
+
+// EnterpriseOptions of the reCAPTCHA Enterprise provider.
+type EnterpriseOptions struct {
+	ProjectId string
+	// Account Defender, the account ID is only sent when a secret is set
+	AccountIdSecret []byte
+	// Labels denying the request, e.g. SUSPICIOUS_LOGIN_ACTIVITY, case-insensitive
+	DeniedAccountDefenderLabels []string
+	// Fraud Prevention, only applied when transaction data is sent. The transaction risk at or above it denies the
+	// request, DefaultTransactionRiskThreshold when zero, while a threshold above 1 never denies.
+	TransactionRiskThreshold float64
+	// Client creating the assessments, a client is created on first use and kept when nil
+	Client AssessmentClient
+	// Options of the client created by the verifier, such as another endpoint
+	ClientOptions []option.ClientOption
+}
+
+// AssessmentClient creates the assessments, implemented by the reCAPTCHA Enterprise client.
+type AssessmentClient interface {
+	CreateAssessment(ctx context.Context, req *recaptchaenterprisepb.CreateAssessmentRequest, opts ...gax.CallOption) (*recaptchaenterprisepb.Assessment, error)
+}
+
+// Creating the client on first use, with the application default credentials unless set by the options, and
+// keeping it for the next calls. A failed creation is retried on the next call.
+type sharedClient struct {
+	opts   []option.ClientOption
+	mu     sync.Mutex
+	client *recaptchaenterprise.Client
+}
+
+func (s *sharedClient) get() (*recaptchaenterprise.Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client == nil {
+		// Never bound to the context of a call, the client outlives it
+		c, err := recaptchaenterprise.NewClient(context.Background(), s.opts...)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create recaptcha enterprise client: %w", err)
+		}
+		s.client = c
+	}
+	return s.client, nil
+}
+
+func (s *sharedClient) CreateAssessment(ctx context.Context, req *recaptchaenterprisepb.CreateAssessmentRequest, opts ...gax.CallOption) (*recaptchaenterprisepb.Assessment, error) {
+	c, err := s.get()
+	if err != nil {
+		return nil, err
+	}
+	return c.CreateAssessment(ctx, req, opts...)
+}
+
+func (s *sharedClient) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client == nil {
+		return nil
+	}
+	err := s.client.Close()
+	s.client = nil
+	return err
+}
+
+// EnterpriseClient returns the reCAPTCHA Enterprise client of the assessments, e.g. to search the related
+// account groups, unless another client was given in the options.
+func (v *Verifier) EnterpriseClient() (*recaptchaenterprise.Client, error) {
+	switch c := v.client.(type) {
+	case *sharedClient:
+		return c.get()
+	case *recaptchaenterprise.Client:
+		return c, nil
+	}
+	return nil, errors.New("no reCAPTCHA Enterprise client")
+}
+
+// Close the client created by the verifier, the clients given in the options are left to their owner.
+func (v *Verifier) Close() error {
+	if c, ok := v.client.(*sharedClient); ok {
+		return c.close()
+	}
+	return nil
+}
+
+// Assess creates a raw assessment in the project, e.g. for a password leak verification (Enterprise only).
+// While the circuit breaker is open, a ProviderError is returned without calling reCAPTCHA.
+func (v *Verifier) Assess(ctx context.Context, assessment *recaptchaenterprisepb.Assessment) (*recaptchaenterprisepb.Assessment, error) {
+	if v.opts.Enterprise == nil {
+		return nil, fmt.Errorf("assessments require reCAPTCHA Enterprise")
+	}
+	if retryAfter, ok := v.breaker.allow(time.Now()); !ok {
+		return nil, breakerOpenError(retryAfter)
+	}
+	resp, err := v.client.CreateAssessment(ctx, &recaptchaenterprisepb.CreateAssessmentRequest{
+		// See https://pkg.go.dev/cloud.google.com/go/recaptchaenterprise/v2/apiv1/recaptchaenterprisepb#CreateAssessmentRequest
+		Parent:     fmt.Sprintf("projects/%s", v.opts.Enterprise.ProjectId),
+		Assessment: assessment,
+	})
+	v.breaker.record(ctx, enterpriseFailure(err), time.Now())
+	return resp, err
+}
+
+// AccountDefender tells whether the account IDs are hashed and sent to Account Defender.
+func (v *Verifier) AccountDefender() bool {
+	return v.opts.Enterprise != nil && len(v.opts.Enterprise.AccountIdSecret) > 0
+}
+
+// The zero value would deny every transaction, the risk being at least zero
+func (v *Verifier) transactionRiskThreshold() float64 {
+	if v.opts.Enterprise.TransactionRiskThreshold != 0 {
+		return v.opts.Enterprise.TransactionRiskThreshold
+	}
+	return DefaultTransactionRiskThreshold
+}
+
+// HashAccountId hashes the account ID with HMAC-SHA256, so that the raw identifier never leaves the service.
+func (v *Verifier) HashAccountId(accountId string) string {
+	mac := hmac.New(sha256.New, v.opts.Enterprise.AccountIdSecret)
+	mac.Write([]byte(accountId))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (v *Verifier) verifyEnterprise(ctx context.Context, req Request) (Verdict, error) {
+	policy := v.SitePolicy(req.SiteKey)
+	event := &recaptchaenterprisepb.Event{
+		Token:              req.Token,
+		SiteKey:            req.SiteKey,
+		WafTokenAssessment: req.TokenType == TokenWafAction || req.TokenType == TokenWafSession,
+		Express:            req.TokenType == TokenExpress,
+		UserAgent:          req.UserAgent,
+		UserIpAddress:      req.UserIp,
+		Headers:            req.Headers,
+	}
+	switch req.TokenType {
+	case TokenWafAction:
+		event.SiteKey = policy.WafActionSiteKey
+	case TokenWafSession:
+		event.SiteKey = policy.WafSessionSiteKey
+	}
+	if event.SiteKey == "" {
+		return Verdict{}, fmt.Errorf("no site key for the '%s' token", req.TokenType)
+	}
+	if req.AccountId != "" && v.AccountDefender() {
+		event.UserInfo = &recaptchaenterprisepb.UserInfo{
+			AccountId: v.HashAccountId(req.AccountId),
+		}
+	}
+	if req.Transaction != nil {
+		event.TransactionData = req.Transaction.toProto()
+	}
+	resp, err := v.Assess(ctx, &recaptchaenterprisepb.Assessment{
+		Event: event,
+	})
+	var providerErr *ProviderError
+	if errors.As(err, &providerErr) {
+		return Verdict{}, err
+	}
+	if err != nil {
+		return Verdict{}, &ProviderError{
+			StatusCode: http.StatusBadGateway,
+			Message:    "unable to process the recaptcha enterprise response",
+			Err:        err,
+		}
+	}
+	verdict, err := v.confirmEnterpriseAssessment(req, policy, resp)
+	if err != nil {
+		return Verdict{}, err
+	}
+	verdict.AssessmentId = resp.GetName()
+	return verdict, nil
+}
+
+// Managing assessment from reCAPTCHA Enterprise
+func (v *Verifier) confirmEnterpriseAssessment(req Request, policy SitePolicy, resp *recaptchaenterprisepb.Assessment) (Verdict, error) {
+	if req.TokenType == TokenExpress {
+		return v.confirmExpressAssessment(policy, resp)
+	}
+
+	if !resp.GetTokenProperties().GetValid() {
+		return Verdict{}, refuse(ErrInvalidToken, "token is invalid: '%d'", int(resp.GetTokenProperties().GetInvalidReason()))
+	}
+
+	// A checkbox is either solved or not, there is no score to check
+	if req.TokenType == TokenCheckbox {
+		return Verdict{Action: resp.GetTokenProperties().GetAction(), Outcome: OutcomeAllow}, nil
+	}
+
+	if req.TokenType == TokenWafSession {
+		if err := policy.checkWafSessionFreshness(resp, time.Now()); err != nil {
+			return Verdict{}, err
+		}
+	} else {
+		var createTime time.Time
+		if ts := resp.GetTokenProperties().GetCreateTime(); ts != nil {
+			createTime = ts.AsTime()
+		}
+		if err := v.checkTokenAge(policy, createTime, time.Now()); err != nil {
+			return Verdict{}, err
+		}
+	}
+	// The actions of the WAF tokens are set by the WAF, not by the page
+	if req.TokenType == TokenScore {
+		if err := policy.checkAction(resp.GetTokenProperties().GetAction()); err != nil {
+			return Verdict{}, err
+		}
+	}
+
+	score := float64(resp.GetRiskAnalysis().GetScore())
+	if err := policy.checkReasons(resp.GetRiskAnalysis().GetReasons(), score); err != nil {
+		return Verdict{}, err
+	}
+
+	if fraudPrevention := resp.GetFraudPreventionAssessment(); fraudPrevention != nil {
+		transactionRisk := float64(fraudPrevention.GetTransactionRisk())
+		if threshold := v.transactionRiskThreshold(); transactionRisk >= threshold {
+			return Verdict{}, refuse(ErrRiskDenied, "received transaction risk '%f', while expecting maximum '%f'", transactionRisk, threshold)
+		}
+	}
+
+	for _, label := range resp.GetAccountDefenderAssessment().GetLabels() {
+		if v.deniedLabels[label] {
+			return Verdict{}, refuse(ErrRiskDenied, "account defender label '%s' is denied", label)
+		}
+	}
+
+	return policy.scoreVerdict(resp.GetTokenProperties().GetAction(), score, v.opts.Threshold)
+}
+
+// Parsing the denied account defender labels, an unknown label would never deny a request
+func parseAccountDefenderLabels(labels []string) (map[recaptchaenterprisepb.AccountDefenderAssessment_AccountDefenderLabel]bool, error) {
+	denied := make(map[recaptchaenterprisepb.AccountDefenderAssessment_AccountDefenderLabel]bool, len(labels))
+	for _, label := range labels {
+		value, ok := recaptchaenterprisepb.AccountDefenderAssessment_AccountDefenderLabel_value[strings.ToUpper(strings.TrimSpace(label))]
+		if !ok || value == int32(recaptchaenterprisepb.AccountDefenderAssessment_ACCOUNT_DEFENDER_LABEL_UNSPECIFIED) {
+			return nil, fmt.Errorf("unknown account defender label '%s'", label)
+		}
+		denied[recaptchaenterprisepb.AccountDefenderAssessment_AccountDefenderLabel(value)] = true
+	}
+	return denied, nil
+}
+
+// Managing express assessment from reCAPTCHA Enterprise, there is no token to validate
+func (v *Verifier) confirmExpressAssessment(policy SitePolicy, resp *recaptchaenterprisepb.Assessment) (Verdict, error) {
+	score := float64(resp.GetRiskAnalysis().GetScore())
+	if err := policy.checkReasons(resp.GetRiskAnalysis().GetReasons(), score); err != nil {
+		return Verdict{}, err
+	}
+	return policy.scoreVerdict("", score, v.expressThreshold(policy))
+}
+
+// Session tokens are reused across requests, so rejecting the ones older than the allowed age
+func (p SitePolicy) checkWafSessionFreshness(resp *recaptchaenterprisepb.Assessment, now time.Time) error {
+	createTime := resp.GetTokenProperties().GetCreateTime()
+	if createTime == nil {
+		return refuse(ErrInvalidToken, "session token has no creation time")
+	}
+	maxAge := time.Duration(p.WafSessionMaxAge)
+	if maxAge == 0 {
+		maxAge = defaultWafSessionMaxAge
+	}
+	if age := now.Sub(createTime.AsTime()); age > maxAge {
+		return refuse(ErrInvalidToken, "session token is '%s' old, while expecting maximum '%s'", age.Round(time.Second), maxAge)
+	}
+	return nil
+}
@@ -0,0 +1,310 @@
+package verify
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	recaptchaenterprisepb "cloud.google.com/go/recaptchaenterprise/v2/apiv1/recaptchaenterprisepb"
+	"github.com/googleapis/gax-go/v2"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// fakeAssessmentClient answers with a canned assessment, recording the requests
+type fakeAssessmentClient struct {
+	assessment *recaptchaenterprisepb.Assessment
+	err        error
+	requests   []*recaptchaenterprisepb.CreateAssessmentRequest
+}
+
+func (c *fakeAssessmentClient) CreateAssessment(ctx context.Context, req *recaptchaenterprisepb.CreateAssessmentRequest, opts ...gax.CallOption) (*recaptchaenterprisepb.Assessment, error) {
+	c.requests = append(c.requests, req)
+	return c.assessment, c.err
+}
+
+func newEnterpriseVerifier(t *testing.T, client AssessmentClient, opts Options) *Verifier {
+	t.Helper()
+	if opts.Enterprise == nil {
+		opts.Enterprise = &EnterpriseOptions{}
+	}
+	opts.Enterprise.ProjectId = "project"
+	opts.Enterprise.Client = client
+	if opts.Threshold == 0 {
+		opts.Threshold = 0.5
+	}
+	v, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+// Assessment of a valid token created now, with the score and the reasons
+func assessment(score float32, reasons ...recaptchaenterprisepb.RiskAnalysis_ClassificationReason) *recaptchaenterprisepb.Assessment {
+	return &recaptchaenterprisepb.Assessment{
+		Name: "projects/project/assessments/1",
+		TokenProperties: &recaptchaenterprisepb.TokenProperties{
+			Valid:      true,
+			Action:     "submit",
+			CreateTime: timestamppb.Now(),
+		},
+		RiskAnalysis: &recaptchaenterprisepb.RiskAnalysis{Score: score, Reasons: reasons},
+	}
+}
+
+func TestConfirmEnterpriseAssessment(t *testing.T) {
+	tests := []struct {
+		name       string
+		opts       Options
+		tokenType  TokenType
+		assessment func(a *recaptchaenterprisepb.Assessment)
+		score      float32
+		outcome    Outcome
+		err        any
+	}{
+		{
+			name:    "above threshold",
+			score:   0.9,
+			outcome: OutcomeAllow,
+		},
+		{
+			name:  "equal to threshold",
+			score: 0.5,
+			err:   "received score '0.500000' for action 'submit', which is denied",
+		},
+		{
+			name:  "invalid token",
+			score: 0.9,
+			assessment: func(a *recaptchaenterprisepb.Assessment) {
+				a.TokenProperties = &recaptchaenterprisepb.TokenProperties{InvalidReason: recaptchaenterprisepb.TokenProperties_DUPE}
+			},
+			err: "token is invalid: '4'",
+		},
+		{
+			name:      "checkbox without score",
+			tokenType: TokenCheckbox,
+			outcome:   OutcomeAllow,
+		},
+		{
+			name:  "expired token",
+			opts:  Options{MaxTokenAge: time.Minute},
+			score: 0.9,
+			assessment: func(a *recaptchaenterprisepb.Assessment) {
+				a.TokenProperties.CreateTime = timestamppb.New(time.Now().Add(-time.Hour))
+			},
+			err: &TokenExpiredError{},
+		},
+		{
+			name:  "denied reason",
+			opts:  Options{SitePolicies: map[string]SitePolicy{DefaultSitePolicyKey: {DenyReasons: []string{"AUTOMATION"}}}},
+			score: 0.9,
+			assessment: func(a *recaptchaenterprisepb.Assessment) {
+				a.RiskAnalysis.Reasons = []recaptchaenterprisepb.RiskAnalysis_ClassificationReason{recaptchaenterprisepb.RiskAnalysis_AUTOMATION}
+			},
+			err: &ReasonsError{},
+		},
+		{
+			name: "escalated reason below the escalated threshold",
+			opts: Options{SitePolicies: map[string]SitePolicy{DefaultSitePolicyKey: {
+				EscalateReasons:    []string{"UNEXPECTED_ENVIRONMENT"},
+				EscalatedThreshold: 0.8,
+			}}},
+			score: 0.7,
+			assessment: func(a *recaptchaenterprisepb.Assessment) {
+				a.RiskAnalysis.Reasons = []recaptchaenterprisepb.RiskAnalysis_ClassificationReason{recaptchaenterprisepb.RiskAnalysis_UNEXPECTED_ENVIRONMENT}
+			},
+			err: &ReasonsError{},
+		},
+		{
+			name: "escalated reason above the escalated threshold",
+			opts: Options{SitePolicies: map[string]SitePolicy{DefaultSitePolicyKey: {
+				EscalateReasons:    []string{"UNEXPECTED_ENVIRONMENT"},
+				EscalatedThreshold: 0.8,
+			}}},
+			score: 0.9,
+			assessment: func(a *recaptchaenterprisepb.Assessment) {
+				a.RiskAnalysis.Reasons = []recaptchaenterprisepb.RiskAnalysis_ClassificationReason{recaptchaenterprisepb.RiskAnalysis_UNEXPECTED_ENVIRONMENT}
+			},
+			outcome: OutcomeAllow,
+		},
+		{
+			name:  "transaction risk",
+			score: 0.9,
+			assessment: func(a *recaptchaenterprisepb.Assessment) {
+				a.FraudPreventionAssessment = &recaptchaenterprisepb.FraudPreventionAssessment{TransactionRisk: 0.5}
+			},
+			err: "received transaction risk '0.500000', while expecting maximum '0.500000'",
+		},
+		{
+			name:  "action mismatch",
+			opts:  Options{SitePolicies: map[string]SitePolicy{DefaultSitePolicyKey: {Actions: []string{"login"}}}},
+			score: 0.9,
+			err:   ErrActionMismatch,
+		},
+		{
+			name:    "expected action",
+			opts:    Options{SitePolicies: map[string]SitePolicy{DefaultSitePolicyKey: {Actions: []string{"submit"}}}},
+			score:   0.9,
+			outcome: OutcomeAllow,
+		},
+		{
+			name:  "transaction risk below the default threshold",
+			score: 0.9,
+			assessment: func(a *recaptchaenterprisepb.Assessment) {
+				a.FraudPreventionAssessment = &recaptchaenterprisepb.FraudPreventionAssessment{TransactionRisk: 0.2}
+			},
+			outcome: OutcomeAllow,
+		},
+		{
+			name:  "transaction risk with a threshold above 1",
+			opts:  Options{Enterprise: &EnterpriseOptions{TransactionRiskThreshold: 1.1}},
+			score: 0.9,
+			assessment: func(a *recaptchaenterprisepb.Assessment) {
+				a.FraudPreventionAssessment = &recaptchaenterprisepb.FraudPreventionAssessment{TransactionRisk: 1}
+			},
+			outcome: OutcomeAllow,
+		},
+		{
+			name:  "denied account defender label",
+			opts:  Options{Enterprise: &EnterpriseOptions{DeniedAccountDefenderLabels: []string{"SUSPICIOUS_LOGIN_ACTIVITY"}}},
+			score: 0.9,
+			assessment: func(a *recaptchaenterprisepb.Assessment) {
+				a.AccountDefenderAssessment = &recaptchaenterprisepb.AccountDefenderAssessment{Labels: []recaptchaenterprisepb.AccountDefenderAssessment_AccountDefenderLabel{
+					recaptchaenterprisepb.AccountDefenderAssessment_SUSPICIOUS_LOGIN_ACTIVITY,
+				}}
+			},
+			err: ErrRiskDenied,
+		},
+		{
+			name:  "denied account defender label in lower case",
+			opts:  Options{Enterprise: &EnterpriseOptions{DeniedAccountDefenderLabels: []string{" suspicious_login_activity"}}},
+			score: 0.9,
+			assessment: func(a *recaptchaenterprisepb.Assessment) {
+				a.AccountDefenderAssessment = &recaptchaenterprisepb.AccountDefenderAssessment{Labels: []recaptchaenterprisepb.AccountDefenderAssessment_AccountDefenderLabel{
+					recaptchaenterprisepb.AccountDefenderAssessment_SUSPICIOUS_LOGIN_ACTIVITY,
+				}}
+			},
+			err: ErrRiskDenied,
+		},
+		{
+			name:      "stale waf session token",
+			opts:      Options{SitePolicies: map[string]SitePolicy{DefaultSitePolicyKey: {WafSessionSiteKey: "session-key"}}},
+			tokenType: TokenWafSession,
+			score:     0.9,
+			assessment: func(a *recaptchaenterprisepb.Assessment) {
+				a.TokenProperties.CreateTime = timestamppb.New(time.Now().Add(-time.Hour))
+			},
+			err: "session token is '1h0m0s' old, while expecting maximum '30m0s'",
+		},
+		{
+			name:      "waf token without waf site key",
+			tokenType: TokenWafAction,
+			score:     0.9,
+			err:       "no site key for the 'waf-action' token",
+		},
+		{
+			name:      "express assessment",
+			tokenType: TokenExpress,
+			score:     0.6,
+			assessment: func(a *recaptchaenterprisepb.Assessment) {
+				a.TokenProperties = nil
+			},
+			outcome: OutcomeAllow,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := assessment(tt.score)
+			if tt.assessment != nil {
+				tt.assessment(a)
+			}
+			client := &fakeAssessmentClient{assessment: a}
+			v := newEnterpriseVerifier(t, client, tt.opts)
+			req := Request{SiteKey: "site-key", Token: "token", TokenType: tt.tokenType}
+			if tt.tokenType == TokenExpress {
+				req.Token = ""
+			}
+			verdict, err := v.Verify(context.Background(), req)
+			assertError(t, err, tt.err)
+			if tt.err != nil {
+				return
+			}
+			if verdict.Outcome != tt.outcome {
+				t.Errorf("got outcome %q, want %q", verdict.Outcome, tt.outcome)
+			}
+			if verdict.AssessmentId != a.Name {
+				t.Errorf("got assessment %q, want %q", verdict.AssessmentId, a.Name)
+			}
+		})
+	}
+}
+
+func TestDeniedAccountDefenderLabels(t *testing.T) {
+	tests := []struct {
+		labels []string
+		err    bool
+	}{
+		{labels: nil},
+		{labels: []string{"SUSPICIOUS_LOGIN_ACTIVITY", "related_accounts_number_high"}},
+		{labels: []string{"SUSPICIOUS_LOGIN"}, err: true},
+		{labels: []string{"ACCOUNT_DEFENDER_LABEL_UNSPECIFIED"}, err: true},
+		{labels: []string{""}, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.labels, ","), func(t *testing.T) {
+			_, err := New(Options{Enterprise: &EnterpriseOptions{ProjectId: "project", DeniedAccountDefenderLabels: tt.labels}})
+			if (err != nil) != tt.err {
+				t.Errorf("got error %v, want an error %t", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestVerifyEnterpriseRequest(t *testing.T) {
+	client := &fakeAssessmentClient{assessment: assessment(0.9)}
+	v := newEnterpriseVerifier(t, client, Options{
+		Enterprise:   &EnterpriseOptions{AccountIdSecret: []byte("secret")},
+		SitePolicies: map[string]SitePolicy{"site-key": {WafActionSiteKey: "waf-key"}},
+	})
+	_, err := v.Verify(context.Background(), Request{
+		SiteKey:   "site-key",
+		Token:     "token",
+		TokenType: TokenWafAction,
+		AccountId: "user@example.com",
+		UserAgent: "agent",
+		UserIp:    "192.0.2.1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(client.requests) != 1 {
+		t.Fatalf("got %d requests, want 1", len(client.requests))
+	}
+	req := client.requests[0]
+	if req.Parent != "projects/project" {
+		t.Errorf("got parent %q", req.Parent)
+	}
+	event := req.Assessment.Event
+	if event.SiteKey != "waf-key" || !event.WafTokenAssessment {
+		t.Errorf("got site key %q and waf %t, want the waf key", event.SiteKey, event.WafTokenAssessment)
+	}
+	if got := event.GetUserInfo().GetAccountId(); got != v.HashAccountId("user@example.com") || got == "user@example.com" {
+		t.Errorf("got account ID %q, want the hashed one", got)
+	}
+	if event.UserAgent != "agent" || event.UserIpAddress != "192.0.2.1" {
+		t.Errorf("got user agent %q and IP %q", event.UserAgent, event.UserIpAddress)
+	}
+}
+
+func TestVerifyEnterpriseProviderError(t *testing.T) {
+	client := &fakeAssessmentClient{err: errors.New("unavailable")}
+	v := newEnterpriseVerifier(t, client, Options{})
+	_, err := v.Verify(context.Background(), Request{SiteKey: "site-key", Token: "token"})
+	var providerErr *ProviderError
+	if !errors.As(err, &providerErr) || providerErr.StatusCode != http.StatusBadGateway {
+		t.Fatalf("got %v, want a provider error with status 502", err)
+	}
+}
@@ -0,0 +1,87 @@
+package verify
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/pseudonator/recaptcha-processing-server/pkg/problem"
+)
+
+// DefaultTokenHeader carries the token of the requests verified by the middleware.
+const DefaultTokenHeader = "x-recaptcha-token"
+
+// Retry hint of the requests cancelled in the tarpit
+const tarpitRetryAfter = time.Second
+
+type contextKey struct{}
+
+// MiddlewareOptions of the middleware for a route.
+type MiddlewareOptions struct {
+	SiteKey string
+	// Header carrying the token, DefaultTokenHeader when empty
+	TokenHeader string
+	// Creating token-less express assessments instead of reading the token (Enterprise only)
+	Express bool
+	// Writes the response of the refused requests, 403 without details when nil.
+	// A ChallengeError, a TokenExpiredError or a ProviderError can be told apart with errors.As.
+	OnError func(w http.ResponseWriter, r *http.Request, err error)
+}
+
+// Middleware verifies the token of the requests, refusing the ones without a verdict and delaying
+// the ones in a tarpit band. The verdict is available with FromContext.
+func (v *Verifier) Middleware(opts MiddlewareOptions) func(http.Handler) http.Handler {
+	if opts.TokenHeader == "" {
+		opts.TokenHeader = DefaultTokenHeader
+	}
+	if opts.OnError == nil {
+		opts.OnError = func(w http.ResponseWriter, r *http.Request, err error) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		}
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			req := Request{
+				SiteKey:   opts.SiteKey,
+				Token:     r.Header.Get(opts.TokenHeader),
+				UserAgent: r.UserAgent(),
+				UserIp:    remoteIp(r),
+			}
+			if opts.Express {
+				req.Token = ""
+				req.TokenType = TokenExpress
+			}
+			verdict, err := v.Verify(r.Context(), req)
+			if err != nil {
+				opts.OnError(w, r, err)
+				return
+			}
+			if verdict.Outcome == OutcomeTarpit {
+				select {
+				case <-time.After(verdict.Delay):
+				case <-r.Context().Done():
+					// Never left without a response, the client may retry once the tarpit is over
+					problem.Write(w, r, problem.New(http.StatusServiceUnavailable, problem.CodeTimeout, "request timed out in the tarpit").WithRetryAfter(tarpitRetryAfter))
+					return
+				}
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, verdict)))
+		})
+	}
+}
+
+// FromContext returns the verdict of the request verified by the middleware.
+func FromContext(ctx context.Context) (Verdict, bool) {
+	verdict, ok := ctx.Value(contextKey{}).(Verdict)
+	return verdict, ok
+}
+
+// The proxy headers are not trusted by the middleware, the remote address is used as it is
+func remoteIp(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
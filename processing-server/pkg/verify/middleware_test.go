@@ -0,0 +1,42 @@
+package verify
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pseudonator/recaptcha-processing-server/pkg/problem"
+)
+
+func TestMiddlewareTarpitCancelled(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"success": true, "score": 0.2, "action": "submit", "challenge_ts": "2024-01-01T00:00:00Z"}`))
+	}))
+	defer srv.Close()
+	v := newSiteVerifyVerifier(t, srv.URL, Options{SitePolicies: map[string]SitePolicy{DefaultSitePolicyKey: {Bands: []ScoreBand{
+		{MinScore: 0, Outcome: OutcomeTarpit, Delay: Duration(2 * time.Second)},
+		{MinScore: 0.7, Outcome: OutcomeAllow},
+	}}}})
+	handler := v.Middleware(MiddlewareOptions{SiteKey: "secret"})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("the request cancelled in the tarpit reached the handler")
+	}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req := httptest.NewRequest(http.MethodPost, "/submit", nil).WithContext(ctx)
+	req.Header.Set(DefaultTokenHeader, "token")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got status %d, want 503", rec.Code)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("no Retry-After header")
+	}
+	if got := rec.Header().Get(problem.CodeHeader); got != string(problem.CodeTimeout) {
+		t.Errorf("got code %q, want %q", got, problem.CodeTimeout)
+	}
+}
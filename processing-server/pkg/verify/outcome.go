@@ -0,0 +1,92 @@
+package verify
+
+import (
+	"fmt"
+	"time"
+)
+
+// Tarpit delays add up to the verification, which has to be answered within the connectionTimeout of the ext auth
+// (3s in the shipped auth config), otherwise the delayed request fails instead of being allowed
+const maxTarpitDelay = 2 * time.Second
+
+// Outcome of a verification, picked from the score bands.
+type Outcome string
+
+const (
+	OutcomeAllow     Outcome = "allow"
+	OutcomeChallenge Outcome = "challenge"
+	OutcomeTarpit    Outcome = "tarpit"
+	OutcomeDeny      Outcome = "deny"
+)
+
+// ScoreBand maps the scores from MinScore upwards to an outcome, until the next band.
+type ScoreBand struct {
+	MinScore float64 `json:"minScore"`
+	Outcome  Outcome `json:"outcome"`
+	// Artificial delay before allowing a request in the tarpit band
+	Delay Duration `json:"delay,omitempty"`
+}
+
+// ChallengeError is returned when the score falls in a challenge band,
+// the client is expected to show a challenge such as a v2 checkbox.
+type ChallengeError struct {
+	Score float64
+}
+
+func (e *ChallengeError) Error() string {
+	return fmt.Sprintf("received score '%f', which requires a challenge", e.Score)
+}
+
+func (b ScoreBand) validate() error {
+	if b.MinScore < 0 || b.MinScore > 1 {
+		return fmt.Errorf("minScore must be within [0, 1]")
+	}
+	switch b.Outcome {
+	case OutcomeAllow, OutcomeChallenge, OutcomeDeny:
+	case OutcomeTarpit:
+		if b.Delay <= 0 || time.Duration(b.Delay) > maxTarpitDelay {
+			return fmt.Errorf("tarpit delay must be within (0, %s]", maxTarpitDelay)
+		}
+	default:
+		return fmt.Errorf("unknown outcome '%s'", b.Outcome)
+	}
+	return nil
+}
+
+// Picking the band of the score, the bands of the action take precedence over the ones of the site key.
+// Without any band, the scores above the threshold are allowed and the rest denied.
+func (p SitePolicy) scoreBand(action string, score float64, threshold float64) ScoreBand {
+	bands := p.Bands
+	if actionBands, ok := p.ActionBands[action]; ok {
+		bands = actionBands
+	}
+	if len(bands) == 0 {
+		if score > threshold {
+			return ScoreBand{MinScore: threshold, Outcome: OutcomeAllow}
+		}
+		return ScoreBand{Outcome: OutcomeDeny}
+	}
+
+	var matched *ScoreBand
+	for i := range bands {
+		if score >= bands[i].MinScore && (matched == nil || bands[i].MinScore > matched.MinScore) {
+			matched = &bands[i]
+		}
+	}
+	if matched == nil {
+		return ScoreBand{Outcome: OutcomeDeny}
+	}
+	return *matched
+}
+
+// Turning the score into a verdict, or an error when the request has to be challenged or denied
+func (p SitePolicy) scoreVerdict(action string, score float64, threshold float64) (Verdict, error) {
+	band := p.scoreBand(action, score, threshold)
+	switch band.Outcome {
+	case OutcomeDeny:
+		return Verdict{}, refuse(ErrScoreTooLow, "received score '%f' for action '%s', which is denied", score, action)
+	case OutcomeChallenge:
+		return Verdict{}, &ChallengeError{Score: score}
+	}
+	return Verdict{Score: score, Action: action, Outcome: band.Outcome, Delay: time.Duration(band.Delay)}, nil
+}
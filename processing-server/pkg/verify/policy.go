@@ -0,0 +1,158 @@
+package verify
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	recaptchaenterprisepb "cloud.google.com/go/recaptchaenterprise/v2/apiv1/recaptchaenterprisepb"
+)
+
+// Site policy applied when the site key has no policy of its own
+const DefaultSitePolicyKey = "*"
+
+// SitePolicy overrides the verification settings of a single site key.
+type SitePolicy struct {
+	// Risk reasons that deny the request whatever the score is
+	DenyReasons []string `json:"denyReasons,omitempty"`
+	// Risk reasons that require the score to be above EscalatedThreshold instead of the threshold
+	EscalateReasons    []string `json:"escalateReasons,omitempty"`
+	EscalatedThreshold float64  `json:"escalatedThreshold,omitempty"`
+	// reCAPTCHA WAF keys used to assess the tokens found in the WAF cookies
+	WafActionSiteKey  string   `json:"wafActionSiteKey,omitempty"`
+	WafSessionSiteKey string   `json:"wafSessionSiteKey,omitempty"`
+	WafSessionMaxAge  Duration `json:"wafSessionMaxAge,omitempty"`
+	// Maximum age of the tokens, overriding MAX_TOKEN_AGE
+	MaxTokenAge Duration `json:"maxTokenAge,omitempty"`
+	// Actions expected from the score tokens, any action when empty
+	Actions []string `json:"actions,omitempty"`
+	// Score bands mapped to outcomes, the bands of the action take precedence over the ones of the site key
+	Bands       []ScoreBand            `json:"bands,omitempty"`
+	ActionBands map[string][]ScoreBand `json:"actionBands,omitempty"`
+	// Token-less express assessments with their own threshold
+	Express          bool    `json:"express,omitempty"`
+	ExpressThreshold float64 `json:"expressThreshold,omitempty"`
+	// Accepting the captcha passes for the requests carrying a transaction or an account ID, which then skip
+	// Fraud Prevention and Account Defender
+	PassSkipsRiskAssessment bool `json:"passSkipsRiskAssessment,omitempty"`
+}
+
+// Duration is a time.Duration read from a JSON string such as "30m".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var v string
+	if err := json.Unmarshal(b, &v); err != nil {
+		return fmt.Errorf("duration must be a string such as \"30m\": %w", err)
+	}
+	parsed, err := time.ParseDuration(v)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// ReasonsError is returned when the assessment is refused because of its risk reasons.
+type ReasonsError struct {
+	Reasons   []string
+	Escalated bool
+	Score     float64
+	Threshold float64
+}
+
+func (e *ReasonsError) Error() string {
+	if e.Escalated {
+		return fmt.Sprintf("risk reasons %v require minimum score '%f', received '%f'", e.Reasons, e.Threshold, e.Score)
+	}
+	return fmt.Sprintf("risk reasons %v are denied", e.Reasons)
+}
+
+// Validate checks that all the configured reasons are known to reCAPTCHA Enterprise.
+func (p SitePolicy) Validate() error {
+	for _, reason := range append(append([]string{}, p.DenyReasons...), p.EscalateReasons...) {
+		if _, ok := recaptchaenterprisepb.RiskAnalysis_ClassificationReason_value[reason]; !ok {
+			return fmt.Errorf("unknown risk reason '%s'", reason)
+		}
+	}
+	if len(p.EscalateReasons) > 0 && (p.EscalatedThreshold <= 0 || p.EscalatedThreshold > 1) {
+		return fmt.Errorf("escalatedThreshold must be within (0, 1] when escalateReasons are set")
+	}
+	if p.ExpressThreshold < 0 || p.ExpressThreshold > 1 {
+		return fmt.Errorf("expressThreshold must be within [0, 1]")
+	}
+	for _, action := range p.Actions {
+		if action == "" {
+			return fmt.Errorf("actions must not be empty")
+		}
+	}
+	for _, band := range p.Bands {
+		if err := band.validate(); err != nil {
+			return fmt.Errorf("invalid band: %w", err)
+		}
+	}
+	for action, bands := range p.ActionBands {
+		for _, band := range bands {
+			if err := band.validate(); err != nil {
+				return fmt.Errorf("invalid band of action '%s': %w", action, err)
+			}
+		}
+	}
+	if p.MaxTokenAge < 0 {
+		return fmt.Errorf("maxTokenAge must not be negative")
+	}
+	if p.WafSessionMaxAge < 0 {
+		return fmt.Errorf("wafSessionMaxAge must not be negative")
+	}
+	return nil
+}
+
+// SitePolicy returns the policy of the site key, falling back to the default policy.
+func (v *Verifier) SitePolicy(siteKey string) SitePolicy {
+	if policy, ok := v.opts.SitePolicies[siteKey]; ok {
+		return policy
+	}
+	return v.opts.SitePolicies[DefaultSitePolicyKey]
+}
+
+// Applying the site policy on the risk reasons, independently of the score threshold
+func (p SitePolicy) checkReasons(reasons []recaptchaenterprisepb.RiskAnalysis_ClassificationReason, score float64) error {
+	if denied := matchReasons(reasons, p.DenyReasons); len(denied) > 0 {
+		return &ReasonsError{Reasons: denied}
+	}
+	if escalated := matchReasons(reasons, p.EscalateReasons); len(escalated) > 0 && p.EscalatedThreshold >= score {
+		return &ReasonsError{Reasons: escalated, Escalated: true, Score: score, Threshold: p.EscalatedThreshold}
+	}
+	return nil
+}
+
+func matchReasons(reasons []recaptchaenterprisepb.RiskAnalysis_ClassificationReason, configured []string) []string {
+	var matched []string
+	for _, reason := range reasons {
+		for _, c := range configured {
+			if strings.EqualFold(reason.String(), c) {
+				matched = append(matched, reason.String())
+				break
+			}
+		}
+	}
+	return matched
+}
+
+// Refusing the tokens generated for another action, e.g. a login token replayed on the checkout
+func (p SitePolicy) checkAction(action string) error {
+	if len(p.Actions) == 0 {
+		return nil
+	}
+	for _, expected := range p.Actions {
+		if action == expected {
+			return nil
+		}
+	}
+	return refuse(ErrActionMismatch, "received action '%s', while expecting one of %v", action, p.Actions)
+}
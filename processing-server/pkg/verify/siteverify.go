@@ -0,0 +1,135 @@
+package verify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// SiteVerifyOptions of the classic reCAPTCHA provider.
+type SiteVerifyOptions struct {
+	// URL of the siteverify API, e.g. https://www.google.com/recaptcha/api/siteverify
+	Api string
+	// HTTP client calling the API, the default client when nil
+	HttpClient *http.Client
+}
+
+// SiteVerifyResponse of the siteverify API.
+type SiteVerifyResponse struct {
+	Success     bool      `json:"success"`               // whether this request was a valid reCAPTCHA token for your site
+	ChallengeTS time.Time `json:"challenge_ts"`          // timestamp of the challenge load (ISO format yyyy-MM-dd'T'HH:mm:ssZZ)
+	Score       *float64  `json:"score,omitempty"`       // the score for this request (0.0 - 1.0)
+	Action      *string   `json:"action,omitempty"`      // the action name for this request (important to verify)
+	Hostname    string    `json:"hostname,omitempty"`    // the hostname of the site where the reCAPTCHA was solved
+	ErrorCodes  []string  `json:"error-codes,omitempty"` // optional
+}
+
+func (v *Verifier) verifySiteVerify(ctx context.Context, req Request) (Verdict, error) {
+	if req.TokenType != TokenScore && req.TokenType != TokenCheckbox {
+		return Verdict{}, fmt.Errorf("'%s' tokens require reCAPTCHA Enterprise", req.TokenType)
+	}
+	resp, err := v.siteVerify(ctx, req.SiteKey, req.Token)
+	if err != nil {
+		return Verdict{}, err
+	}
+	return v.confirm(req, *resp)
+}
+
+// Verifying the token with the reCAPTCHA siteverify API, through the circuit breaker
+func (v *Verifier) siteVerify(ctx context.Context, secret string, token string) (*SiteVerifyResponse, error) {
+	if retryAfter, ok := v.breaker.allow(time.Now()); !ok {
+		return nil, breakerOpenError(retryAfter)
+	}
+	resp, err := v.callSiteVerify(ctx, secret, token)
+	v.breaker.record(ctx, siteVerifyFailure(err), time.Now())
+	return resp, err
+}
+
+func (v *Verifier) callSiteVerify(ctx context.Context, secret string, token string) (*SiteVerifyResponse, error) {
+	form := url.Values{}
+	form.Add("secret", secret)
+	form.Add("response", token)
+
+	verifyCaptchaReq, err := http.NewRequestWithContext(ctx, http.MethodPost, v.opts.SiteVerify.Api, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, &ProviderError{
+			StatusCode: http.StatusInternalServerError,
+			Message:    "unable to create the captcha verification request",
+			Err:        err,
+		}
+	}
+	verifyCaptchaReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	client := v.opts.SiteVerify.HttpClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	verifyCaptchaResp, err := client.Do(verifyCaptchaReq)
+	if err != nil {
+		return nil, &ProviderError{
+			StatusCode: http.StatusBadGateway,
+			Message:    "unable to reach the captcha verification",
+			Err:        err,
+		}
+	}
+	defer verifyCaptchaResp.Body.Close()
+
+	if verifyCaptchaResp.StatusCode != http.StatusOK {
+		// Throttled or unavailable, the request may be retried, any other status is unexpected
+		status := http.StatusBadGateway
+		if verifyCaptchaResp.StatusCode == http.StatusTooManyRequests || verifyCaptchaResp.StatusCode >= http.StatusInternalServerError {
+			status = http.StatusServiceUnavailable
+		}
+		return nil, &ProviderError{
+			StatusCode: status,
+			Message:    fmt.Sprintf("captcha verification answered with status %d", verifyCaptchaResp.StatusCode),
+		}
+	}
+
+	var siteVerifyResp SiteVerifyResponse
+	if err := json.NewDecoder(verifyCaptchaResp.Body).Decode(&siteVerifyResp); err != nil {
+		return nil, &ProviderError{
+			StatusCode: http.StatusBadGateway,
+			Message:    "unable to parse the response from captcha verification",
+			Err:        err,
+		}
+	}
+	return &siteVerifyResp, nil
+}
+
+// Managing response from reCAPTCHA
+func (v *Verifier) confirm(req Request, resp SiteVerifyResponse) (Verdict, error) {
+	if resp.ErrorCodes != nil {
+		return Verdict{}, refuse(ErrInvalidToken, "remote error codes: %v", resp.ErrorCodes)
+	}
+
+	if !resp.Success {
+		return Verdict{}, refuse(ErrInvalidToken, "invalid challenge solution")
+	}
+
+	action := ""
+	if resp.Action != nil {
+		action = *resp.Action
+	}
+	// A checkbox is either solved or not, there is no score to check
+	if req.TokenType == TokenCheckbox {
+		return Verdict{Action: action, Outcome: OutcomeAllow}, nil
+	}
+
+	policy := v.SitePolicy(req.SiteKey)
+	if err := v.checkTokenAge(policy, resp.ChallengeTS, time.Now()); err != nil {
+		return Verdict{}, err
+	}
+	if err := policy.checkAction(action); err != nil {
+		return Verdict{}, err
+	}
+
+	if resp.Score == nil {
+		return Verdict{}, refuse(ErrInvalidToken, "no risk score available")
+	}
+
+	return policy.scoreVerdict(action, *resp.Score, v.opts.Threshold)
+}
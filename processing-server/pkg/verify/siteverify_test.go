@@ -0,0 +1,306 @@
+package verify
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newSiteVerifyVerifier(t *testing.T, api string, opts Options) *Verifier {
+	t.Helper()
+	opts.SiteVerify = &SiteVerifyOptions{Api: api}
+	v, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func float(v float64) *float64 {
+	return &v
+}
+
+func str(v string) *string {
+	return &v
+}
+
+func TestConfirm(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name      string
+		opts      Options
+		tokenType TokenType
+		resp      SiteVerifyResponse
+		outcome   Outcome
+		delay     time.Duration
+		err       any
+	}{
+		{
+			name: "error codes",
+			resp: SiteVerifyResponse{Success: false, ErrorCodes: []string{"invalid-input-response"}},
+			err:  "remote error codes: [invalid-input-response]",
+		},
+		{
+			name: "unsuccessful",
+			resp: SiteVerifyResponse{Success: false},
+			err:  ErrInvalidToken,
+		},
+		{
+			name: "no score",
+			resp: SiteVerifyResponse{Success: true, ChallengeTS: now},
+			err:  "no risk score available",
+		},
+		{
+			name:    "above threshold",
+			resp:    SiteVerifyResponse{Success: true, ChallengeTS: now, Score: float(0.51), Action: str("submit")},
+			outcome: OutcomeAllow,
+		},
+		{
+			name: "equal to threshold",
+			resp: SiteVerifyResponse{Success: true, ChallengeTS: now, Score: float(0.5), Action: str("submit")},
+			err:  "received score '0.500000' for action 'submit', which is denied",
+		},
+		{
+			name: "below threshold",
+			resp: SiteVerifyResponse{Success: true, ChallengeTS: now, Score: float(0.1)},
+			err:  ErrScoreTooLow,
+		},
+		{
+			name:      "checkbox without score",
+			tokenType: TokenCheckbox,
+			resp:      SiteVerifyResponse{Success: true},
+			outcome:   OutcomeAllow,
+		},
+		{
+			name: "expired token",
+			opts: Options{MaxTokenAge: time.Minute},
+			resp: SiteVerifyResponse{Success: true, ChallengeTS: now.Add(-2 * time.Minute), Score: float(0.9)},
+			err:  &TokenExpiredError{},
+		},
+		{
+			name:    "token within the clock skew",
+			opts:    Options{MaxTokenAge: time.Minute, TokenClockSkew: 10 * time.Second},
+			resp:    SiteVerifyResponse{Success: true, ChallengeTS: now.Add(-65 * time.Second), Score: float(0.9)},
+			outcome: OutcomeAllow,
+		},
+		{
+			name: "token without creation time",
+			opts: Options{MaxTokenAge: time.Minute},
+			resp: SiteVerifyResponse{Success: true, Score: float(0.9)},
+			err:  "token has no creation time",
+		},
+		{
+			name: "challenge band",
+			opts: Options{SitePolicies: map[string]SitePolicy{DefaultSitePolicyKey: {Bands: []ScoreBand{
+				{MinScore: 0, Outcome: OutcomeDeny},
+				{MinScore: 0.3, Outcome: OutcomeChallenge},
+				{MinScore: 0.7, Outcome: OutcomeAllow},
+			}}}},
+			resp: SiteVerifyResponse{Success: true, ChallengeTS: now, Score: float(0.3)},
+			err:  &ChallengeError{},
+		},
+		{
+			name: "tarpit band",
+			opts: Options{SitePolicies: map[string]SitePolicy{DefaultSitePolicyKey: {Bands: []ScoreBand{
+				{MinScore: 0, Outcome: OutcomeTarpit, Delay: Duration(time.Second)},
+				{MinScore: 0.7, Outcome: OutcomeAllow},
+			}}}},
+			resp:    SiteVerifyResponse{Success: true, ChallengeTS: now, Score: float(0.2)},
+			outcome: OutcomeTarpit,
+			delay:   time.Second,
+		},
+		{
+			name: "action band",
+			opts: Options{SitePolicies: map[string]SitePolicy{DefaultSitePolicyKey: {ActionBands: map[string][]ScoreBand{
+				"login": {{MinScore: 0.8, Outcome: OutcomeAllow}},
+			}}}},
+			resp: SiteVerifyResponse{Success: true, ChallengeTS: now, Score: float(0.7), Action: str("login")},
+			err:  "received score '0.700000' for action 'login', which is denied",
+		},
+		{
+			name:    "expected action",
+			opts:    Options{SitePolicies: map[string]SitePolicy{DefaultSitePolicyKey: {Actions: []string{"login", "signup"}}}},
+			resp:    SiteVerifyResponse{Success: true, ChallengeTS: now, Score: float(0.9), Action: str("signup")},
+			outcome: OutcomeAllow,
+		},
+		{
+			name: "action mismatch",
+			opts: Options{SitePolicies: map[string]SitePolicy{DefaultSitePolicyKey: {Actions: []string{"login"}}}},
+			resp: SiteVerifyResponse{Success: true, ChallengeTS: now, Score: float(0.9), Action: str("checkout")},
+			err:  ErrActionMismatch,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.opts.Threshold == 0 {
+				tt.opts.Threshold = 0.5
+			}
+			if tt.tokenType == "" {
+				tt.tokenType = TokenScore
+			}
+			v := newSiteVerifyVerifier(t, "http://localhost", tt.opts)
+			verdict, err := v.confirm(Request{SiteKey: "secret", Token: "token", TokenType: tt.tokenType}, tt.resp)
+			assertError(t, err, tt.err)
+			if tt.err != nil {
+				return
+			}
+			if verdict.Outcome != tt.outcome {
+				t.Errorf("got outcome %q, want %q", verdict.Outcome, tt.outcome)
+			}
+			if verdict.Delay != tt.delay {
+				t.Errorf("got delay %s, want %s", verdict.Delay, tt.delay)
+			}
+		})
+	}
+}
+
+func TestSiteVerify(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		token   string
+		outcome Outcome
+		err     any
+		// Status suggested by the provider error
+		providerStatus int
+	}{
+		{
+			name: "allowed",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				if r.PostFormValue("secret") != "secret" || r.PostFormValue("response") != "token" {
+					t.Errorf("unexpected form %v", r.PostForm)
+				}
+				w.Write([]byte(`{"success": true, "score": 0.9, "action": "submit", "challenge_ts": "2024-01-01T00:00:00Z"}`))
+			},
+			token:   "token",
+			outcome: OutcomeAllow,
+		},
+		{
+			name: "malformed response",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(`<html>`))
+			},
+			token:          "token",
+			err:            &ProviderError{},
+			providerStatus: http.StatusBadGateway,
+		},
+		{
+			name: "unavailable",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				w.Write([]byte(`{"success": true, "score": 0.9}`))
+			},
+			token:          "token",
+			err:            &ProviderError{},
+			providerStatus: http.StatusServiceUnavailable,
+		},
+		{
+			name: "throttled",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusTooManyRequests)
+			},
+			token:          "token",
+			err:            &ProviderError{},
+			providerStatus: http.StatusServiceUnavailable,
+		},
+		{
+			name: "unexpected status",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNotFound)
+			},
+			token:          "token",
+			err:            &ProviderError{},
+			providerStatus: http.StatusBadGateway,
+		},
+		{
+			name:    "missing token",
+			handler: func(w http.ResponseWriter, r *http.Request) {},
+			err:     ErrMissingToken,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(tt.handler)
+			defer srv.Close()
+			v := newSiteVerifyVerifier(t, srv.URL, Options{Threshold: 0.5})
+			verdict, err := v.Verify(context.Background(), Request{SiteKey: "secret", Token: tt.token})
+			assertError(t, err, tt.err)
+			if tt.err == nil && verdict.Outcome != tt.outcome {
+				t.Errorf("got outcome %q, want %q", verdict.Outcome, tt.outcome)
+			}
+			var providerErr *ProviderError
+			if errors.As(err, &providerErr) && providerErr.StatusCode != tt.providerStatus {
+				t.Errorf("got provider status %d, want %d", providerErr.StatusCode, tt.providerStatus)
+			}
+		})
+	}
+
+	t.Run("unreachable", func(t *testing.T) {
+		srv := httptest.NewServer(http.NotFoundHandler())
+		srv.Close()
+		v := newSiteVerifyVerifier(t, srv.URL, Options{Threshold: 0.5})
+		_, err := v.Verify(context.Background(), Request{SiteKey: "secret", Token: "token"})
+		var providerErr *ProviderError
+		if !errors.As(err, &providerErr) || providerErr.StatusCode != http.StatusBadGateway {
+			t.Fatalf("got %v, want a provider error with status 502", err)
+		}
+	})
+}
+
+// Matching the error against a message, a sentinel error or the type of a pointer to an error
+func assertError(t *testing.T, err error, want any) {
+	t.Helper()
+	switch want := want.(type) {
+	case nil:
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case string:
+		if err == nil || err.Error() != want {
+			t.Fatalf("got error %v, want %q", err, want)
+		}
+	case *TokenExpiredError:
+		if !errors.As(err, &want) {
+			t.Fatalf("got error %v, want a %T", err, want)
+		}
+	case *ChallengeError:
+		if !errors.As(err, &want) {
+			t.Fatalf("got error %v, want a %T", err, want)
+		}
+	case *ReasonsError:
+		if !errors.As(err, &want) {
+			t.Fatalf("got error %v, want a %T", err, want)
+		}
+	case *ProviderError:
+		if !errors.As(err, &want) {
+			t.Fatalf("got error %v, want a %T", err, want)
+		}
+	case error:
+		if !errors.Is(err, want) {
+			t.Fatalf("got error %v, want %v", err, want)
+		}
+	}
+}
+
+func TestSitePolicyTarpitDelay(t *testing.T) {
+	tests := []struct {
+		name  string
+		delay time.Duration
+		err   bool
+	}{
+		{name: "within the cap", delay: 2 * time.Second},
+		{name: "no delay", err: true},
+		{name: "above the ext auth timeout", delay: 3 * time.Second, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := SitePolicy{Bands: []ScoreBand{{MinScore: 0, Outcome: OutcomeTarpit, Delay: Duration(tt.delay)}}}
+			if err := policy.Validate(); (err != nil) != tt.err {
+				t.Errorf("got error %v, want an error %t", err, tt.err)
+			}
+		})
+	}
+}
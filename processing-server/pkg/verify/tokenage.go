@@ -0,0 +1,45 @@
+package verify
+
+import (
+	"fmt"
+	"time"
+)
+
+// TokenExpiredError is returned when the token is older than the maximum token age,
+// the client is expected to execute reCAPTCHA again rather than being treated as a bot.
+type TokenExpiredError struct {
+	Age    time.Duration
+	MaxAge time.Duration
+}
+
+func (e *TokenExpiredError) Error() string {
+	return fmt.Sprintf("token is '%s' old, while expecting maximum '%s'", e.Age.Round(time.Second), e.MaxAge)
+}
+
+func (v *Verifier) maxTokenAge(policy SitePolicy) time.Duration {
+	if policy.MaxTokenAge != 0 {
+		return time.Duration(policy.MaxTokenAge)
+	}
+	return v.opts.MaxTokenAge
+}
+
+// Checking the token creation time against the maximum token age, allowing for clock skew
+// between reCAPTCHA and this service. A zero maximum age disables the check.
+func (v *Verifier) checkTokenAge(policy SitePolicy, createTime time.Time, now time.Time) error {
+	maxAge := v.maxTokenAge(policy)
+	if maxAge <= 0 {
+		return nil
+	}
+	if createTime.IsZero() {
+		return refuse(ErrInvalidToken, "token has no creation time")
+	}
+	skew := v.opts.TokenClockSkew
+	age := now.Sub(createTime)
+	if age < -skew {
+		return refuse(ErrInvalidToken, "token is created '%s' in the future", (-age).Round(time.Second))
+	}
+	if age > maxAge+skew {
+		return &TokenExpiredError{Age: age, MaxAge: maxAge}
+	}
+	return nil
+}
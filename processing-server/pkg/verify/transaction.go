@@ -0,0 +1,58 @@
+package verify
+
+import (
+	recaptchaenterprisepb "cloud.google.com/go/recaptchaenterprise/v2/apiv1/recaptchaenterprisepb"
+)
+
+// TransactionData describes a payment transaction for reCAPTCHA Enterprise Fraud Prevention.
+type TransactionData struct {
+	TransactionId   string              `json:"transactionId,omitempty"`
+	Amount          float64             `json:"amount"`
+	ShippingAmount  float64             `json:"shippingAmount,omitempty"`
+	Currency        string              `json:"currency"` // ISO 4217 currency code
+	PaymentMethod   string              `json:"paymentMethod,omitempty"`
+	CardBin         string              `json:"cardBin,omitempty"`
+	CardLastFour    string              `json:"cardLastFour,omitempty"`
+	BillingAddress  *TransactionAddress `json:"billingAddress,omitempty"`
+	ShippingAddress *TransactionAddress `json:"shippingAddress,omitempty"`
+}
+
+type TransactionAddress struct {
+	Recipient          string   `json:"recipient,omitempty"`
+	Address            []string `json:"address,omitempty"`
+	Locality           string   `json:"locality,omitempty"`
+	AdministrativeArea string   `json:"administrativeArea,omitempty"`
+	RegionCode         string   `json:"regionCode,omitempty"` // CLDR region code
+	PostalCode         string   `json:"postalCode,omitempty"`
+}
+
+func (t *TransactionData) toProto() *recaptchaenterprisepb.TransactionData {
+	td := &recaptchaenterprisepb.TransactionData{
+		PaymentMethod:   t.PaymentMethod,
+		CardBin:         t.CardBin,
+		CardLastFour:    t.CardLastFour,
+		CurrencyCode:    t.Currency,
+		Value:           t.Amount,
+		ShippingValue:   t.ShippingAmount,
+		BillingAddress:  t.BillingAddress.toProto(),
+		ShippingAddress: t.ShippingAddress.toProto(),
+	}
+	if t.TransactionId != "" {
+		td.TransactionId = &t.TransactionId
+	}
+	return td
+}
+
+func (a *TransactionAddress) toProto() *recaptchaenterprisepb.TransactionData_Address {
+	if a == nil {
+		return nil
+	}
+	return &recaptchaenterprisepb.TransactionData_Address{
+		Recipient:          a.Recipient,
+		Address:            a.Address,
+		Locality:           a.Locality,
+		AdministrativeArea: a.AdministrativeArea,
+		RegionCode:         a.RegionCode,
+		PostalCode:         a.PostalCode,
+	}
+}
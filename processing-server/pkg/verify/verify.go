@@ -0,0 +1,216 @@
+// Package verify verifies reCAPTCHA tokens in-process, either with reCAPTCHA Enterprise assessments or with the
+// classic siteverify API. The site policies, the score bands and the maximum token age are applied on the result.
+//
+//	verifier, err := verify.New(verify.Options{
+//		Threshold:  0.5,
+//		Enterprise: &verify.EnterpriseOptions{ProjectId: "my-project"},
+//	})
+//	verdict, err := verifier.Verify(ctx, verify.Request{SiteKey: siteKey, Token: token})
+//
+// The processing server is built on this package, which can be embedded the same way by other Go services.
+package verify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	recaptchaenterprisepb "cloud.google.com/go/recaptchaenterprise/v2/apiv1/recaptchaenterprisepb"
+)
+
+// TokenType is the type of the token being verified.
+type TokenType string
+
+const (
+	// Score based token, the default
+	TokenScore TokenType = "score"
+	// reCAPTCHA WAF tokens, assessed with the WAF keys of the site policy
+	TokenWafAction  TokenType = "waf-action"
+	TokenWafSession TokenType = "waf-session"
+	// Token-less assessment built from the request metadata only (Enterprise only)
+	TokenExpress TokenType = "express"
+	// v2 checkbox token, which has no score
+	TokenCheckbox TokenType = "checkbox"
+)
+
+// Options of the verifier, exactly one provider must be set.
+type Options struct {
+	// Scores above the threshold are allowed, unless the site policy has score bands
+	Threshold float64
+	// Providers
+	Enterprise *EnterpriseOptions
+	SiteVerify *SiteVerifyOptions
+	// Policies per site key, see DefaultSitePolicyKey
+	SitePolicies map[string]SitePolicy
+	// Maximum age of the tokens unless set by the site policy, zero disables the check
+	MaxTokenAge    time.Duration
+	TokenClockSkew time.Duration
+	// Threshold of the express assessments, unless set by the site policy
+	ExpressThreshold float64
+	// Circuit breaker around the calls to the provider, disabled by default
+	Breaker BreakerOptions
+}
+
+// Request to verify.
+type Request struct {
+	// Site key of the token, the secret key with the siteverify API. The WAF tokens are assessed
+	// with the WAF keys of the policy of this site key.
+	SiteKey   string
+	Token     string
+	TokenType TokenType
+	// Account ID for Account Defender, hashed before being sent (Enterprise only)
+	AccountId string
+	// Payment transaction for Fraud Prevention (Enterprise only)
+	Transaction *TransactionData
+	UserAgent   string
+	UserIp      string
+	// Request headers formatted as `name: value`, for the express assessments
+	Headers []string
+}
+
+// Verdict of a verification that was not refused.
+type Verdict struct {
+	TokenType TokenType
+	Score     float64
+	Action    string
+	// Either allow or tarpit, the challenges and the denials are returned as errors
+	Outcome Outcome
+	// Delay to apply before allowing the request in the tarpit band
+	Delay time.Duration
+	// Name of the Enterprise assessment
+	AssessmentId string
+}
+
+// ProviderError is returned when reCAPTCHA could not be reached or answered unexpectedly,
+// the request is neither allowed nor refused.
+type ProviderError struct {
+	// Status suggested for the response
+	StatusCode int
+	Message    string
+	Err        error
+	// Time after which the request may be retried, when known, e.g. while the circuit breaker is open
+	RetryAfter time.Duration
+}
+
+func (e *ProviderError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %v", e.Message, e.Err)
+	}
+	return e.Message
+}
+
+func (e *ProviderError) Unwrap() error {
+	return e.Err
+}
+
+// ErrMissingToken is returned when the request has no token, while its type requires one.
+var ErrMissingToken = errors.New("missing token")
+
+// Kinds of the other refusals of Verify, matched with errors.Is. The message tells the details.
+var (
+	// The token is malformed, already used, or was refused by reCAPTCHA
+	ErrInvalidToken = errors.New("invalid token")
+	// The score falls in a deny band, or is not above the threshold
+	ErrScoreTooLow = errors.New("score too low")
+	// The transaction risk or an account defender label is denied
+	ErrRiskDenied = errors.New("risk denied")
+	// The action of the token is not one of the actions of the site policy
+	ErrActionMismatch = errors.New("action mismatch")
+)
+
+// refusal keeps its detailed message, while being matched with its kind
+type refusal struct {
+	kind    error
+	message string
+}
+
+func (e *refusal) Error() string {
+	return e.message
+}
+
+func (e *refusal) Is(target error) bool {
+	return target == e.kind
+}
+
+func refuse(kind error, format string, args ...any) error {
+	return &refusal{kind: kind, message: fmt.Sprintf(format, args...)}
+}
+
+// Verifier verifies the requests with the configured provider.
+type Verifier struct {
+	opts   Options
+	client AssessmentClient
+	// Account defender labels denying the request
+	deniedLabels map[recaptchaenterprisepb.AccountDefenderAssessment_AccountDefenderLabel]bool
+	// Nil when disabled
+	breaker *breaker
+}
+
+// New creates a verifier, validating the options and the site policies.
+func New(opts Options) (*Verifier, error) {
+	if (opts.Enterprise == nil) == (opts.SiteVerify == nil) {
+		return nil, errors.New("exactly one of the Enterprise and SiteVerify providers is required")
+	}
+	for siteKey, policy := range opts.SitePolicies {
+		if err := policy.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid site policy for %s: %w", siteKey, err)
+		}
+	}
+	v := &Verifier{opts: opts}
+	if opts.Enterprise != nil {
+		if opts.Enterprise.ProjectId == "" {
+			return nil, errors.New("the Enterprise project ID is required")
+		}
+		labels, err := parseAccountDefenderLabels(opts.Enterprise.DeniedAccountDefenderLabels)
+		if err != nil {
+			return nil, err
+		}
+		v.deniedLabels = labels
+		v.client = opts.Enterprise.Client
+		if v.client == nil {
+			v.client = &sharedClient{opts: opts.Enterprise.ClientOptions}
+		}
+		v.breaker = newBreaker("enterprise", opts.Breaker)
+	} else if opts.SiteVerify.Api == "" {
+		return nil, errors.New("the siteverify API is required")
+	} else {
+		v.breaker = newBreaker("siteverify", opts.Breaker)
+	}
+	return v, nil
+}
+
+// Enterprise tells whether the verifier creates reCAPTCHA Enterprise assessments.
+func (v *Verifier) Enterprise() bool {
+	return v.opts.Enterprise != nil
+}
+
+// Verify the request, returning the verdict or the reason of the refusal, such as a ChallengeError,
+// a TokenExpiredError, a ReasonsError or a ProviderError.
+func (v *Verifier) Verify(ctx context.Context, req Request) (Verdict, error) {
+	if req.TokenType == "" {
+		req.TokenType = TokenScore
+	}
+	if req.Token == "" && req.TokenType != TokenExpress {
+		return Verdict{}, ErrMissingToken
+	}
+	var verdict Verdict
+	var err error
+	if v.opts.Enterprise != nil {
+		verdict, err = v.verifyEnterprise(ctx, req)
+	} else {
+		verdict, err = v.verifySiteVerify(ctx, req)
+	}
+	if err != nil {
+		return Verdict{}, err
+	}
+	verdict.TokenType = req.TokenType
+	return verdict, nil
+}
+
+func (v *Verifier) expressThreshold(policy SitePolicy) float64 {
+	if policy.ExpressThreshold != 0 {
+		return policy.ExpressThreshold
+	}
+	return v.opts.ExpressThreshold
+}
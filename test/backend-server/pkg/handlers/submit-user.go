@@ -8,6 +8,7 @@ import (
 	"os"
 
 	chi "github.com/go-chi/chi/v5"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/attest/middleware"
 	"go.uber.org/zap"
 )
 
@@ -26,8 +27,19 @@ type storeReqPayload struct {
 	Email string `json:"email"`
 }
 
-func SubmitUser(mux chi.Router, log *zap.Logger) {
-	mux.Post("/submit", func(w http.ResponseWriter, r *http.Request) {
+// SubmitUser requires a verdict attestation of the processing server when verdict options are given.
+func SubmitUser(mux chi.Router, verdictOptions *middleware.Options, log *zap.Logger) {
+	router := mux
+	if verdictOptions != nil {
+		opts := *verdictOptions
+		opts.OnError = func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Info("Refused verdict", zap.Error(err))
+			middleware.WriteProblem(w, r, err)
+		}
+		router = mux.With(middleware.Verdict(opts))
+	}
+
+	router.Post("/submit", func(w http.ResponseWriter, r *http.Request) {
 		var storeRequest storeReqPayload
 		errorResp := errorResp{}
 
@@ -50,6 +62,9 @@ func SubmitUser(mux chi.Router, log *zap.Logger) {
 				returnErrorRespAsHttpResponse(w, errorResp)
 				return
 			}
+			if verdict, ok := middleware.FromContext(r.Context()); ok {
+				log.Info("Verified verdict", zap.Float64("score", verdict.Score), zap.String("action", verdict.Action))
+			}
 			log.Info("Name of user", zap.String("name", storeRequest.User))
 			log.Info("Email of user", zap.String("email", storeRequest.Email))
 
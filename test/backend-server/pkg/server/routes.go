@@ -5,5 +5,5 @@ import (
 )
 
 func (s *Server) setupRoutes() {
-	handlers.SubmitUser(s.mux, s.log)
+	handlers.SubmitUser(s.mux, s.verdict, s.log)
 }
@@ -13,12 +13,15 @@ import (
 
 	chi "github.com/go-chi/chi/v5"
 	"github.com/go-chi/cors"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/attest"
+	"github.com/pseudonator/recaptcha-processing-server/pkg/attest/middleware"
 	"go.uber.org/zap"
 )
 
 const (
 	defaultServerHost = "localhost"
 	defaultServerPort = 9092
+	defaultAction     = "submit"
 )
 
 type Options struct {
@@ -30,6 +33,7 @@ type Server struct {
 	log     *zap.Logger
 	mux     chi.Router
 	server  *http.Server
+	verdict *middleware.Options
 }
 
 type loggerWrapper struct {
@@ -67,6 +71,7 @@ func New(opts Options) *Server {
 			WriteTimeout:      5 * time.Second,
 			IdleTimeout:       5 * time.Second,
 		},
+		verdict: lw.getVerdictOptions(),
 	}
 }
 
@@ -77,6 +82,19 @@ func (lw *loggerWrapper) getBindingAddress() string {
 	return address
 }
 
+// Verifying the verdict attestations of the processing server, only when its JWKS URL is set
+func (lw *loggerWrapper) getVerdictOptions() *middleware.Options {
+	jwksUrl := lw.getStringOrDefault("RECAPTCHA_JWKS_URL", "")
+	if jwksUrl == "" {
+		return nil
+	}
+	return &middleware.Options{
+		Verifier: attest.NewVerifier(attest.NewRemoteKeySet(jwksUrl, nil), lw.getStringOrDefault("RECAPTCHA_ISSUER", "")),
+		MinScore: lw.getFloatOrDefault("RECAPTCHA_MIN_SCORE", 0),
+		Action:   lw.getStringOrDefault("RECAPTCHA_ACTION", defaultAction),
+	}
+}
+
 // Start by setting up routes and listening for HTTP requests on the given address.
 func (s *Server) Start() error {
 	s.setupRoutes()
@@ -122,6 +140,18 @@ func (lw *loggerWrapper) getStringOrDefault(name string, defaultV string) string
 	return strings.TrimSpace(v)
 }
 
+func (lw *loggerWrapper) getFloatOrDefault(name string, defaultV float64) float64 {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return defaultV
+	}
+	vAsFloat, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return defaultV
+	}
+	return vAsFloat
+}
+
 func (lw *loggerWrapper) getIntOrDefault(name string, defaultV int) int {
 	v, ok := os.LookupEnv(name)
 	if !ok {
@@ -0,0 +1,278 @@
+package e2e
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	processing "github.com/pseudonator/recaptcha-processing-server/pkg/server"
+	backend "github.com/pseudonator/recaptcha-test-backend-server/pkg/server"
+	provider "github.com/pseudonator/recaptcha-test-fake-provider/pkg/server"
+)
+
+const (
+	authConfigPath = "../../k8s/gloo-edge/config/authconfig.yaml"
+	apiKey         = "test-api-key"
+	strictApiKey   = "strict-api-key"
+	siteKey        = "test-site-key"
+	strictSiteKey  = "strict-site-key"
+	threshold      = "0.5"
+)
+
+// The strict site key challenges the scores below 0.8 and denies the ones below 0.3
+const sitePolicies = `{
+  "strict-site-key": {
+    "bands": [
+      {"minScore": 0, "outcome": "deny"},
+      {"minScore": 0.3, "outcome": "challenge"},
+      {"minScore": 0.8, "outcome": "allow"}
+    ]
+  }
+}`
+
+// chain is the whole passthrough chain for one provider mode, the gateway is the entry point of the clients
+type chain struct {
+	gateway *httptest.Server
+}
+
+type stoppable interface {
+	Start() error
+	Stop() error
+}
+
+var nonce atomic.Int64
+
+// Unique scripted token, as the fake provider rejects the replays
+func token(script string) string {
+	return fmt.Sprintf("%s-nonce-%d", script, nonce.Add(1))
+}
+
+func TestPassthrough(t *testing.T) {
+	fakeHttp, fakeGrpc := startProvider(t)
+
+	modes := map[string]map[string]string{
+		"siteverify": {
+			"ENABLE_ENTERPRISE":         "false",
+			"VERIFY_CAPTCHA_GOOGLE_API": fmt.Sprintf("http://%s/recaptcha/api/siteverify", fakeHttp),
+		},
+		"enterprise": {
+			"ENABLE_ENTERPRISE":             "true",
+			"GOOGLE_ADC_PROJECT_ID":         "e2e",
+			"RECAPTCHA_ENTERPRISE_ENDPOINT": fakeGrpc,
+			"RECAPTCHA_ENTERPRISE_INSECURE": "true",
+		},
+	}
+	for mode, env := range modes {
+		t.Run(mode, func(t *testing.T) {
+			c := startChain(t, env)
+
+			tests := []struct {
+				name    string
+				apiKey  string
+				token   string
+				status  int
+				outcome string
+				// Code of the problem details, none for the refusals of the gateway
+				code string
+			}{
+				{name: "no api key", token: token("score-0.9-action-submit"), status: http.StatusUnauthorized},
+				{name: "unknown api key", apiKey: "unknown", token: token("score-0.9-action-submit"), status: http.StatusUnauthorized},
+				{name: "no token", apiKey: apiKey, status: http.StatusUnauthorized, code: "token_missing"},
+				{name: "above threshold", apiKey: apiKey, token: token("score-0.9-action-submit"), status: http.StatusOK},
+				{name: "just above threshold", apiKey: apiKey, token: token("score-0.51-action-submit"), status: http.StatusOK},
+				{name: "equal to threshold", apiKey: apiKey, token: token("score-0.5-action-submit"), status: http.StatusUnauthorized, outcome: "deny", code: "score_too_low"},
+				{name: "below threshold", apiKey: apiKey, token: token("score-0.2-action-submit"), status: http.StatusUnauthorized, outcome: "deny", code: "score_too_low"},
+				{name: "invalid token", apiKey: apiKey, token: token("invalid-MALFORMED"), status: http.StatusUnauthorized, outcome: "deny", code: "token_invalid"},
+				// Allowed by the processing server, then refused by the attestation middleware of the backend
+				{name: "unexpected action", apiKey: apiKey, token: token("score-0.9-action-login"), status: http.StatusForbidden, code: "action_mismatch"},
+				// The site key of the strict API key metadata selects its policy
+				{name: "strict allow", apiKey: strictApiKey, token: token("score-0.9-action-submit"), status: http.StatusOK},
+				{name: "strict challenge", apiKey: strictApiKey, token: token("score-0.6-action-submit"), status: http.StatusPreconditionRequired, outcome: "challenge", code: "challenge_required"},
+				{name: "strict deny", apiKey: strictApiKey, token: token("score-0.2-action-submit"), status: http.StatusUnauthorized, outcome: "deny", code: "score_too_low"},
+			}
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					resp := c.submit(t, tt.apiKey, tt.token)
+					if resp.StatusCode != tt.status {
+						t.Fatalf("got status %d, want %d", resp.StatusCode, tt.status)
+					}
+					if got := resp.Header.Get("x-recaptcha-outcome"); got != tt.outcome {
+						t.Errorf("got outcome %q, want %q", got, tt.outcome)
+					}
+					if got := resp.Header.Get("x-recaptcha-error"); got != tt.code {
+						t.Errorf("got code %q, want %q", got, tt.code)
+					}
+					if tt.code != "" && resp.Header.Get("Content-Type") != "application/problem+json" {
+						t.Errorf("got content type %q, want the problem details", resp.Header.Get("Content-Type"))
+					}
+				})
+			}
+
+			t.Run("replay", func(t *testing.T) {
+				replayed := token("score-0.9-action-submit")
+				if resp := c.submit(t, apiKey, replayed); resp.StatusCode != http.StatusOK {
+					t.Fatalf("got status %d on the first use, want %d", resp.StatusCode, http.StatusOK)
+				}
+				if resp := c.submit(t, apiKey, replayed); resp.StatusCode != http.StatusUnauthorized {
+					t.Fatalf("got status %d on the replay, want %d", resp.StatusCode, http.StatusUnauthorized)
+				}
+			})
+
+			t.Run("provider failure", func(t *testing.T) {
+				resp := c.submit(t, apiKey, token("status-503"))
+				if resp.StatusCode == http.StatusOK {
+					t.Fatalf("got status %d, want a refusal", resp.StatusCode)
+				}
+				if got := resp.Header.Get("x-recaptcha-error"); got != "provider_unavailable" {
+					t.Errorf("got code %q, want provider_unavailable", got)
+				}
+				if resp.Header.Get("Retry-After") == "" {
+					t.Error("got no retry hint")
+				}
+			})
+		})
+	}
+}
+
+func (c *chain) submit(t *testing.T, key string, captchaToken string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, c.gateway.URL+"/submit", strings.NewReader(`{"name":"e2e","email":"e2e@example.com"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		req.Header.Set("x-api-key", key)
+	}
+	if captchaToken != "" {
+		req.Header.Set("x-recaptcha-token", captchaToken)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp
+}
+
+// Starting the fake provider rejecting the replays, returning the addresses of its HTTP and gRPC APIs
+func startProvider(t *testing.T) (string, string) {
+	httpPort, grpcPort := freePort(t), freePort(t)
+	setEnv(t, map[string]string{
+		"SERVER_PORT":    strconv.Itoa(httpPort),
+		"GRPC_PORT":      strconv.Itoa(grpcPort),
+		"REJECT_REPLAYS": "true",
+	})
+	start(t, provider.New(provider.Options{}))
+	httpAddress := net.JoinHostPort("localhost", strconv.Itoa(httpPort))
+	grpcAddress := net.JoinHostPort("localhost", strconv.Itoa(grpcPort))
+	waitForListener(t, httpAddress)
+	waitForListener(t, grpcAddress)
+	return httpAddress, grpcAddress
+}
+
+// Starting the processing server with the provider env, the backend verifying its attestations and the gateway
+func startChain(t *testing.T, providerEnv map[string]string) *chain {
+	policies := filepath.Join(t.TempDir(), "site-policies.json")
+	if err := os.WriteFile(policies, []byte(sitePolicies), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	processingPort := freePort(t)
+	env := map[string]string{
+		"SERVER_PORT":                strconv.Itoa(processingPort),
+		"ACCEPTABLE_SCORE_THRESHOLD": threshold,
+		"SITE_POLICIES_FILE":         policies,
+		"ATTESTATION_ENABLED":        "true",
+	}
+	for name, value := range providerEnv {
+		env[name] = value
+	}
+	setEnv(t, env)
+	start(t, processing.New(processing.Options{}))
+	processingAddress := net.JoinHostPort("localhost", strconv.Itoa(processingPort))
+	waitForListener(t, processingAddress)
+
+	backendPort := freePort(t)
+	setEnv(t, map[string]string{
+		"SERVER_PORT":        strconv.Itoa(backendPort),
+		"RECAPTCHA_JWKS_URL": fmt.Sprintf("http://%s/.well-known/jwks.json", processingAddress),
+		"RECAPTCHA_ACTION":   "submit",
+	})
+	start(t, backend.New(backend.Options{}))
+	backendAddress := net.JoinHostPort("localhost", strconv.Itoa(backendPort))
+	waitForListener(t, backendAddress)
+
+	config, err := LoadAuthConfig(authConfigPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	extAuth, err := NewExtAuth(ExtAuthOptions{
+		Config: config,
+		ApiKeys: []ApiKey{
+			{Key: apiKey, Metadata: map[string]string{"site-key": siteKey}},
+			{Key: strictApiKey, Metadata: map[string]string{"site-key": strictSiteKey}},
+		},
+		PassThroughUrl: fmt.Sprintf("http://%s/captcha-verify", processingAddress),
+		Upstream:       &url.URL{Scheme: "http", Host: backendAddress},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gateway := httptest.NewServer(extAuth)
+	t.Cleanup(gateway.Close)
+	return &chain{gateway: gateway}
+}
+
+// The servers read their configuration from the env when created
+func setEnv(t *testing.T, env map[string]string) {
+	for name, value := range env {
+		t.Setenv(name, value)
+	}
+}
+
+func start(t *testing.T, s stoppable) {
+	go func() {
+		if err := s.Start(); err != nil {
+			t.Errorf("unable to start the server: %v", err)
+		}
+	}()
+	t.Cleanup(func() {
+		if err := s.Stop(); err != nil {
+			t.Errorf("unable to stop the server: %v", err)
+		}
+	})
+}
+
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func waitForListener(t *testing.T, address string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		conn, err := net.Dial("tcp", address)
+		if err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("%s is not listening", address)
+}
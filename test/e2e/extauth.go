@@ -0,0 +1,277 @@
+// Package e2e runs the whole passthrough chain in-process: a Gloo ext-auth emulation reading the AuthConfig of
+// the cluster, the processing server, the fake provider and the test backend server.
+package e2e
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// AuthConfig is the subset of the Gloo `AuthConfig` resource applied by the emulation.
+type AuthConfig struct {
+	Spec struct {
+		BooleanExpr string            `yaml:"booleanExpr"`
+		Configs     []AuthConfigEntry `yaml:"configs"`
+	} `yaml:"spec"`
+}
+
+// AuthConfigEntry is a named auth step of the boolean expression.
+type AuthConfigEntry struct {
+	Name       string `yaml:"name"`
+	ApiKeyAuth *struct {
+		HeaderName               string `yaml:"headerName"`
+		HeadersFromMetadataEntry map[string]struct {
+			Name     string `yaml:"name"`
+			Required bool   `yaml:"required"`
+		} `yaml:"headersFromMetadataEntry"`
+	} `yaml:"apiKeyAuth"`
+	PassThroughAuth *struct {
+		Http struct {
+			Url               string `yaml:"url"`
+			ConnectionTimeout string `yaml:"connectionTimeout"`
+			Request           struct {
+				AllowedHeaders   []string `yaml:"allowedHeaders"`
+				PassThroughState bool     `yaml:"passThroughState"`
+				PassThroughBody  bool     `yaml:"passThroughBody"`
+			} `yaml:"request"`
+			Response struct {
+				AllowedUpstreamHeaders       []string `yaml:"allowedUpstreamHeaders"`
+				AllowedClientHeadersOnDenied []string `yaml:"allowedClientHeadersOnDenied"`
+			} `yaml:"response"`
+		} `yaml:"http"`
+	} `yaml:"passThroughAuth"`
+}
+
+// LoadAuthConfig reads the AuthConfig manifest.
+func LoadAuthConfig(path string) (*AuthConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the auth config: %w", err)
+	}
+	var config AuthConfig
+	if err := yaml.Unmarshal(b, &config); err != nil {
+		return nil, fmt.Errorf("unable to parse the auth config: %w", err)
+	}
+	return &config, nil
+}
+
+// ApiKey stands for an API key secret selected by the auth config, with its metadata entries.
+type ApiKey struct {
+	Key      string
+	Metadata map[string]string
+}
+
+// ExtAuthOptions of the emulation.
+type ExtAuthOptions struct {
+	Config  *AuthConfig
+	ApiKeys []ApiKey
+	// Replaces the in-cluster URL of the passthrough service
+	PassThroughUrl string
+	// Upstream of the authorized requests
+	Upstream *url.URL
+}
+
+// ExtAuth emulates the ext-auth filter of Gloo in front of an upstream.
+type ExtAuth struct {
+	opts   ExtAuthOptions
+	proxy  *httputil.ReverseProxy
+	client *http.Client
+}
+
+// The outcome of an auth step, the headers are either added to the upstream request or returned on a denial
+type stepResult struct {
+	allowed bool
+	status  int
+	body    []byte
+	headers http.Header
+}
+
+// NewExtAuth creates the emulation, validating the boolean expression against the configs.
+func NewExtAuth(opts ExtAuthOptions) (*ExtAuth, error) {
+	for _, name := range expressionSteps(opts.Config.Spec.BooleanExpr) {
+		if opts.Config.entry(name) == nil {
+			return nil, fmt.Errorf("no config '%s' for the boolean expression", name)
+		}
+	}
+	timeout := 5 * time.Second
+	for _, entry := range opts.Config.Spec.Configs {
+		if entry.PassThroughAuth != nil && entry.PassThroughAuth.Http.ConnectionTimeout != "" {
+			d, err := time.ParseDuration(entry.PassThroughAuth.Http.ConnectionTimeout)
+			if err != nil {
+				return nil, fmt.Errorf("invalid connection timeout of '%s': %w", entry.Name, err)
+			}
+			timeout = d
+		}
+	}
+	return &ExtAuth{
+		opts: opts,
+		proxy: &httputil.ReverseProxy{
+			Rewrite: func(r *httputil.ProxyRequest) {
+				r.SetURL(opts.Upstream)
+			},
+		},
+		client: &http.Client{Timeout: timeout},
+	}, nil
+}
+
+func (c *AuthConfig) entry(name string) *AuthConfigEntry {
+	for i := range c.Spec.Configs {
+		if c.Spec.Configs[i].Name == name {
+			return &c.Spec.Configs[i]
+		}
+	}
+	return nil
+}
+
+// Names of the steps of an expression such as `apiKey && captchaProc || other`, without parentheses
+func expressionSteps(expr string) []string {
+	var names []string
+	for _, or := range strings.Split(expr, "||") {
+		for _, and := range strings.Split(or, "&&") {
+			names = append(names, strings.TrimSpace(and))
+		}
+	}
+	return names
+}
+
+func (e *ExtAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	r.Body.Close()
+
+	// The && binds tighter than the ||, each step sees the state of the previous ones
+	var denied *stepResult
+	for _, or := range strings.Split(e.opts.Config.Spec.BooleanExpr, "||") {
+		state := map[string]any{}
+		upstream := http.Header{}
+		denied = nil
+		for _, and := range strings.Split(or, "&&") {
+			result := e.runStep(e.opts.Config.entry(strings.TrimSpace(and)), r, body, state)
+			if !result.allowed {
+				denied = &result
+				break
+			}
+			for name, values := range result.headers {
+				upstream[name] = values
+			}
+		}
+		if denied == nil {
+			for name, values := range upstream {
+				r.Header[name] = values
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			r.ContentLength = int64(len(body))
+			e.proxy.ServeHTTP(w, r)
+			return
+		}
+	}
+
+	for name, values := range denied.headers {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(denied.status)
+	w.Write(denied.body)
+}
+
+func (e *ExtAuth) runStep(entry *AuthConfigEntry, r *http.Request, body []byte, state map[string]any) stepResult {
+	switch {
+	case entry.ApiKeyAuth != nil:
+		return e.apiKey(entry, r, state)
+	case entry.PassThroughAuth != nil:
+		return e.passThrough(entry, r, body, state)
+	}
+	return stepResult{status: http.StatusInternalServerError, body: []byte("unsupported auth config")}
+}
+
+// Matching the API key, its metadata entries are added as headers to the upstream request and to the state
+func (e *ExtAuth) apiKey(entry *AuthConfigEntry, r *http.Request, state map[string]any) stepResult {
+	unauthorized := stepResult{status: http.StatusUnauthorized}
+	key := r.Header.Get(entry.ApiKeyAuth.HeaderName)
+	if key == "" {
+		return unauthorized
+	}
+	for _, apiKey := range e.opts.ApiKeys {
+		if apiKey.Key != key {
+			continue
+		}
+		headers := http.Header{}
+		for header, metadata := range entry.ApiKeyAuth.HeadersFromMetadataEntry {
+			value, ok := apiKey.Metadata[metadata.Name]
+			if !ok {
+				if metadata.Required {
+					return unauthorized
+				}
+				continue
+			}
+			headers.Set(header, value)
+			state[header] = value
+		}
+		return stepResult{allowed: true, headers: headers}
+	}
+	return unauthorized
+}
+
+// Calling the passthrough service with the allowed headers, the state and the body. The status of a denial
+// is returned to the client as it is, with the allowed headers.
+func (e *ExtAuth) passThrough(entry *AuthConfigEntry, r *http.Request, body []byte, state map[string]any) stepResult {
+	config := entry.PassThroughAuth.Http
+	payload := map[string]any{}
+	if config.Request.PassThroughState {
+		payload["state"] = state
+	}
+	if config.Request.PassThroughBody {
+		payload["body"] = string(body)
+	}
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return stepResult{status: http.StatusInternalServerError, body: []byte(err.Error())}
+	}
+
+	passThroughUrl := config.Url
+	if e.opts.PassThroughUrl != "" {
+		passThroughUrl = e.opts.PassThroughUrl
+	}
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, passThroughUrl, bytes.NewReader(b))
+	if err != nil {
+		return stepResult{status: http.StatusInternalServerError, body: []byte(err.Error())}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for _, name := range config.Request.AllowedHeaders {
+		for _, value := range r.Header.Values(name) {
+			req.Header.Add(name, value)
+		}
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		// Gloo denies the request when the passthrough service can't be reached
+		return stepResult{status: http.StatusForbidden}
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(resp.Body)
+
+	allowed := resp.StatusCode == http.StatusOK
+	names := config.Response.AllowedClientHeadersOnDenied
+	if allowed {
+		names = config.Response.AllowedUpstreamHeaders
+	}
+	headers := http.Header{}
+	for _, name := range names {
+		for _, value := range resp.Header.Values(name) {
+			headers.Add(name, value)
+		}
+	}
+	return stepResult{allowed: allowed, status: resp.StatusCode, body: respBody, headers: headers}
+}
@@ -0,0 +1,22 @@
+module github.com/pseudonator/recaptcha-test-fake-provider
+
+go 1.20
+
+require (
+	cloud.google.com/go/recaptchaenterprise/v2 v2.14.0
+	github.com/go-chi/chi/v5 v5.0.8
+	go.uber.org/zap v1.24.0
+	golang.org/x/sync v0.7.0
+	google.golang.org/grpc v1.64.0
+	google.golang.org/protobuf v1.34.2
+)
+
+require (
+	go.uber.org/atomic v1.7.0 // indirect
+	go.uber.org/multierr v1.6.0 // indirect
+	golang.org/x/net v0.26.0 // indirect
+	golang.org/x/sys v0.21.0 // indirect
+	golang.org/x/text v0.16.0 // indirect
+	google.golang.org/genproto/googleapis/api v0.0.0-20240617180043-68d350f18fd4 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20240624140628-dc46fd24d27d // indirect
+)
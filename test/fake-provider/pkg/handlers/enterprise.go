@@ -0,0 +1,251 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	mathrand "math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	recaptchaenterprisepb "cloud.google.com/go/recaptchaenterprise/v2/apiv1/recaptchaenterprisepb"
+	"github.com/pseudonator/recaptcha-test-fake-provider/pkg/script"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// EnterpriseOptions of the fake reCAPTCHA Enterprise API.
+type EnterpriseOptions struct {
+	Script script.Script
+	// Score and action of the tokens not setting them
+	DefaultScore  float64
+	DefaultAction string
+	Hostname      string
+	Faults        FaultOptions
+	// Rejects the tokens assessed before when set
+	Replays *ReplayLog
+}
+
+type enterpriseService struct {
+	recaptchaenterprisepb.UnimplementedRecaptchaEnterpriseServiceServer
+	opts *EnterpriseOptions
+	log  *zap.Logger
+	// Names of the assessments created, which can be annotated
+	mu          sync.Mutex
+	assessments map[string]bool
+}
+
+// HandleEnterprise serves the `CreateAssessment` and `AnnotateAssessment` methods of the RecaptchaEnterpriseService,
+// the other methods are answered as unimplemented.
+func HandleEnterprise(s *grpc.Server, opts *EnterpriseOptions, log *zap.Logger) {
+	recaptchaenterprisepb.RegisterRecaptchaEnterpriseServiceServer(s, &enterpriseService{
+		opts:        opts,
+		log:         log,
+		assessments: map[string]bool{},
+	})
+}
+
+func (s *enterpriseService) CreateAssessment(ctx context.Context, req *recaptchaenterprisepb.CreateAssessmentRequest) (*recaptchaenterprisepb.Assessment, error) {
+	if !strings.HasPrefix(req.GetParent(), "projects/") {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid parent '%s'", req.GetParent())
+	}
+	event := req.GetAssessment().GetEvent()
+	if event.GetSiteKey() == "" {
+		return nil, status.Error(codes.InvalidArgument, "the site key is required")
+	}
+	token := event.GetToken()
+
+	resp, scripted, err := s.opts.Script.Lookup(token)
+	if err != nil {
+		s.log.Info("Invalid scripted token", zap.String("token", token), zap.Error(err))
+		resp = script.Response{InvalidReason: recaptchaenterprisepb.TokenProperties_MALFORMED.String()}
+	}
+	if err := injectGrpcFaults(ctx, s.opts.Faults, time.Duration(resp.Latency)); err != nil {
+		return nil, err
+	}
+	if resp.Status != 0 {
+		s.log.Info("Injected status", zap.String("token", token), zap.Int("status", resp.Status))
+		return nil, status.Error(grpcCode(resp.Status), http.StatusText(resp.Status))
+	}
+
+	assessment, err := s.assess(event, resp)
+	if err != nil {
+		return nil, err
+	}
+	assessment.Name = fmt.Sprintf("%s/assessments/%s", req.GetParent(), randomId())
+	s.mu.Lock()
+	s.assessments[assessment.Name] = true
+	s.mu.Unlock()
+
+	s.log.Info("Created assessment",
+		zap.String("name", assessment.Name),
+		zap.Bool("scripted", scripted),
+		zap.Bool("valid", assessment.GetTokenProperties().GetValid()),
+		zap.Float32("score", assessment.GetRiskAnalysis().GetScore()))
+	return assessment, nil
+}
+
+// Building the assessment of the event from the scripted response
+func (s *enterpriseService) assess(event *recaptchaenterprisepb.Event, resp script.Response) (*recaptchaenterprisepb.Assessment, error) {
+	score := s.opts.DefaultScore
+	if resp.Score != nil {
+		score = *resp.Score
+	}
+	assessment := &recaptchaenterprisepb.Assessment{
+		Event: event,
+		RiskAnalysis: &recaptchaenterprisepb.RiskAnalysis{
+			Score: float32(score),
+		},
+	}
+	for _, name := range resp.Reasons {
+		reason, ok := recaptchaenterprisepb.RiskAnalysis_ClassificationReason_value[name]
+		if !ok {
+			return nil, status.Errorf(codes.InvalidArgument, "unknown classification reason '%s'", name)
+		}
+		assessment.RiskAnalysis.Reasons = append(assessment.RiskAnalysis.Reasons, recaptchaenterprisepb.RiskAnalysis_ClassificationReason(reason))
+	}
+
+	// The express assessments have no token to validate
+	if !event.GetExpress() {
+		properties, err := s.tokenProperties(event, resp)
+		if err != nil {
+			return nil, err
+		}
+		assessment.TokenProperties = properties
+	}
+
+	if len(resp.Labels) > 0 {
+		assessment.AccountDefenderAssessment = &recaptchaenterprisepb.AccountDefenderAssessment{}
+		for _, name := range resp.Labels {
+			label, ok := recaptchaenterprisepb.AccountDefenderAssessment_AccountDefenderLabel_value[name]
+			if !ok {
+				return nil, status.Errorf(codes.InvalidArgument, "unknown account defender label '%s'", name)
+			}
+			assessment.AccountDefenderAssessment.Labels = append(assessment.AccountDefenderAssessment.Labels, recaptchaenterprisepb.AccountDefenderAssessment_AccountDefenderLabel(label))
+		}
+	}
+
+	if event.GetTransactionData() != nil {
+		var risk float64
+		if resp.TransactionRisk != nil {
+			risk = *resp.TransactionRisk
+		}
+		assessment.FraudPreventionAssessment = &recaptchaenterprisepb.FraudPreventionAssessment{
+			TransactionRisk: float32(risk),
+		}
+	}
+	return assessment, nil
+}
+
+func (s *enterpriseService) tokenProperties(event *recaptchaenterprisepb.Event, resp script.Response) (*recaptchaenterprisepb.TokenProperties, error) {
+	invalidReason := resp.InvalidReason
+	switch {
+	case event.GetToken() == "":
+		invalidReason = recaptchaenterprisepb.TokenProperties_MISSING.String()
+	case s.opts.Replays.Seen(event.GetToken()):
+		invalidReason = recaptchaenterprisepb.TokenProperties_DUPE.String()
+	case invalidReason == "" && len(resp.ErrorCodes) > 0:
+		// Mapping the siteverify error codes of the scripts shared by both APIs
+		invalidReason = recaptchaenterprisepb.TokenProperties_MALFORMED.String()
+		if resp.ErrorCodes[0] == "timeout-or-duplicate" {
+			invalidReason = recaptchaenterprisepb.TokenProperties_DUPE.String()
+		}
+	}
+	if invalidReason != "" {
+		reason, ok := recaptchaenterprisepb.TokenProperties_InvalidReason_value[invalidReason]
+		if !ok {
+			return nil, status.Errorf(codes.InvalidArgument, "unknown invalid reason '%s'", invalidReason)
+		}
+		return &recaptchaenterprisepb.TokenProperties{
+			InvalidReason: recaptchaenterprisepb.TokenProperties_InvalidReason(reason),
+		}, nil
+	}
+
+	properties := &recaptchaenterprisepb.TokenProperties{
+		Valid:      true,
+		Hostname:   resp.Hostname,
+		Action:     resp.Action,
+		CreateTime: timestamppb.New(time.Now().Add(-time.Duration(resp.Age))),
+	}
+	if properties.Hostname == "" {
+		properties.Hostname = s.opts.Hostname
+	}
+	if properties.Action == "" {
+		properties.Action = s.opts.DefaultAction
+	}
+	return properties, nil
+}
+
+func (s *enterpriseService) AnnotateAssessment(ctx context.Context, req *recaptchaenterprisepb.AnnotateAssessmentRequest) (*recaptchaenterprisepb.AnnotateAssessmentResponse, error) {
+	s.mu.Lock()
+	found := s.assessments[req.GetName()]
+	s.mu.Unlock()
+	if !found {
+		return nil, status.Errorf(codes.NotFound, "assessment '%s' not found", req.GetName())
+	}
+	reasons := make([]string, 0, len(req.GetReasons()))
+	for _, reason := range req.GetReasons() {
+		reasons = append(reasons, reason.String())
+	}
+	s.log.Info("Annotated assessment",
+		zap.String("name", req.GetName()),
+		zap.String("annotation", req.GetAnnotation().String()),
+		zap.Strings("reasons", reasons))
+	return &recaptchaenterprisepb.AnnotateAssessmentResponse{}, nil
+}
+
+// Waiting for the latency, then failing the call at the error rate
+func injectGrpcFaults(ctx context.Context, faults FaultOptions, latency time.Duration) error {
+	latency += faults.Latency
+	if latency > 0 {
+		select {
+		case <-time.After(latency):
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		}
+	}
+	if faults.ErrorRate > 0 && mathrand.Float64() < faults.ErrorRate {
+		return status.Error(codes.Unavailable, "injected error")
+	}
+	return nil
+}
+
+// Mapping the HTTP statuses of the scripts to the gRPC codes, as the Google APIs do
+func grpcCode(httpStatus int) codes.Code {
+	switch httpStatus {
+	case http.StatusBadRequest:
+		return codes.InvalidArgument
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusConflict:
+		return codes.Aborted
+	case http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case http.StatusNotImplemented:
+		return codes.Unimplemented
+	case http.StatusServiceUnavailable:
+		return codes.Unavailable
+	case http.StatusGatewayTimeout:
+		return codes.DeadlineExceeded
+	default:
+		return codes.Internal
+	}
+}
+
+func randomId() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,27 @@
+package handlers
+
+import "sync"
+
+// ReplayLog rejects the tokens verified before, as Google does.
+type ReplayLog struct {
+	mu   sync.Mutex
+	seen map[string]bool
+}
+
+func NewReplayLog() *ReplayLog {
+	return &ReplayLog{seen: map[string]bool{}}
+}
+
+// Seen records the token, telling whether it was verified before. A nil log accepts the replays.
+func (l *ReplayLog) Seen(token string) bool {
+	if l == nil || token == "" {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.seen[token] {
+		return true
+	}
+	l.seen[token] = true
+	return false
+}
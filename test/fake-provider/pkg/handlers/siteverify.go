@@ -0,0 +1,129 @@
+package handlers
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"time"
+
+	chi "github.com/go-chi/chi/v5"
+	"github.com/pseudonator/recaptcha-test-fake-provider/pkg/script"
+	"go.uber.org/zap"
+)
+
+// FaultOptions inject latency and errors in every response, on top of the scripted ones.
+type FaultOptions struct {
+	Latency time.Duration
+	// Fraction of the requests answered with 503
+	ErrorRate float64
+}
+
+// SiteVerifyOptions of the fake siteverify API.
+type SiteVerifyOptions struct {
+	Script script.Script
+	// Secret expected from the callers, any secret when empty
+	Secret string
+	// Score and action of the tokens not setting them
+	DefaultScore  float64
+	DefaultAction string
+	Hostname      string
+	Faults        FaultOptions
+	// Rejects the tokens verified before when set
+	Replays *ReplayLog
+}
+
+type siteVerifyResp struct {
+	Success     bool       `json:"success"`
+	ChallengeTS *time.Time `json:"challenge_ts,omitempty"`
+	Score       *float64   `json:"score,omitempty"`
+	Action      string     `json:"action,omitempty"`
+	Hostname    string     `json:"hostname,omitempty"`
+	ErrorCodes  []string   `json:"error-codes,omitempty"`
+}
+
+// HandleSiteVerify serves the siteverify form API on the same path as Google.
+func HandleSiteVerify(mux chi.Router, opts *SiteVerifyOptions, log *zap.Logger) {
+	mux.Post("/recaptcha/api/siteverify", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			writeSiteVerify(w, siteVerifyResp{ErrorCodes: []string{"bad-request"}})
+			return
+		}
+		secret := r.PostForm.Get("secret")
+		token := r.PostForm.Get("response")
+
+		resp, scripted, err := opts.Script.Lookup(token)
+		if err != nil {
+			log.Info("Invalid scripted token", zap.String("token", token), zap.Error(err))
+			writeSiteVerify(w, siteVerifyResp{ErrorCodes: []string{"invalid-input-response"}})
+			return
+		}
+		if !injectFaults(w, r, opts.Faults, time.Duration(resp.Latency)) {
+			return
+		}
+		if resp.Status != 0 {
+			log.Info("Injected status", zap.String("token", token), zap.Int("status", resp.Status))
+			http.Error(w, http.StatusText(resp.Status), resp.Status)
+			return
+		}
+
+		switch {
+		case secret == "":
+			writeSiteVerify(w, siteVerifyResp{ErrorCodes: []string{"missing-input-secret"}})
+		case opts.Secret != "" && secret != opts.Secret:
+			writeSiteVerify(w, siteVerifyResp{ErrorCodes: []string{"invalid-input-secret"}})
+		case token == "":
+			writeSiteVerify(w, siteVerifyResp{ErrorCodes: []string{"missing-input-response"}})
+		case opts.Replays.Seen(token):
+			writeSiteVerify(w, siteVerifyResp{ErrorCodes: []string{"timeout-or-duplicate"}})
+		case len(resp.ErrorCodes) > 0:
+			writeSiteVerify(w, siteVerifyResp{ErrorCodes: resp.ErrorCodes})
+		case resp.InvalidReason != "":
+			writeSiteVerify(w, siteVerifyResp{ErrorCodes: []string{"invalid-input-response"}})
+		default:
+			result := siteVerifyResp{
+				Success:  true,
+				Score:    resp.Score,
+				Action:   resp.Action,
+				Hostname: resp.Hostname,
+			}
+			challengeTS := time.Now().Add(-time.Duration(resp.Age)).UTC().Truncate(time.Second)
+			result.ChallengeTS = &challengeTS
+			if result.Score == nil {
+				result.Score = &opts.DefaultScore
+			}
+			if result.Action == "" {
+				result.Action = opts.DefaultAction
+			}
+			if result.Hostname == "" {
+				result.Hostname = opts.Hostname
+			}
+			log.Info("Verified token", zap.Bool("scripted", scripted), zap.Float64("score", *result.Score), zap.String("action", result.Action))
+			writeSiteVerify(w, result)
+		}
+	})
+}
+
+// Waiting for the latency, then failing the request at the error rate. False is returned when
+// the request was answered or abandoned.
+func injectFaults(w http.ResponseWriter, r *http.Request, faults FaultOptions, latency time.Duration) bool {
+	latency += faults.Latency
+	if latency > 0 {
+		select {
+		case <-time.After(latency):
+		case <-r.Context().Done():
+			return false
+		}
+	}
+	if faults.ErrorRate > 0 && rand.Float64() < faults.ErrorRate {
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return false
+	}
+	return true
+}
+
+func writeSiteVerify(w http.ResponseWriter, resp siteVerifyResp) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		panic(err)
+	}
+}
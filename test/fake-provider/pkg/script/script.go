@@ -0,0 +1,167 @@
+// Package script resolves the scripted response of a token, either from a script file keyed by token or from
+// the token itself, made of `-` separated keys and values such as `score-0.2-action-login-latency-2s`.
+package script
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Response scripted for a token, the zero values fall back to the defaults of the server.
+type Response struct {
+	Score    *float64 `json:"score,omitempty"`
+	Action   string   `json:"action,omitempty"`
+	Hostname string   `json:"hostname,omitempty"`
+	// Age of the token, moving its creation time in the past
+	Age Duration `json:"age,omitempty"`
+	// Error codes of an unsuccessful verification, such as `timeout-or-duplicate`
+	ErrorCodes []string `json:"errorCodes,omitempty"`
+	// Injected latency before answering
+	Latency Duration `json:"latency,omitempty"`
+	// Injected HTTP status, answered without a verification result. The Enterprise API answers
+	// with the matching gRPC code.
+	Status int `json:"status,omitempty"`
+	// Enterprise only, names of the enums such as `AUTOMATION`, `EXPIRED` or `SUSPICIOUS_LOGIN_ACTIVITY`
+	Reasons         []string `json:"reasons,omitempty"`
+	InvalidReason   string   `json:"invalidReason,omitempty"`
+	Labels          []string `json:"labels,omitempty"`
+	TransactionRisk *float64 `json:"transactionRisk,omitempty"`
+}
+
+// Duration is a time.Duration read from a JSON string such as "2s".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var v string
+	if err := json.Unmarshal(b, &v); err != nil {
+		return fmt.Errorf("duration must be a string such as \"2s\": %w", err)
+	}
+	parsed, err := time.ParseDuration(v)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Script of the responses keyed by token.
+type Script map[string]Response
+
+// Load the script file, a JSON object of the responses keyed by token.
+func Load(path string) (Script, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the script: %w", err)
+	}
+	var s Script
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, fmt.Errorf("unable to parse the script: %w", err)
+	}
+	return s, nil
+}
+
+// Lookup the response of the token in the script, then in the token itself. The tokens which are neither
+// scripted nor made of known keys, such as real tokens, are not found.
+func (s Script) Lookup(token string) (Response, bool, error) {
+	if resp, ok := s[token]; ok {
+		return resp, true, nil
+	}
+	return Parse(token)
+}
+
+// Keys of the scripted tokens, the values may contain `-` as long as they don't match a key
+var keys = map[string]bool{
+	"score":    true,
+	"action":   true,
+	"hostname": true,
+	"age":      true,
+	"error":    true,
+	"latency":  true,
+	"status":   true,
+	"reason":   true,
+	"invalid":  true,
+	"label":    true,
+	"risk":     true,
+	"nonce":    true,
+}
+
+// Parse the token made of keys and values, e.g. `score-0.2-action-login`, `error-timeout-or-duplicate`
+// or `score-0.3-reason-AUTOMATION-reason-TOO_MUCH_TRAFFIC`.
+func Parse(token string) (Response, bool, error) {
+	parts := strings.Split(token, "-")
+	if !keys[parts[0]] {
+		return Response{}, false, nil
+	}
+	var fields [][2]string
+	for _, part := range parts {
+		if keys[part] {
+			fields = append(fields, [2]string{part, ""})
+			continue
+		}
+		field := &fields[len(fields)-1]
+		if field[1] == "" {
+			field[1] = part
+		} else {
+			field[1] += "-" + part
+		}
+	}
+
+	var resp Response
+	for _, field := range fields {
+		key, value := field[0], field[1]
+		if value == "" {
+			return Response{}, true, fmt.Errorf("no value for '%s'", key)
+		}
+		switch key {
+		case "score", "risk":
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil || v < 0 || v > 1 {
+				return Response{}, true, fmt.Errorf("invalid %s '%s'", key, value)
+			}
+			if key == "score" {
+				resp.Score = &v
+			} else {
+				resp.TransactionRisk = &v
+			}
+		case "action":
+			resp.Action = value
+		case "hostname":
+			resp.Hostname = value
+		case "error":
+			resp.ErrorCodes = append(resp.ErrorCodes, value)
+		case "reason":
+			resp.Reasons = append(resp.Reasons, value)
+		case "invalid":
+			resp.InvalidReason = value
+		case "label":
+			resp.Labels = append(resp.Labels, value)
+		case "nonce":
+			// Only makes the token unique, e.g. when the replays are rejected
+		case "age", "latency":
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return Response{}, true, fmt.Errorf("invalid %s '%s': %w", key, value, err)
+			}
+			if key == "age" {
+				resp.Age = Duration(d)
+			} else {
+				resp.Latency = Duration(d)
+			}
+		case "status":
+			status, err := strconv.Atoi(value)
+			if err != nil || status < 100 || status > 599 {
+				return Response{}, true, fmt.Errorf("invalid status '%s'", value)
+			}
+			resp.Status = status
+		}
+	}
+	return resp, true, nil
+}
@@ -0,0 +1,10 @@
+package server
+
+import (
+	"github.com/pseudonator/recaptcha-test-fake-provider/pkg/handlers"
+)
+
+func (s *Server) setupRoutes() {
+	handlers.HandleSiteVerify(s.mux, s.siteVerify, s.log)
+	handlers.HandleEnterprise(s.grpcServer, s.enterprise, s.log)
+}
@@ -0,0 +1,225 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	chi "github.com/go-chi/chi/v5"
+	"github.com/pseudonator/recaptcha-test-fake-provider/pkg/handlers"
+	"github.com/pseudonator/recaptcha-test-fake-provider/pkg/script"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+)
+
+const (
+	defaultServerHost = "localhost"
+	defaultServerPort = 9093
+	defaultGrpcPort   = 9094
+	defaultScore      = 0.9
+	defaultAction     = "submit"
+	defaultHostname   = "localhost"
+)
+
+type Options struct {
+	Log *zap.Logger
+}
+
+type Server struct {
+	address     string
+	grpcAddress string
+	log         *zap.Logger
+	mux         chi.Router
+	server      *http.Server
+	grpcServer  *grpc.Server
+	siteVerify  *handlers.SiteVerifyOptions
+	enterprise  *handlers.EnterpriseOptions
+}
+
+type loggerWrapper struct {
+	log *zap.Logger
+}
+
+func New(opts Options) *Server {
+	if opts.Log == nil {
+		opts.Log = zap.NewNop()
+	}
+	log := opts.Log
+
+	lw := &loggerWrapper{log: log}
+
+	address := lw.getBindingAddress()
+	mux := chi.NewMux()
+	responses := lw.getScript()
+	score := lw.getFloatOrDefault("DEFAULT_SCORE", defaultScore)
+	action := lw.getStringOrDefault("DEFAULT_ACTION", defaultAction)
+	hostname := lw.getStringOrDefault("HOSTNAME_CLAIM", defaultHostname)
+	faults := handlers.FaultOptions{
+		Latency:   lw.getDurationOrDefault("LATENCY", 0),
+		ErrorRate: lw.getFloatOrDefault("ERROR_RATE", 0),
+	}
+	var replays *handlers.ReplayLog
+	if lw.getBoolOrDefault("REJECT_REPLAYS", false) {
+		replays = handlers.NewReplayLog()
+	}
+	return &Server{
+		address:     address,
+		grpcAddress: lw.getGrpcBindingAddress(),
+		log:         log,
+		mux:         mux,
+		server: &http.Server{
+			Addr:              address,
+			Handler:           mux,
+			ReadTimeout:       5 * time.Second,
+			ReadHeaderTimeout: 5 * time.Second,
+			// Leaving room for the injected latency
+			WriteTimeout: 5 * time.Minute,
+			IdleTimeout:  5 * time.Second,
+		},
+		grpcServer: grpc.NewServer(),
+		siteVerify: &handlers.SiteVerifyOptions{
+			Script:        responses,
+			Secret:        lw.getStringOrDefault("SITEVERIFY_SECRET", ""),
+			DefaultScore:  score,
+			DefaultAction: action,
+			Hostname:      hostname,
+			Faults:        faults,
+			Replays:       replays,
+		},
+		enterprise: &handlers.EnterpriseOptions{
+			Script:        responses,
+			DefaultScore:  score,
+			DefaultAction: action,
+			Hostname:      hostname,
+			Faults:        faults,
+			Replays:       replays,
+		},
+	}
+}
+
+func (lw *loggerWrapper) getBindingAddress() string {
+	host := lw.getStringOrDefault("SERVER_HOST", defaultServerHost)
+	port := lw.getIntOrDefault("SERVER_PORT", defaultServerPort)
+	address := net.JoinHostPort(host, strconv.Itoa(port))
+	return address
+}
+
+// The Enterprise API is served with gRPC in plaintext on its own port
+func (lw *loggerWrapper) getGrpcBindingAddress() string {
+	host := lw.getStringOrDefault("SERVER_HOST", defaultServerHost)
+	port := lw.getIntOrDefault("GRPC_PORT", defaultGrpcPort)
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// Loading the responses keyed by token, the tokens are only parsed when no script is given
+func (lw *loggerWrapper) getScript() script.Script {
+	path := lw.getStringOrDefault("SCRIPT_FILE", "")
+	if path == "" {
+		return script.Script{}
+	}
+	s, err := script.Load(path)
+	if err != nil {
+		panic(err)
+	}
+	lw.log.Info("loaded script", zap.String("path", path), zap.Int("tokens", len(s)))
+	return s
+}
+
+// Start by setting up routes and listening for HTTP requests on the given address.
+func (s *Server) Start() error {
+	s.setupRoutes()
+
+	listener, err := net.Listen("tcp", s.grpcAddress)
+	if err != nil {
+		return fmt.Errorf("error starting gRPC server: %w", err)
+	}
+	go func() {
+		s.log.Info("starting gRPC server", zap.String("address", s.grpcAddress))
+		if err := s.grpcServer.Serve(listener); err != nil {
+			s.log.Error("error serving gRPC", zap.Error(err))
+		}
+	}()
+
+	s.log.Info("starting server", zap.String("address", s.address))
+	if err := s.server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("error starting server: %w", err)
+	}
+	return nil
+}
+
+// Stop gracefully within the timeout.
+func (s *Server) Stop() error {
+	s.log.Info("stopping server")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	s.grpcServer.GracefulStop()
+	if err := s.server.Shutdown(ctx); err != nil {
+		return fmt.Errorf("error stopping server: %w", err)
+	}
+
+	return nil
+}
+
+func (lw *loggerWrapper) getBoolOrDefault(name string, defaultV bool) bool {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return defaultV
+	}
+	vAsBool, err := strconv.ParseBool(v)
+	if err != nil {
+		return defaultV
+	}
+	return vAsBool
+}
+
+func (lw *loggerWrapper) getStringOrDefault(name string, defaultV string) string {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return defaultV
+	}
+	return strings.TrimSpace(v)
+}
+
+func (lw *loggerWrapper) getIntOrDefault(name string, defaultV int) int {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return defaultV
+	}
+	vAsInt, err := strconv.Atoi(v)
+	if err != nil {
+		return defaultV
+	}
+	return vAsInt
+}
+
+func (lw *loggerWrapper) getFloatOrDefault(name string, defaultV float64) float64 {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return defaultV
+	}
+	vAsFloat, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return defaultV
+	}
+	return vAsFloat
+}
+
+func (lw *loggerWrapper) getDurationOrDefault(name string, defaultV time.Duration) time.Duration {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return defaultV
+	}
+	vAsDuration, err := time.ParseDuration(v)
+	if err != nil {
+		return defaultV
+	}
+	return vAsDuration
+}